@@ -1,12 +1,166 @@
 package main
 
-import "fmt"
-
-// analyzeSession is a placeholder for the session analysis tool.
-func analyzeSession() error {
-	fmt.Println("This is a placeholder for the 'analyze_session' tool.")
-	fmt.Println("This tool would typically inspect active or recent database sessions for anomalies.")
-	// In a real implementation, this would involve connecting to the database
-	// and querying system catalogs like pg_stat_activity.
-	return nil
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/spf13/cobra"
+)
+
+// Longest query text printed per session before it is truncated
+const sessionQueryWidth = 60
+
+// Sessions that are not idle, oldest first. Greenplum 6 reports lock waits in
+// the waiting and waiting_reason columns, while Greenplum 7 uses wait events.
+const (
+	activeSessionsQuery = `select pid, sess_id, usename, datname, state,
+       %s as waiting_on,
+       now() - query_start as runtime,
+       query
+from pg_stat_activity
+where state <> 'idle' and pid <> pg_backend_pid()
+  and query_start <= now() - $1::interval
+order by query_start`
+
+	waitingColumnsGP6 = "case when waiting then coalesce(waiting_reason, 'lock') else '' end"
+	waitingColumnsGP7 = "coalesce(wait_event_type || ': ' || wait_event, '')"
+)
+
+// Ungranted locks on the coordinator and the sessions holding what they wait for
+const blockedSessionsQuery = `select waiting.pid as waiting_pid, blocking.pid as blocking_pid,
+       waiting.locktype, coalesce(waiting.relation::regclass::text, '') as relation, waiting.mode
+from pg_locks waiting
+join pg_locks blocking
+  on blocking.granted
+ and blocking.pid <> waiting.pid
+ and blocking.locktype = waiting.locktype
+ and blocking.gp_segment_id = waiting.gp_segment_id
+ and blocking.database is not distinct from waiting.database
+ and blocking.relation is not distinct from waiting.relation
+ and blocking.transactionid is not distinct from waiting.transactionid
+where not waiting.granted and waiting.gp_segment_id = -1
+order by waiting.pid, blocking.pid`
+
+// AnalyzeSessionOptions define the options/flag for the analyze_session command
+type AnalyzeSessionOptions struct {
+	minRuntime time.Duration
+}
+
+var asOpts AnalyzeSessionOptions
+
+// activeSession is one row of activeSessionsQuery
+type activeSession struct {
+	Pid       int64       `db:"pid"`
+	SessID    int64       `db:"sess_id"`
+	Username  string      `db:"usename"`
+	Database  string      `db:"datname"`
+	State     string      `db:"state"`
+	WaitingOn string      `db:"waiting_on"`
+	Runtime   db.Interval `db:"runtime"`
+	Query     string      `db:"query"`
+}
+
+// blockedSession is one row of blockedSessionsQuery
+type blockedSession struct {
+	WaitingPid  int64  `db:"waiting_pid"`
+	BlockingPid int64  `db:"blocking_pid"`
+	LockType    string `db:"locktype"`
+	Relation    string `db:"relation"`
+	Mode        string `db:"mode"`
+}
+
+// Sub Command: Analyze Session
+// Lists the sessions doing work on the cluster and which of them are stuck
+// behind another session's locks
+var analyzeSessionCmd = &cobra.Command{
+	Use:   "analyze_session",
+	Short: "inspect active database sessions",
+	Long: "\nanalyze_session lists the sessions currently running on the cluster, \n" +
+		"what they are waiting on, and which sessions hold the locks blocking them",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := openClient(cmd.Context())
+		if err != nil {
+			fmt.Printf("Error connecting to the database: %s\n", connectionHint(err))
+			os.Exit(1)
+		}
+		defer client.Close()
+
+		if err := analyzeSession(cmd.Context(), client, cmd.OutOrStdout(), asOpts); err != nil {
+			fmt.Printf("Error analyzing sessions: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// analyzeSession reports active sessions and lock waits to out.
+func analyzeSession(ctx context.Context, querier db.Querier, out io.Writer, opts AnalyzeSessionOptions) error {
+	info, err := querier.ServerInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to detect the server version: %w", err)
+	}
+
+	waitingColumns := waitingColumnsGP6
+	if info.PostgresVersion.AtLeast(9, 6) {
+		waitingColumns = waitingColumnsGP7
+	}
+	minRuntime := fmt.Sprintf("%d milliseconds", opts.minRuntime.Milliseconds())
+
+	result, err := querier.ExecuteQueryContext(ctx, fmt.Sprintf(activeSessionsQuery, waitingColumns), minRuntime)
+	if err != nil {
+		return fmt.Errorf("failed to query pg_stat_activity: %w", err)
+	}
+	var sessions []activeSession
+	if err := result.ScanStructs(&sessions); err != nil {
+		return fmt.Errorf("failed to read pg_stat_activity: %w", err)
+	}
+
+	result, err = querier.ExecuteQueryContext(ctx, blockedSessionsQuery)
+	if err != nil {
+		return fmt.Errorf("failed to query pg_locks: %w", err)
+	}
+	var blocked []blockedSession
+	if err := result.ScanStructs(&blocked); err != nil {
+		return fmt.Errorf("failed to read pg_locks: %w", err)
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "Active sessions: %d\n", len(sessions))
+	if len(sessions) > 0 {
+		fmt.Fprintln(writer, "PID\tSESSION\tUSER\tDATABASE\tSTATE\tRUNTIME\tWAITING ON\tQUERY")
+		for _, session := range sessions {
+			fmt.Fprintf(writer, "%d\tcon%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				session.Pid, session.SessID, session.Username, session.Database, session.State,
+				session.Runtime.Duration().Truncate(time.Second), session.WaitingOn, truncateQuery(session.Query))
+		}
+	}
+
+	fmt.Fprintf(writer, "\nBlocked sessions: %d\n", len(blocked))
+	if len(blocked) > 0 {
+		fmt.Fprintln(writer, "WAITING PID\tBLOCKED BY\tLOCK TYPE\tRELATION\tMODE")
+		for _, lock := range blocked {
+			fmt.Fprintf(writer, "%d\t%d\t%s\t%s\t%s\n",
+				lock.WaitingPid, lock.BlockingPid, lock.LockType, lock.Relation, lock.Mode)
+		}
+	}
+	return writer.Flush()
+}
+
+// Collapse a query onto one line and cut it to sessionQueryWidth characters.
+func truncateQuery(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if runes := []rune(query); len(runes) > sessionQueryWidth {
+		return string(runes[:sessionQueryWidth-3]) + "..."
+	}
+	return query
+}
+
+func init() {
+	rootCmd.AddCommand(analyzeSessionCmd)
+	analyzeSessionCmd.Flags().DurationVar(&asOpts.minRuntime, "min-runtime", 0, "Only report sessions whose current query has run at least this long (e.g. 5m)")
 }
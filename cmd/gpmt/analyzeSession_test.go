@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+)
+
+var (
+	activeSessionColumns = []db.Column{
+		{Name: "pid", DatabaseType: "INT4"},
+		{Name: "sess_id", DatabaseType: "INT4"},
+		{Name: "usename", DatabaseType: "NAME"},
+		{Name: "datname", DatabaseType: "NAME"},
+		{Name: "state", DatabaseType: "TEXT"},
+		{Name: "waiting_on", DatabaseType: "TEXT"},
+		{Name: "runtime", DatabaseType: "INTERVAL"},
+		{Name: "query", DatabaseType: "TEXT"},
+	}
+	blockedSessionColumns = []db.Column{
+		{Name: "waiting_pid", DatabaseType: "INT4"},
+		{Name: "blocking_pid", DatabaseType: "INT4"},
+		{Name: "locktype", DatabaseType: "TEXT"},
+		{Name: "relation", DatabaseType: "TEXT"},
+		{Name: "mode", DatabaseType: "TEXT"},
+	}
+)
+
+func TestAnalyzeSession(t *testing.T) {
+	testCases := []struct {
+		name          string
+		version       string
+		waitingColumn string
+	}{
+		{name: "greenplum 6", version: dbtest.Greenplum6Version, waitingColumn: "waiting_reason"},
+		{name: "greenplum 7", version: dbtest.Greenplum7Version, waitingColumn: "wait_event_type"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			querier := dbtest.NewQuerier()
+			querier.Info = dbtest.GreenplumInfo(tc.version, "group")
+			querier.Handle(`from pg_stat_activity`, db.NewResult(activeSessionColumns,
+				[]interface{}{int64(101), int64(7), "gpadmin", "sales", "active", "", db.Interval{Microseconds: 90e6}, "select\n  count(*)  from orders"},
+				[]interface{}{int64(102), int64(8), "etl", "sales", "active", "lock", db.Interval{Microseconds: 30e6}, "truncate orders"},
+			))
+			querier.Handle(`from pg_locks`, db.NewResult(blockedSessionColumns,
+				[]interface{}{int64(102), int64(101), "relation", "orders", "AccessExclusiveLock"},
+			))
+
+			var out bytes.Buffer
+			if err := analyzeSession(context.Background(), querier, &out, AnalyzeSessionOptions{}); err != nil {
+				t.Fatalf("analyzeSession failed: %v", err)
+			}
+
+			queries := querier.Queries()
+			if len(queries) == 0 || !strings.Contains(queries[0], tc.waitingColumn) {
+				t.Errorf("Expected the session query to use %s, got %v", tc.waitingColumn, queries)
+			}
+			for _, expected := range []string{
+				"Active sessions: 2",
+				"con7",
+				"1m30s",
+				"select count(*) from orders",
+				"Blocked sessions: 1",
+				"AccessExclusiveLock",
+			} {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeSessionMinRuntime(t *testing.T) {
+	querier := dbtest.NewQuerier()
+	querier.Info = dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group")
+	var minRuntime interface{}
+	querier.HandleFunc(`from pg_stat_activity`, func(query string, args []interface{}) (*db.Result, error) {
+		minRuntime = args[0]
+		return db.NewResult(activeSessionColumns), nil
+	})
+	querier.Handle(`from pg_locks`, db.NewResult(blockedSessionColumns))
+
+	var out bytes.Buffer
+	if err := analyzeSession(context.Background(), querier, &out, AnalyzeSessionOptions{minRuntime: 5 * time.Minute}); err != nil {
+		t.Fatalf("analyzeSession failed: %v", err)
+	}
+	if minRuntime != "300000 milliseconds" {
+		t.Errorf("Expected the minimum runtime as a bind argument, got %v", minRuntime)
+	}
+	if !strings.Contains(out.String(), "Active sessions: 0") || !strings.Contains(out.String(), "Blocked sessions: 0") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+func TestTruncateQuery(t *testing.T) {
+	long := strings.Repeat("x", sessionQueryWidth+10)
+	if truncated := truncateQuery(long); len(truncated) != sessionQueryWidth || !strings.HasSuffix(truncated, "...") {
+		t.Errorf("Expected a %d character query ending in ..., got %q", sessionQueryWidth, truncated)
+	}
+	if truncated := truncateQuery("select 1"); truncated != "select 1" {
+		t.Errorf("Expected a short query unchanged, got %q", truncated)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archive directory holding the configuration files and catalog snapshots
+const catalogArchiveDir = "catalog"
+
+// catalogSnapshot is one file of the catalog directory. Snapshots that do not
+// apply to the server, such as resource groups on a cluster using resource
+// queues, are skipped.
+type catalogSnapshot struct {
+	name    string
+	applies func(info *db.ServerInfo) bool
+	collect func(ctx context.Context, querier db.Querier, info *db.ServerInfo) ([]byte, error)
+}
+
+var catalogSnapshots = []catalogSnapshot{
+	{name: "version.txt", collect: func(ctx context.Context, querier db.Querier, info *db.ServerInfo) ([]byte, error) {
+		return []byte(info.VersionString + "\n"), nil
+	}},
+	{name: "postgresql.conf", collect: serverFile("postgresql.conf")},
+	{name: "pg_hba.conf", collect: serverFile("pg_hba.conf")},
+	{name: "gp_segment_configuration.csv", collect: queryCSV(`select * from gp_segment_configuration order by content, role desc`)},
+	{name: "pg_settings.csv", collect: queryCSV(`select name, setting, unit, category, context, source, sourcefile, sourceline
+from pg_settings
+order by name`)},
+	{
+		name: "pg_settings_segment_diffs.csv",
+		applies: func(info *db.ServerInfo) bool {
+			return info.HasGPToolkit("gp_param_settings_seg_value_diffs")
+		},
+		collect: queryCSV(`select psdname, psdvalue, psdsegment
+from gp_toolkit.gp_param_settings_seg_value_diffs
+order by psdname, psdsegment`),
+	},
+	{
+		name: "resource_groups.csv",
+		applies: func(info *db.ServerInfo) bool {
+			return info.UsesResourceGroups() && info.HasGPToolkit("gp_resgroup_config")
+		},
+		collect: queryCSV(`select * from gp_toolkit.gp_resgroup_config order by groupname`),
+	},
+	{
+		name: "resource_queues.csv",
+		applies: func(info *db.ServerInfo) bool {
+			return info.UsesResourceQueues()
+		},
+		collect: queryCSV(`select rsqname, resname, ressetting
+from pg_resqueue_attributes
+order by rsqname, resname`),
+	},
+	{name: "gp_configuration_history.csv", collect: queryCSV(`select * from gp_configuration_history order by time, dbid`)},
+}
+
+// queryCSV is a snapshot of a query's result as CSV.
+func queryCSV(query string) func(context.Context, db.Querier, *db.ServerInfo) ([]byte, error) {
+	return func(ctx context.Context, querier db.Querier, info *db.ServerInfo) ([]byte, error) {
+		result, err := querier.ExecuteQueryContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return resultCSV(result)
+	}
+}
+
+// serverFile is a snapshot of a file in the coordinator's data directory,
+// read through the server so gpmt need not run on the coordinator host.
+func serverFile(name string) func(context.Context, db.Querier, *db.ServerInfo) ([]byte, error) {
+	return func(ctx context.Context, querier db.Querier, info *db.ServerInfo) ([]byte, error) {
+		result, err := querier.ExecuteQueryContext(ctx, "select pg_read_file($1) as content", name)
+		if err != nil {
+			return nil, err
+		}
+		if result.Len() != 1 {
+			return nil, fmt.Errorf("pg_read_file returned %d rows", result.Len())
+		}
+		content, err := result.Rows[0].String("content")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(content), nil
+	}
+}
+
+// addCatalogSnapshots writes every applicable catalog snapshot into the
+// archive. A snapshot that cannot be taken, for example for lack of
+// privileges, is reported, recorded in the manifest and skipped; only
+// failing to write the archive is an error.
+func addCatalogSnapshots(ctx context.Context, querier db.Querier, aw *archiveWriter) error {
+	host := coordinatorHostname(ctx, querier)
+	info, err := querier.ServerInfo(ctx)
+	if err != nil {
+		log.Warnf("Skipping the catalog snapshots: %v", err)
+		aw.manifest.addError(host, catalogArchiveDir, err)
+		return nil
+	}
+
+	for _, snapshot := range catalogSnapshots {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if snapshot.applies != nil && !snapshot.applies(info) {
+			continue
+		}
+
+		name := path.Join(catalogArchiveDir, snapshot.name)
+		data, err := snapshot.collect(ctx, querier, info)
+		if err != nil {
+			log.Warnf("Skipping %s: %v", snapshot.name, err)
+			aw.manifest.addError(host, name, err)
+			continue
+		}
+		if err := addBytesToTar(aw, name, host, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coordinatorHostname names the coordinator the way gp_segment_configuration
+// does, for the manifest entries of what was queried from it. It falls back
+// to this host's name, as gpmt normally runs on the coordinator.
+func coordinatorHostname(ctx context.Context, querier db.Querier) string {
+	segments, err := db.ListSegments(ctx, querier)
+	if err != nil {
+		log.Debugf("Failed to look up the coordinator's hostname: %v", err)
+		return localHostname()
+	}
+	for _, segment := range segments {
+		if segment.ContentID == db.CoordinatorContentID && segment.Role == db.RolePrimary {
+			return segment.Hostname
+		}
+	}
+	return localHostname()
+}
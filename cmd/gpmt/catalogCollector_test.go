@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+// Script every catalog snapshot query with a one column result.
+func catalogQuerier(info *db.ServerInfo) *dbtest.Querier {
+	querier := dbtest.NewQuerier()
+	querier.Info = info
+	single := func(column string, value string) *db.Result {
+		return db.NewResult([]db.Column{{Name: column, DatabaseType: "TEXT"}}, []interface{}{value})
+	}
+	querier.HandleFunc(`pg_read_file`, func(query string, args []interface{}) (*db.Result, error) {
+		return single("content", "# "+args[0].(string)+"\n"), nil
+	})
+	querier.Handle(`select \* from gp_segment_configuration`, single("hostname", "sdw1"))
+	querier.Handle(`from pg_settings`, single("name", "work_mem"))
+	querier.Handle(`gp_param_settings_seg_value_diffs`, single("psdname", "gp_vmem_protect_limit"))
+	querier.Handle(`gp_resgroup_config`, single("groupname", "admin_group"))
+	querier.Handle(`pg_resqueue_attributes`, single("rsqname", "pg_default"))
+	querier.Handle(`from gp_configuration_history`, single("desc", "FTS: update status"))
+	querier.Segments([]db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: "/data/coordinator/gpseg-1"},
+		{DBID: 2, ContentID: -1, Role: "m", Hostname: "scdw", Address: "scdw", DataDir: "/data/coordinator/gpseg-1"},
+	})
+	return querier
+}
+
+func TestAddCatalogSnapshots(t *testing.T) {
+	testCases := []struct {
+		name     string
+		info     *db.ServerInfo
+		expected []string
+	}{
+		{
+			name: "greenplum 6 with resource queues",
+			info: dbtest.GreenplumInfo(dbtest.Greenplum6Version, "queue", "gp_param_settings_seg_value_diffs"),
+			expected: []string{
+				"catalog/gp_configuration_history.csv", "catalog/gp_segment_configuration.csv", "catalog/pg_hba.conf",
+				"catalog/pg_settings.csv", "catalog/pg_settings_segment_diffs.csv", "catalog/postgresql.conf",
+				"catalog/resource_queues.csv", "catalog/version.txt",
+			},
+		},
+		{
+			name: "greenplum 7 with resource groups",
+			info: dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group", "gp_param_settings_seg_value_diffs", "gp_resgroup_config"),
+			expected: []string{
+				"catalog/gp_configuration_history.csv", "catalog/gp_segment_configuration.csv", "catalog/pg_hba.conf",
+				"catalog/pg_settings.csv", "catalog/pg_settings_segment_diffs.csv", "catalog/postgresql.conf",
+				"catalog/resource_groups.csv", "catalog/version.txt",
+			},
+		},
+		{
+			name: "without gp_toolkit",
+			info: dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group"),
+			expected: []string{
+				"catalog/gp_configuration_history.csv", "catalog/gp_segment_configuration.csv", "catalog/pg_hba.conf",
+				"catalog/pg_settings.csv", "catalog/postgresql.conf", "catalog/version.txt",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			archiveName := filepath.Join(t.TempDir(), "catalog.tar.gz")
+			manifest := &archiveManifest{}
+			err := writeArchive(archiveName, manifest, nil, func(aw *archiveWriter) error {
+				return addCatalogSnapshots(context.Background(), catalogQuerier(tc.info), aw)
+			})
+			if err != nil {
+				t.Fatalf("addCatalogSnapshots failed: %v", err)
+			}
+			if entries := archiveEntries(t, archiveName); !reflect.DeepEqual(entries, tc.expected) {
+				t.Errorf("Expected archive entries %v, got %v", tc.expected, entries)
+			}
+			if version := archiveFile(t, archiveName, "catalog/version.txt"); version != tc.info.VersionString+"\n" {
+				t.Errorf("Unexpected version.txt %q", version)
+			}
+			if hba := archiveFile(t, archiveName, "catalog/pg_hba.conf"); hba != "# pg_hba.conf\n" {
+				t.Errorf("Unexpected pg_hba.conf %q", hba)
+			}
+			// Attributed to the coordinator, wherever gpmt runs
+			for _, entry := range manifest.Entries {
+				if entry.Host != "cdw" {
+					t.Errorf("Expected %s to come from cdw, got %s", entry.Name, entry.Host)
+				}
+			}
+		})
+	}
+}
+
+func TestCoordinatorHostname(t *testing.T) {
+	querier := catalogQuerier(dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group"))
+	if host := coordinatorHostname(context.Background(), querier); host != "cdw" {
+		t.Errorf("Expected cdw, got %s", host)
+	}
+
+	// Without gp_segment_configuration, this host stands in for it
+	querier.HandleError(`from gp_segment_configuration`, errors.New("permission denied"))
+	if host := coordinatorHostname(context.Background(), querier); host != localHostname() {
+		t.Errorf("Expected %s, got %s", localHostname(), host)
+	}
+}
+
+// Snapshots that fail, e.g. pg_read_file without superuser, are skipped and
+// the logs are still collected.
+func TestLogCollectorCatalogFailures(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	dataDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dataDir, "log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "log", "startup.log"), []byte("ok\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	querier := catalogQuerier(dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group"))
+	querier.HandleError(`pg_read_file`, errors.New("permission denied for function pg_read_file"))
+	querier.Handle(`select distinct datadir from gp_segment_configuration`,
+		db.NewResult([]db.Column{{Name: "datadir", DatabaseType: "TEXT"}}, []interface{}{dataDir}))
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01"}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	entries := archiveEntries(t, archiveName)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, ".conf") {
+			t.Errorf("Expected the unreadable configuration files to be skipped, got %s", entry)
+		}
+	}
+	expected := []string{"catalog/gp_configuration_history.csv", "catalog/gp_segment_configuration.csv",
+		"catalog/pg_settings.csv", "catalog/version.txt", "startup.log"}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+)
+
+// Archive entry holding the gp_configuration_history rows behind
+// --failed-segs, next to the catalog snapshot of the whole table
+const failedSegmentsHistoryEntry = catalogArchiveDir + "/failed_segments_history.csv"
+
+// Segment status changes inside the collection window. The history only
+// records the dbid, so the content id comes from the current configuration.
+const configurationHistoryQuery = `select h.time, h.dbid, c.content, h."desc"
+from gp_configuration_history h
+left join gp_segment_configuration c on c.dbid = h.dbid
+where h.time >= $1 and h.time < $2
+order by h.time, h.dbid`
+
+// failedSegmentHistory returns the gp_configuration_history rows recorded
+// inside window.
+func failedSegmentHistory(ctx context.Context, querier db.Querier, window timeWindow) (*db.Result, error) {
+	if querier == nil {
+		return nil, fmt.Errorf("--failed-segs needs a database connection to read gp_configuration_history")
+	}
+	history, err := querier.ExecuteQueryContext(ctx, configurationHistoryQuery, window.start, window.end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query gp_configuration_history: %w", err)
+	}
+	return history, nil
+}
+
+// changedContentIDs lists, in order, the segment content ids that appear in
+// the history. The coordinator's rows are left out, and so are those of
+// dbids no longer in the configuration, which have no content id.
+func changedContentIDs(history *db.Result) ([]int, error) {
+	seen := make(map[int]bool)
+	var contentIDs []int
+	for _, row := range history.Rows {
+		contentID, err := row.NullInt64("content")
+		if err != nil {
+			return nil, err
+		}
+		if !contentID.Valid || contentID.Int64 == db.CoordinatorContentID || seen[int(contentID.Int64)] {
+			continue
+		}
+		seen[int(contentID.Int64)] = true
+		contentIDs = append(contentIDs, int(contentID.Int64))
+	}
+	sort.Ints(contentIDs)
+	return contentIDs, nil
+}
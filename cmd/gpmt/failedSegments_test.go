@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+var configurationHistoryColumns = []db.Column{
+	{Name: "time", DatabaseType: "TIMESTAMPTZ"},
+	{Name: "dbid", DatabaseType: "INT2"},
+	{Name: "content", DatabaseType: "INT2"},
+	{Name: "desc", DatabaseType: "TEXT"},
+}
+
+func TestChangedContentIDs(t *testing.T) {
+	changed := time.Date(2024, 1, 15, 14, 5, 0, 0, time.Local)
+	history := db.NewResult(configurationHistoryColumns,
+		[]interface{}{changed, int64(6), int64(2), "FTS: update status for dbid 6 to d"},
+		[]interface{}{changed, int64(1), int64(-1), "coordinator promoted"},
+		[]interface{}{changed, int64(3), int64(0), "FTS: update status for dbid 3 to d"},
+		[]interface{}{changed, int64(9), nil, "dbid removed by expansion"},
+		[]interface{}{changed, int64(7), int64(2), "FTS: update status for dbid 7 to u"},
+	)
+	contentIDs, err := changedContentIDs(history)
+	if err != nil {
+		t.Fatalf("changedContentIDs failed: %v", err)
+	}
+	if expected := []int{0, 2}; !reflect.DeepEqual(contentIDs, expected) {
+		t.Errorf("Expected %v, got %v", expected, contentIDs)
+	}
+}
+
+func TestFailedSegmentHistoryWindow(t *testing.T) {
+	window, err := parseTimeWindow("2024-01-15 14:00", "2024-01-15 15:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	querier := dbtest.NewQuerier()
+	var args []interface{}
+	querier.HandleFunc(`from gp_configuration_history`, func(query string, queryArgs []interface{}) (*db.Result, error) {
+		args = queryArgs
+		return db.NewResult(configurationHistoryColumns), nil
+	})
+
+	if _, err := failedSegmentHistory(context.Background(), querier, window); err != nil {
+		t.Fatalf("failedSegmentHistory failed: %v", err)
+	}
+	if expected := []interface{}{window.start, window.end}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected the window %v as bind arguments, got %v", expected, args)
+	}
+
+	if _, err := failedSegmentHistory(context.Background(), nil, window); err == nil {
+		t.Error("Expected an error without a database connection")
+	}
+}
+
+func TestLogCollectorFailedSegments(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	for _, dataDir := range []string{"coordinator", "primary0", "mirror0", "primary1", "mirror1"} {
+		logDir := filepath.Join(root, dataDir, "log")
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte(dataDir+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 4, ContentID: 0, Role: "m", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "mirror0")},
+		{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "primary1")},
+		{DBID: 5, ContentID: 1, Role: "m", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "mirror1")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+	// Only the windowed query has bind arguments, the full catalog snapshot
+	// none
+	querier.HandleFunc(`from gp_configuration_history`, func(query string, args []interface{}) (*db.Result, error) {
+		if len(args) == 0 {
+			return db.NewResult(configurationHistoryColumns,
+				[]interface{}{time.Date(1999, 1, 15, 14, 5, 0, 0, time.UTC), int64(2), int64(0), "FTS: update status for dbid 2 to d"},
+			), nil
+		}
+		return db.NewResult(configurationHistoryColumns,
+			[]interface{}{time.Date(2024, 1, 15, 14, 5, 0, 0, time.UTC), int64(3), int64(1), "FTS: update status for dbid 3 to d"},
+		), nil
+	})
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", failedOnly: true, segmentDir: t.TempDir()}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	// Only the failed segments' logs, without the coordinator's
+	expected := []string{
+		"sdw1/gpseg1-m/startup.log",
+		"sdw2/gpseg1-p/startup.log",
+	}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+
+	// The rows inside the window are archived apart from the full snapshot
+	history := archiveFile(t, archiveName, failedSegmentsHistoryEntry)
+	if !strings.Contains(history, "dbid 3 to d") || strings.Contains(history, "dbid 2 to d") {
+		t.Errorf("Expected only the rows inside the window in %s, got:\n%s", failedSegmentsHistoryEntry, history)
+	}
+	snapshot := archiveFile(t, archiveName, "catalog/gp_configuration_history.csv")
+	if !strings.Contains(snapshot, "dbid 2 to d") {
+		t.Errorf("Expected the whole table in the catalog snapshot, got:\n%s", snapshot)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// errInsufficientSpace aborts a collection that would leave, or has left, a
+// disk with less free space than --free-space allows.
+var errInsufficientSpace = errors.New("not enough free space")
+
+// How often the archive's disk is checked while it is being written.
+var freeSpaceCheckInterval = 2 * time.Second
+
+// statDisk reports the usage of the file system holding a local directory.
+// Tests replace it to simulate a filling disk.
+var statDisk = localDiskUsage
+
+// diskUsage is the size of a file system and the bytes still available to
+// unprivileged users.
+type diskUsage struct {
+	total     uint64
+	available uint64
+}
+
+// localDiskUsage reports the usage of the file system holding dir.
+func localDiskUsage(dir string) (diskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return diskUsage{}, fmt.Errorf("failed to check free space on %s: %w", dir, err)
+	}
+	return diskUsage{
+		total:     uint64(stat.Blocks) * uint64(stat.Bsize),
+		available: uint64(stat.Bavail) * uint64(stat.Bsize),
+	}, nil
+}
+
+// remoteDiskUsage reports the usage of the file system holding dir on host.
+func remoteDiskUsage(ctx context.Context, executor remote.Executor, host string, dir string) (diskUsage, error) {
+	output, err := remote.Output(ctx, executor, host, "df -Pk "+remote.Quote(dir))
+	if err != nil {
+		return diskUsage{}, fmt.Errorf("failed to check free space on %s:%s: %w", host, dir, err)
+	}
+	return parseDF(string(output))
+}
+
+// Parse the second line of POSIX df -Pk output, sizes in kilobytes:
+// Filesystem 1024-blocks Used Available Capacity Mounted on
+func parseDF(output string) (diskUsage, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return diskUsage{}, fmt.Errorf("unexpected df output %q", output)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return diskUsage{}, fmt.Errorf("unexpected df output %q", output)
+	}
+	total, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return diskUsage{}, fmt.Errorf("unexpected df size %q", fields[1])
+	}
+	available, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return diskUsage{}, fmt.Errorf("unexpected df available space %q", fields[3])
+	}
+	return diskUsage{total: total * 1024, available: available * 1024}, nil
+}
+
+// remainsAbove reports whether writing need more bytes still leaves at least
+// percent of the file system free.
+func (usage diskUsage) remainsAbove(need uint64, percent int) bool {
+	reserve := usage.total / 100 * uint64(percent)
+	return usage.available >= need && usage.available-need >= reserve
+}
+
+// Format a byte count for messages.
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// checkFreeSpace makes sure the collection fits before anything is written.
+// The archive is estimated at the uncompressed size of every planned file,
+// and the spools of the largest hosts collected at once have to fit next to
+// it, as does redactSize, the temporary copy of the largest file with
+// --redact; each segment host has to fit its own staged files in --segdir. A
+// host whose free space cannot be read is left for the collection itself to
+// report.
+func checkFreeSpace(ctx context.Context, executor remote.Executor, pool hostPool, archiveDir string, percent int,
+	localSize uint64, redactSize uint64, hosts []hostLogs, segmentDir string) error {
+	if percent <= 0 {
+		return nil
+	}
+
+	need := localSize + redactSize
+	sizes := make([]uint64, len(hosts))
+	for idx, target := range hosts {
+		sizes[idx] = target.size()
+		need += sizes[idx]
+	}
+	largest := append([]uint64{}, sizes...)
+	sort.Slice(largest, func(i, j int) bool { return largest[i] > largest[j] })
+	for _, size := range largest[:min(pool.parallel, len(largest))] {
+		need += size
+	}
+
+	usages := make([]diskUsage, len(hosts))
+	err := pool.run(ctx, len(hosts), func(ctx context.Context, idx int) error {
+		var err error
+		usages[idx], err = remoteDiskUsage(ctx, executor, hosts[idx].host, segmentDir)
+		return err
+	}, func(idx int, err error) error {
+		if err != nil {
+			log.Warnf("Skipping the free space check on %s: %v", hosts[idx].host, err)
+			return nil
+		}
+		if !usages[idx].remainsAbove(sizes[idx], percent) {
+			return fmt.Errorf("%w on %s:%s: staging %s would leave less than %d%% of %s free",
+				errInsufficientSpace, hosts[idx].host, segmentDir, formatBytes(sizes[idx]), percent, formatBytes(usages[idx].total))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	usage, err := statDisk(archiveDir)
+	if err != nil {
+		return err
+	}
+	if !usage.remainsAbove(need, percent) {
+		return fmt.Errorf("%w on %s: the archive may need up to %s, which would leave less than %d%% of %s free",
+			errInsufficientSpace, archiveDir, formatBytes(need), percent, formatBytes(usage.total))
+	}
+	log.Debugf("Estimated %s needed on %s, %s available", formatBytes(need), archiveDir, formatBytes(usage.available))
+	return nil
+}
+
+// watchFreeSpace checks the archive's disk until ctx is done, and cancels
+// ctx with errInsufficientSpace as soon as less than percent of it is free.
+// Only the local disk is watched; the segment hosts' --segdir is checked once
+// by checkFreeSpace, before anything is staged there.
+func watchFreeSpace(ctx context.Context, dir string, percent int, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(freeSpaceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		usage, err := statDisk(dir)
+		if err != nil {
+			log.Debugf("Free space check failed: %v", err)
+			continue
+		}
+		if !usage.remainsAbove(0, percent) {
+			cancel(fmt.Errorf("%w on %s: less than %d%% of %s left, aborting",
+				errInsufficientSpace, dir, percent, formatBytes(usage.total)))
+			return
+		}
+	}
+}
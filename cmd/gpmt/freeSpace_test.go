@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+const gib = 1 << 30
+
+func TestParseDF(t *testing.T) {
+	output := "Filesystem     1024-blocks      Used Available Capacity Mounted on\n" +
+		"/dev/mapper/data-vol 104857600 52428800  52428800      50% /data\n"
+	usage, err := parseDF(output)
+	if err != nil {
+		t.Fatalf("parseDF failed: %v", err)
+	}
+	if usage.total != 100*gib || usage.available != 50*gib {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+
+	if _, err := parseDF("df: /missing: No such file or directory\n"); err == nil {
+		t.Error("Expected an error for malformed df output")
+	}
+}
+
+func TestRemainsAbove(t *testing.T) {
+	usage := diskUsage{total: 100 * gib, available: 20 * gib}
+	testCases := []struct {
+		need     uint64
+		percent  int
+		expected bool
+	}{
+		{need: 5 * gib, percent: 10, expected: true},
+		{need: 10 * gib, percent: 10, expected: true},
+		{need: 11 * gib, percent: 10, expected: false},
+		{need: 0, percent: 25, expected: false},
+		{need: 30 * gib, percent: 0, expected: false},
+	}
+	for _, tc := range testCases {
+		if fits := usage.remainsAbove(tc.need, tc.percent); fits != tc.expected {
+			t.Errorf("remainsAbove(%s, %d) = %t, expected %t", formatBytes(tc.need), tc.percent, fits, tc.expected)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for size, expected := range map[uint64]string{
+		512:                "512 B",
+		1536:               "1.5 KiB",
+		10 * gib:           "10.0 GiB",
+		3*gib*1024 + 1<<29: "3.0 TiB",
+	} {
+		if formatted := formatBytes(size); formatted != expected {
+			t.Errorf("formatBytes(%d) = %s, expected %s", size, formatted, expected)
+		}
+	}
+}
+
+// dfExecutor answers df with a fixed amount of space per host and runs
+// everything else locally.
+type dfExecutor struct {
+	available map[string]uint64
+}
+
+func (executor *dfExecutor) Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	if strings.HasPrefix(command, "df ") {
+		_, err := io.WriteString(stdout, "Filesystem 1024-blocks Used Available Capacity Mounted on\n"+
+			"/dev/sda1 104857600 0 "+strconv.FormatUint(executor.available[host]/1024, 10)+" 0% /tmp\n")
+		return err
+	}
+	return remote.LocalExecutor{}.Run(ctx, host, command, stdin, stdout)
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	defer func(original func(string) (diskUsage, error)) { statDisk = original }(statDisk)
+	statDisk = func(string) (diskUsage, error) {
+		return diskUsage{total: 100 * gib, available: 50 * gib}, nil
+	}
+
+	hosts := []hostLogs{
+		{host: "sdw1", bundles: []remoteBundle{{files: []remoteLogFile{{path: "a.csv", size: 10 * gib}}}}},
+		{host: "sdw2", bundles: []remoteBundle{
+			{files: []remoteLogFile{{path: "b.csv", size: 5 * gib}}},
+			{files: []remoteLogFile{{path: "c.csv", size: 5 * gib}}},
+		}},
+	}
+	executor := &dfExecutor{available: map[string]uint64{"sdw1": 50 * gib, "sdw2": 50 * gib}}
+
+	// 10 GiB local, 20 GiB of segment logs and a 10 GiB spool leaves 10 GiB
+	if err := checkFreeSpace(context.Background(), executor, hostPool{parallel: 1}, "/out", 10, 10*gib, 0, hosts, "/tmp"); err != nil {
+		t.Errorf("Expected the collection to fit, got %v", err)
+	}
+
+	err := checkFreeSpace(context.Background(), executor, hostPool{parallel: 1}, "/out", 11, 10*gib, 0, hosts, "/tmp")
+	if !errors.Is(err, errInsufficientSpace) || !strings.Contains(err.Error(), "/out") {
+		t.Errorf("Expected the archive directory to run short, got %v", err)
+	}
+
+	executor.available["sdw2"] = 15 * gib
+	err = checkFreeSpace(context.Background(), executor, hostPool{parallel: 1}, "/out", 10, 0, 0, hosts, "/tmp")
+	if !errors.Is(err, errInsufficientSpace) || !strings.Contains(err.Error(), "sdw2:/tmp") {
+		t.Errorf("Expected sdw2 to run short, got %v", err)
+	}
+
+	// Collecting both hosts at once needs room for both spools
+	executor.available["sdw2"] = 50 * gib
+	err = checkFreeSpace(context.Background(), executor, hostPool{parallel: 2}, "/out", 10, 10*gib, 0, hosts, "/tmp")
+	if !errors.Is(err, errInsufficientSpace) || !strings.Contains(err.Error(), "/out") {
+		t.Errorf("Expected the archive directory to run short with two spools, got %v", err)
+	}
+
+	// --redact needs room for the temporary copy of the largest file too
+	err = checkFreeSpace(context.Background(), executor, hostPool{parallel: 1}, "/out", 10, 10*gib, 10*gib, hosts, "/tmp")
+	if !errors.Is(err, errInsufficientSpace) || !strings.Contains(err.Error(), "/out") {
+		t.Errorf("Expected the archive directory to run short with a redacted copy, got %v", err)
+	}
+
+	if err := checkFreeSpace(context.Background(), executor, hostPool{parallel: 1}, "/out", 0, 100*gib, 0, hosts, "/tmp"); err != nil {
+		t.Errorf("Expected a zero threshold to disable the check, got %v", err)
+	}
+}
+
+// stallingExecutor never finishes copying staged logs back, so the collection
+// is still running when the disk fills up. It has no df, so only the local
+// disk is checked.
+type stallingExecutor struct {
+	remote.LocalExecutor
+}
+
+func (executor stallingExecutor) Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	switch {
+	case strings.HasPrefix(command, "df "):
+		return &remote.CommandError{Host: host, Command: command, Stderr: "sh: df: command not found", Err: errors.New("exit status 127")}
+	case strings.HasPrefix(command, "tar -C"):
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return executor.LocalExecutor.Run(ctx, host, command, stdin, stdout)
+}
+
+func TestLogCollectorAbortsWhenDiskFills(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	defer func(original func(string) (diskUsage, error)) { statDisk = original }(statDisk)
+	defer func(original time.Duration) { freeSpaceCheckInterval = original }(freeSpaceCheckInterval)
+	freeSpaceCheckInterval = time.Millisecond
+
+	// Plenty of space for the up front check, then the disk fills
+	var checks int32
+	statDisk = func(string) (diskUsage, error) {
+		if atomic.AddInt32(&checks, 1) == 1 {
+			return diskUsage{total: 100 * gib, available: 50 * gib}, nil
+		}
+		return diskUsage{total: 100 * gib, available: 5 * gib}, nil
+	}
+
+	root := t.TempDir()
+	for _, dataDir := range []string{"coordinator", "primary0"} {
+		logDir := filepath.Join(root, dataDir, "log")
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte(dataDir+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	outDir := t.TempDir()
+	archiveName := filepath.Join(outDir, "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", contentIds: []string{"0"},
+		segmentDir: t.TempDir(), freeSpace: 10}
+	err := logCollector(context.Background(), querier, stallingExecutor{}, archiveName, opts)
+	if !errors.Is(err, errInsufficientSpace) {
+		t.Fatalf("Expected the collection to abort for lack of space, got %v", err)
+	}
+
+	leftovers, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range leftovers {
+		t.Errorf("Expected the partial output to be removed, found %s", entry.Name())
+	}
+}
+
+func TestLogCollectorRefusesToStart(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	defer func(original func(string) (diskUsage, error)) { statDisk = original }(statDisk)
+	statDisk = func(string) (diskUsage, error) {
+		return diskUsage{total: 100 * gib, available: 5 * gib}, nil
+	}
+
+	dataDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dataDir, "log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: dataDir},
+	})
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", freeSpace: 10}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); !errors.Is(err, errInsufficientSpace) {
+		t.Fatalf("Expected the collection to be refused, got %v", err)
+	}
+	if _, err := os.Stat(archiveName); !os.IsNotExist(err) {
+		t.Errorf("Expected no archive to be created, got %v", err)
+	}
+}
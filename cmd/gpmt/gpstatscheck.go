@@ -1,12 +1,122 @@
 package main
 
-import "fmt"
-
-// gpstatscheck is a placeholder for the statistics checking tool.
-func gpstatscheck() error {
-	fmt.Println("This is a placeholder for the 'gpstatscheck' tool.")
-	fmt.Println("This tool would check for missing or stale statistics on database tables.")
-	// A full implementation would connect to the database and query
-	// pg_class and pg_statistic to identify tables needing analysis.
-	return nil
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/spf13/cobra"
+)
+
+// Tables with no statistics, or statistics on only some of their columns. An
+// empty $1 matches every schema.
+const (
+	statsMissingQuery = `select smischema, smitable, smisize, smicols, smirecs
+from gp_toolkit.gp_stats_missing
+where $1 = '' or smischema = $1
+order by smischema, smitable`
+
+	// The same report for servers without gp_toolkit, built from the catalog
+	statsMissingCatalogQuery = `select n.nspname as smischema, c.relname as smitable,
+       c.reltuples > 0 or c.relpages > 0 as smisize,
+       (select count(*) from pg_statistic s where s.starelid = c.oid) as smicols,
+       (select count(*) from pg_attribute a where a.attrelid = c.oid and a.attnum > 0 and not a.attisdropped) as smirecs
+from pg_class c
+join pg_namespace n on n.oid = c.relnamespace
+where c.relkind = 'r'
+  and n.nspname not in ('pg_catalog', 'information_schema', 'gp_toolkit')
+  and n.nspname not like 'pg_toast%'
+  and ($1 = '' or n.nspname = $1)
+order by 1, 2`
+)
+
+// GPStatsCheckOptions define the options/flag for the gpstatscheck command
+type GPStatsCheckOptions struct {
+	schema string
+}
+
+var scOpts GPStatsCheckOptions
+
+// statsMissing is one row of statsMissingQuery
+type statsMissing struct {
+	Schema       string `db:"smischema"`
+	Table        string `db:"smitable"`
+	HasSize      bool   `db:"smisize"`
+	StatsColumns int64  `db:"smicols"`
+	Columns      int64  `db:"smirecs"`
+}
+
+// Sub Command: Stats Check
+// Finds the tables the optimizer has to plan without statistics for
+var gpstatscheckCmd = &cobra.Command{
+	Use:   "gpstatscheck",
+	Short: "find tables with missing statistics",
+	Long: "\ngpstatscheck lists the tables that have never been analyzed, \n" +
+		"or only have statistics for some of their columns",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := openClient(cmd.Context())
+		if err != nil {
+			fmt.Printf("Error connecting to the database: %s\n", connectionHint(err))
+			os.Exit(1)
+		}
+		defer client.Close()
+
+		if err := gpstatscheck(cmd.Context(), client, cmd.OutOrStdout(), scOpts); err != nil {
+			fmt.Printf("Error checking statistics: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// gpstatscheck reports the tables missing statistics to out.
+func gpstatscheck(ctx context.Context, querier db.Querier, out io.Writer, opts GPStatsCheckOptions) error {
+	info, err := querier.ServerInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to detect the server version: %w", err)
+	}
+
+	query := statsMissingCatalogQuery
+	if info.HasGPToolkit("gp_stats_missing") {
+		query = statsMissingQuery
+	}
+	result, err := querier.ExecuteQueryContext(ctx, query, opts.schema)
+	if err != nil {
+		return fmt.Errorf("failed to query missing statistics: %w", err)
+	}
+	var tables []statsMissing
+	if err := result.ScanStructs(&tables); err != nil {
+		return fmt.Errorf("failed to read missing statistics: %w", err)
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	missing := 0
+	for _, table := range tables {
+		if table.HasSize && table.StatsColumns >= table.Columns {
+			continue
+		}
+		if missing == 0 {
+			fmt.Fprintln(writer, "TABLE\tSTATUS\tCOLUMNS WITH STATS")
+		}
+		missing++
+
+		status := "partial statistics"
+		if !table.HasSize || table.StatsColumns == 0 {
+			status = "never analyzed"
+		}
+		fmt.Fprintf(writer, "%s.%s\t%s\t%d/%d\n", table.Schema, table.Table, status, table.StatsColumns, table.Columns)
+	}
+	if missing == 0 {
+		fmt.Fprintln(writer, "All tables have statistics.")
+	} else {
+		fmt.Fprintf(writer, "\n%d table(s) need ANALYZE.\n", missing)
+	}
+	return writer.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(gpstatscheckCmd)
+	gpstatscheckCmd.Flags().StringVar(&scOpts.schema, "schema", "", "Only check tables in this schema")
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+)
+
+var statsMissingColumns = []db.Column{
+	{Name: "smischema", DatabaseType: "NAME"},
+	{Name: "smitable", DatabaseType: "NAME"},
+	{Name: "smisize", DatabaseType: "BOOL"},
+	{Name: "smicols", DatabaseType: "INT8"},
+	{Name: "smirecs", DatabaseType: "INT8"},
+}
+
+func TestGPStatsCheck(t *testing.T) {
+	testCases := []struct {
+		name      string
+		gpToolkit []string
+		relation  string
+	}{
+		{name: "gp_toolkit", gpToolkit: []string{"gp_stats_missing"}, relation: "gp_toolkit.gp_stats_missing"},
+		{name: "catalog fallback", relation: "pg_statistic"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			querier := dbtest.NewQuerier()
+			querier.Info = dbtest.GreenplumInfo(dbtest.Greenplum6Version, "queue", tc.gpToolkit...)
+			querier.Handle(tc.relation, db.NewResult(statsMissingColumns,
+				[]interface{}{"public", "orders", false, int64(0), int64(4)},
+				[]interface{}{"public", "customers", true, int64(2), int64(5)},
+				[]interface{}{"public", "regions", true, int64(3), int64(3)},
+			))
+
+			var out bytes.Buffer
+			if err := gpstatscheck(context.Background(), querier, &out, GPStatsCheckOptions{schema: "public"}); err != nil {
+				t.Fatalf("gpstatscheck failed: %v", err)
+			}
+
+			for _, expected := range []string{"public.orders", "never analyzed", "public.customers", "partial statistics", "2/5", "2 table(s) need ANALYZE"} {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+				}
+			}
+			if strings.Contains(out.String(), "public.regions") {
+				t.Errorf("Expected fully analyzed tables to be left out, got:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestGPStatsCheckNothingMissing(t *testing.T) {
+	querier := dbtest.NewQuerier()
+	querier.Info = dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group", "gp_stats_missing")
+	querier.Handle(`gp_stats_missing`, db.NewResult(statsMissingColumns))
+
+	var out bytes.Buffer
+	if err := gpstatscheck(context.Background(), querier, &out, GPStatsCheckOptions{}); err != nil {
+		t.Fatalf("gpstatscheck failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "All tables have statistics.") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Hosts worked on at once when --parallel is not given
+const defaultParallelHosts = 8
+
+// Longest a single host may take when --host-timeout is not given
+const defaultHostTimeout = 30 * time.Minute
+
+// hostPool runs the per-host steps of a collection on several hosts at once,
+// giving up on any one host that takes longer than timeout.
+type hostPool struct {
+	parallel int
+	timeout  time.Duration // 0 means no limit
+}
+
+// newHostPool sizes the pool from --parallel and --host-timeout.
+func newHostPool(opts LogCollectorOptions) hostPool {
+	pool := hostPool{parallel: opts.parallel, timeout: opts.hostTimeout}
+	if pool.parallel < 1 {
+		pool.parallel = 1
+	}
+	return pool
+}
+
+// hostResult is the outcome of the work on one host.
+type hostResult struct {
+	idx int
+	err error
+}
+
+// run calls work for each of count hosts, at most pool.parallel at a time,
+// each under its own timeout. done is called on the caller's goroutine as
+// each host finishes, in the order they finish, with the error work returned,
+// so it may write to the archive without locking. A host keeps its slot
+// until done returns, so no more than pool.parallel hosts' results, such as
+// spool files, exist at once. If done fails, the hosts still running are
+// cancelled and its error is returned. Hosts not yet started when ctx is done
+// are skipped.
+func (pool hostPool) run(ctx context.Context, count int,
+	work func(ctx context.Context, idx int) error, done func(idx int, err error) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hostResult)
+	slots := make(chan struct{}, max(pool.parallel, 1))
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(results)
+		}()
+		for idx := 0; idx < count; idx++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				results <- hostResult{idx: idx, err: pool.runHost(ctx, idx, work)}
+			}(idx)
+		}
+	}()
+
+	var failure error
+	for result := range results {
+		if failure == nil {
+			if err := done(result.idx, result.err); err != nil {
+				failure = err
+				cancel()
+			}
+		}
+		<-slots
+	}
+	return failure
+}
+
+// runHost calls work for one host under the pool's timeout, making sure a
+// host that ran out of time says so.
+func (pool hostPool) runHost(ctx context.Context, idx int, work func(ctx context.Context, idx int) error) error {
+	hostCtx, cancel := ctx, context.CancelFunc(func() {})
+	if pool.timeout > 0 {
+		hostCtx, cancel = context.WithTimeout(ctx, pool.timeout)
+	}
+	defer cancel()
+
+	err := work(hostCtx, idx)
+	if err != nil && ctx.Err() == nil && errors.Is(hostCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %w", pool.timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewHostPool(t *testing.T) {
+	pool := newHostPool(LogCollectorOptions{parallel: 0, hostTimeout: time.Minute})
+	if pool.parallel != 1 || pool.timeout != time.Minute {
+		t.Errorf("Unexpected pool %+v", pool)
+	}
+}
+
+func TestHostPoolRun(t *testing.T) {
+	var running, most atomic.Int32
+	var doneHosts []int
+	pool := hostPool{parallel: 3}
+	err := pool.run(context.Background(), 10, func(ctx context.Context, idx int) error {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			previous := most.Load()
+			if now <= previous || most.CompareAndSwap(previous, now) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}, func(idx int, err error) error {
+		if err != nil {
+			t.Errorf("Unexpected error for host %d: %v", idx, err)
+		}
+		doneHosts = append(doneHosts, idx)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if len(doneHosts) != 10 {
+		t.Errorf("Expected every host to finish, got %v", doneHosts)
+	}
+	if most.Load() > 3 {
+		t.Errorf("Expected at most 3 hosts at once, got %d", most.Load())
+	}
+}
+
+// A host that hangs is timed out without holding up the others.
+func TestHostPoolTimeout(t *testing.T) {
+	pool := hostPool{parallel: 2, timeout: 50 * time.Millisecond}
+	errs := make(map[int]error)
+	err := pool.run(context.Background(), 3, func(ctx context.Context, idx int) error {
+		if idx == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, func(idx int, err error) error {
+		errs[idx] = err
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if len(errs) != 3 || errs[0] != nil || errs[2] != nil {
+		t.Errorf("Expected hosts 0 and 2 to succeed, got %v", errs)
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "timed out after 50ms") {
+		t.Errorf("Expected host 1 to time out, got %v", errs[1])
+	}
+}
+
+// When done fails, the hosts still running are cancelled.
+func TestHostPoolDoneFailure(t *testing.T) {
+	pool := hostPool{parallel: 4}
+	failure := errors.New("archive full")
+	var cancelled sync.WaitGroup
+	cancelled.Add(3)
+	err := pool.run(context.Background(), 4, func(ctx context.Context, idx int) error {
+		if idx == 0 {
+			return nil
+		}
+		<-ctx.Done()
+		cancelled.Done()
+		return ctx.Err()
+	}, func(idx int, err error) error {
+		if idx != 0 {
+			t.Errorf("Expected done to stop being called after failing, got host %d", idx)
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected the done error, got %v", err)
+	}
+	cancelled.Wait()
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,171 +14,371 @@ import (
 	"strings"
 	"time"
 
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
 	log "github.com/sirupsen/logrus"
 )
 
 // getLogDirectoryFromDB queries the database to get the actual log directory path
-func getLogDirectoryFromDB() (string, error) {
-	const query = "select distinct datadir || '/log' from gp_segment_configuration where content='-1';"
+func getLogDirectoryFromDB(ctx context.Context, querier db.Querier) (string, error) {
+	const query = "select distinct datadir from gp_segment_configuration where content = -1 and role = 'p';"
 
-	log.Debug("Querying database for log directory path")
-
-	// Try to execute the query, but handle any panics from connection failures
-	var result []map[string]interface{}
-	var err error
+	// Greenplum 6 logs to pg_log and Greenplum 7 to log
+	info, err := querier.ServerInfo(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect the server version: %w", err)
+	}
 
-	func() {
-		defer func() {
-			if r := recover(); r != nil {
-				err = fmt.Errorf("database connection failed: %v", r)
-			}
-		}()
-		result, err = connString.ExecuteQuery(query)
-	}()
+	log.Debug("Querying database for log directory path")
 
+	result, err := querier.ExecuteQueryContext(ctx, query)
 	if err != nil {
 		return "", fmt.Errorf("failed to query database for log directory: %w", err)
 	}
 
-	if len(result) == 0 {
+	if result.Len() == 0 {
 		return "", fmt.Errorf("no log directory found in gp_segment_configuration")
 	}
 
-	log.Debugf("Database query returned %d rows", len(result))
+	log.Debugf("Database query returned %d rows", result.Len())
 
 	// Extract the directory path from the result
-	for rowIdx, row := range result {
-		log.Debugf("Processing row %d with %d columns", rowIdx, len(row))
-		for colName, value := range row {
-			log.Debugf("Column '%s' has value of type %T: %v", colName, value, value)
-
-			var logDir string
-			if str, ok := value.(string); ok {
-				logDir = strings.TrimSpace(str)
-			} else if bytes, ok := value.([]byte); ok && len(bytes) > 0 {
-				logDir = strings.TrimSpace(string(bytes))
-			} else {
-				log.Debugf("Skipping column '%s' with unsupported type %T", colName, value)
-				continue
-			}
+	for rowIdx, row := range result.Rows {
+		value, err := row.NullString("datadir")
+		if err != nil {
+			log.Debugf("Skipping row %d: %v", rowIdx, err)
+			continue
+		}
 
-			// Check if we got a valid non-empty directory path
-			if logDir != "" {
-				log.Debugf("Found log directory from database: '%s'", logDir)
-				return logDir, nil
-			} else {
-				log.Debugf("Column '%s' contains empty or whitespace-only value", colName)
-			}
+		// Check if we got a valid non-empty directory path
+		dataDir := strings.TrimSpace(value.String)
+		if dataDir != "" {
+			logDir := filepath.Join(dataDir, info.LogDirectory())
+			log.Debugf("Found log directory from database: '%s'", logDir)
+			return logDir, nil
 		}
+		log.Debugf("Row %d contains a NULL, empty or whitespace-only value", rowIdx)
 	}
 
 	return "", fmt.Errorf("invalid log directory result from database")
 }
 
-// logCollector archives Greenplum Database log files from the master and segment directories.
-func logCollector(archiveName string) error {
+// logCollector archives the Greenplum log files that may hold entries inside
+// the --start/--end window, along with a manifest of what was collected.
+// querier may be nil when the database is unreachable, in which case the log
+// directory is guessed from the local environment. Remote hosts are reached
+// through executor.
+func logCollector(ctx context.Context, querier db.Querier, executor remote.Executor, archiveName string, opts LogCollectorOptions) error {
 	// Default to a timestamped archive name if none is provided.
 	if archiveName == "" {
 		timestamp := time.Now().Format("20060102_150405")
 		archiveName = fmt.Sprintf("gpmt_logs_%s.tar.gz", timestamp)
 	}
 
+	redact, err := newRedactor(opts)
+	if err != nil {
+		return err
+	}
+	if opts.osOnly {
+		return osCollector(ctx, querier, executor, archiveName, redact, opts)
+	}
+
+	window, err := parseTimeWindow(opts.startDate, opts.endDate)
+	if err != nil {
+		return err
+	}
+	manifest := newArchiveManifest(ctx, querier)
+	manifest.setWindow(window)
+
+	// --failed-segs adds every segment whose status changed in the window
+	var history *db.Result
+	var failedContentIDs []int
+	if opts.failedOnly {
+		if history, err = failedSegmentHistory(ctx, querier, window); err != nil {
+			return err
+		}
+		if failedContentIDs, err = changedContentIDs(history); err != nil {
+			return err
+		}
+		if len(failedContentIDs) == 0 {
+			fmt.Printf("No segment changed status from %s\n", window)
+		} else {
+			fmt.Printf("Segments that changed status: content %v\n", failedContentIDs)
+		}
+	}
+
+	hosts, err := segmentHosts(ctx, querier, opts, failedContentIDs)
+	if err != nil {
+		return err
+	}
+	if opts.standby {
+		standby, err := findStandby(ctx, querier)
+		if err != nil {
+			return err
+		}
+		if standby == nil {
+			fmt.Println("No standby coordinator is configured")
+		} else {
+			hosts = append(hosts, standbyHost(*standby))
+		}
+	}
+
 	fmt.Printf("Starting log collection...\n")
 	fmt.Printf("Logs will be archived to: %s\n", archiveName)
+	fmt.Printf("Collecting logs from %s\n", window)
+
+	// Work out everything to collect before writing anything. --failed-segs
+	// is only after the segments' logs, not the coordinator's.
+	var logDir string
+	var localFiles []string
+	var localSize, localLargest uint64
+	if !opts.failedOnly {
+		if logDir, err = coordinatorLogDir(ctx, querier); err != nil {
+			return err
+		}
+		if localFiles, localSize, localLargest, err = listLocalLogs(ctx, logDir, window); err != nil {
+			return fmt.Errorf("failed to walk log directory: %w", err)
+		}
+	}
 
-	// Create the output file.
-	outFile, err := os.Create(archiveName)
-	if err != nil {
-		return fmt.Errorf("failed to create archive file: %w", err)
+	pool := newHostPool(opts)
+	if len(hosts) > 0 {
+		// Segment hosts are only selected when the database answered
+		info, err := querier.ServerInfo(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to detect the server version: %w", err)
+		}
+		segmentLogDir := info.LogDirectory()
+		err = pool.run(ctx, len(hosts), func(ctx context.Context, idx int) error {
+			planHostLogs(ctx, executor, &hosts[idx], segmentLogDir, window, manifest)
+			return nil
+		}, func(int, error) error {
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	}
-	defer outFile.Close()
 
-	// Create a gzip writer.
-	gw := gzip.NewWriter(outFile)
-	defer gw.Close()
+	archiveDir := filepath.Dir(archiveName)
+	segmentDir := opts.segmentDir
+	if segmentDir == "" {
+		segmentDir = defaultSegmentDir
+	}
+	// --redact writes each file to a temporary copy next to the archive
+	// first. One copy exists at a time, so the largest file is enough room.
+	var redactSize uint64
+	if redact != nil {
+		redactSize = localLargest
+		for _, target := range hosts {
+			redactSize = max(redactSize, target.largest())
+		}
+	}
+	if err := checkFreeSpace(ctx, executor, pool, archiveDir, opts.freeSpace, localSize, redactSize, hosts, segmentDir); err != nil {
+		return err
+	}
 
-	// Create a tar writer.
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	// Keep watching the archive's disk while it fills up
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if opts.freeSpace > 0 {
+		go watchFreeSpace(ctx, archiveDir, opts.freeSpace, cancel)
+	}
 
-	// Get the log directory from the database first
-	logDir, err := getLogDirectoryFromDB()
-	if err != nil {
-		log.Debugf("Failed to get log directory from database: %v", err)
+	var failedHosts []string
+	err = writeArchive(archiveName, manifest, redact, func(aw *archiveWriter) error {
+		for _, path := range localFiles {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := addFileToTar(aw, path, logDir); err != nil {
+				return err
+			}
+		}
+
+		if history != nil {
+			data, err := resultCSV(history)
+			if err != nil {
+				return fmt.Errorf("failed to format gp_configuration_history: %w", err)
+			}
+			if err := addBytesToTar(aw, failedSegmentsHistoryEntry, coordinatorHostname(ctx, querier), data); err != nil {
+				return err
+			}
+		}
 
-		// Fallback to environment variable or hardcoded path
-		gpMasterDir := os.Getenv("MASTER_DATA_DIRECTORY")
-		if gpMasterDir == "" {
-			// Fallback for when the environment variable is not set.
-			homeDir, err := os.UserHomeDir()
-			if err == nil {
-				gpMasterDir = filepath.Join(homeDir, "gpdb", "gp-master", "gpseg-1")
+		// Configuration files and catalog snapshots need the database
+		if querier != nil {
+			if err := addCatalogSnapshots(ctx, querier, aw); err != nil {
+				return err
 			}
 		}
 
-		if gpMasterDir == "" {
-			return fmt.Errorf("unable to determine log directory: database query failed and MASTER_DATA_DIRECTORY environment variable not set")
+		if len(hosts) > 0 {
+			failedHosts, err = collectSegmentLogs(ctx, executor, aw, hosts, opts, archiveDir)
+			return err
 		}
+		return nil
+	})
+	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errInsufficientSpace) {
+			err = cause
+		}
+		return err
+	}
 
-		// Try both "log" (newer Greenplum) and "pg_log" (older Greenplum)
-		logDirCandidates := []string{
-			filepath.Join(gpMasterDir, "log"),
-			filepath.Join(gpMasterDir, "pg_log"),
+	if len(failedHosts) > 0 {
+		fmt.Printf("Log collection finished without %s.\n", strings.Join(failedHosts, ", "))
+		return fmt.Errorf("failed to collect logs from %s", strings.Join(failedHosts, ", "))
+	}
+	fmt.Println("Log collection complete.")
+	return nil
+}
+
+// coordinatorLogDir finds the coordinator's log directory, from the database
+// when it is reachable and otherwise from the local environment.
+func coordinatorLogDir(ctx context.Context, querier db.Querier) (string, error) {
+	// Get the log directory from the database first
+	if querier != nil {
+		logDir, err := getLogDirectoryFromDB(ctx, querier)
+		if err == nil {
+			return logDir, nil
 		}
+		log.Debugf("Failed to get log directory from database: %v", err)
+	}
 
-		for _, candidate := range logDirCandidates {
-			if _, err := os.Stat(candidate); err == nil {
-				logDir = candidate
-				log.Debugf("Using fallback log directory: %s", logDir)
-				break
-			}
+	// Fallback to environment variable or hardcoded path
+	gpMasterDir := os.Getenv("MASTER_DATA_DIRECTORY")
+	if gpMasterDir == "" {
+		// Fallback for when the environment variable is not set.
+		homeDir, err := os.UserHomeDir()
+		if err == nil {
+			gpMasterDir = filepath.Join(homeDir, "gpdb", "gp-master", "gpseg-1")
 		}
+	}
+
+	if gpMasterDir == "" {
+		return "", fmt.Errorf("unable to determine log directory: database query failed and MASTER_DATA_DIRECTORY environment variable not set")
+	}
 
-		// If none of the candidates exist, use the first one and let the error be handled later
-		if logDir == "" {
-			logDir = logDirCandidates[0]
-			log.Debugf("No existing log directory found, using: %s", logDir)
+	// Try both "log" (newer Greenplum) and "pg_log" (older Greenplum)
+	logDirCandidates := []string{
+		filepath.Join(gpMasterDir, "log"),
+		filepath.Join(gpMasterDir, "pg_log"),
+	}
+
+	for _, candidate := range logDirCandidates {
+		if _, err := os.Stat(candidate); err == nil {
+			log.Debugf("Using fallback log directory: %s", candidate)
+			return candidate, nil
 		}
 	}
 
-	// Walk the log directory and add files to the archive.
-	err = filepath.Walk(logDir, func(path string, info os.FileInfo, err error) error {
+	// If none of the candidates exist, use the first one and let the error be handled later
+	log.Debugf("No existing log directory found, using: %s", logDirCandidates[0])
+	return logDirCandidates[0], nil
+}
+
+// localHostname names this host, the coordinator, in the manifest and the
+// host diagnostics.
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// listLocalLogs walks a local log directory for the files that may hold
+// entries inside window, returning them with their total size and the size
+// of the largest of them.
+func listLocalLogs(ctx context.Context, logDir string, window timeWindow) ([]string, uint64, uint64, error) {
+	var files []string
+	var size, largest uint64
+	err := filepath.Walk(logDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		if info.IsDir() {
 			return nil
 		}
+		if !window.includesFile(info.Name(), info.ModTime()) {
+			log.Debugf("Skipping %s, outside of %s", path, window)
+			return nil
+		}
 
-		// Add the file to the tar archive.
-		return addFileToTar(tw, path, logDir)
+		files = append(files, path)
+		size += uint64(info.Size())
+		largest = max(largest, uint64(info.Size()))
+		return nil
 	})
+	return files, size, largest, err
+}
 
+// writeArchive creates a tar.gz archive and lets write fill it, then adds
+// the manifest of everything written. Every file is redacted when redact is
+// set. If write or closing the archive fails, the partial archive is removed.
+func writeArchive(archiveName string, manifest *archiveManifest, redact *redactor,
+	write func(aw *archiveWriter) error) error {
+	// Create the output file.
+	outFile, err := os.Create(archiveName)
 	if err != nil {
-		return fmt.Errorf("failed to walk log directory: %w", err)
+		return fmt.Errorf("failed to create archive file: %w", err)
 	}
 
-	fmt.Println("Log collection complete.")
+	// Create a gzip writer and a tar writer on top of it.
+	gw := gzip.NewWriter(outFile)
+	tw := tar.NewWriter(gw)
+	aw := &archiveWriter{tw: tw, manifest: manifest, redactor: redact, tempDir: filepath.Dir(archiveName)}
+
+	err = write(aw)
+	if err == nil {
+		err = aw.writeManifest()
+	}
+	for _, closer := range []io.Closer{tw, gw, outFile} {
+		if closeErr := closer.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to write archive file: %w", closeErr)
+		}
+	}
+	if err != nil {
+		if removeErr := os.Remove(archiveName); removeErr != nil {
+			log.Warnf("Failed to remove the partial archive %s: %v", archiveName, removeErr)
+		} else {
+			fmt.Printf("Log collection aborted, removed %s\n", archiveName)
+		}
+		return err
+	}
 	return nil
 }
 
-// addFileToTar is a helper function to add a file to a tar archive.
-func addFileToTar(tw *tar.Writer, path string, basePath string) error {
+// addFileToTar is a helper function to add a local file to a tar archive. A
+// file that cannot be read, for example because it was removed since it was
+// listed, is reported, recorded in the manifest and skipped; only failing to
+// write the archive is an error.
+func addFileToTar(aw *archiveWriter, path string, basePath string) error {
 	file, err := os.Open(path)
 	if err != nil {
-		return err
+		skipFile(aw, path, err)
+		return nil
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		return err
+		skipFile(aw, path, err)
+		return nil
 	}
 
 	header, err := tar.FileInfoHeader(stat, stat.Name())
 	if err != nil {
-		return err
+		skipFile(aw, path, err)
+		return nil
 	}
 
 	// Use a relative path in the archive.
@@ -191,14 +395,63 @@ func addFileToTar(tw *tar.Writer, path string, basePath string) error {
 	// Ensure header name doesn't start with /
 	header.Name = strings.TrimPrefix(header.Name, "/")
 
-	if err := tw.WriteHeader(header); err != nil {
+	if err := aw.writeEntry(header, localHostname(), path, file); err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(tw, file); err != nil {
+	fmt.Printf("  - Archived %s\n", path)
+	return nil
+}
+
+// skipFile records a local file that could not be archived.
+func skipFile(aw *archiveWriter, path string, err error) {
+	log.Warnf("Skipping %s: %v", path, err)
+	aw.manifest.addError(localHostname(), path, err)
+}
+
+// addBytesToTar adds generated content, such as a query result, to a tar
+// archive as a regular file. host is where the content was gathered.
+func addBytesToTar(aw *archiveWriter, name string, host string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := aw.writeEntry(header, host, "", bytes.NewReader(data)); err != nil {
 		return err
 	}
 
-	fmt.Printf("  - Archived %s\n", path)
+	fmt.Printf("  - Archived %s\n", name)
 	return nil
 }
+
+// resultCSV formats a query result as CSV with a header row. NULL becomes an
+// empty field and timestamps keep PostgreSQL's text format.
+func resultCSV(result *db.Result) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write(result.ColumnNames()); err != nil {
+		return nil, err
+	}
+	for _, row := range result.Rows {
+		values := row.Values()
+		record := make([]string, len(values))
+		for idx, value := range values {
+			switch typed := value.(type) {
+			case nil:
+			case time.Time:
+				record[idx] = typed.Format("2006-01-02 15:04:05.999999-07")
+			case []byte:
+				record[idx] = string(typed)
+			default:
+				record[idx] = fmt.Sprint(typed)
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
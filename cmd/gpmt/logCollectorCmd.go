@@ -6,6 +6,9 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -23,6 +26,12 @@ type LogCollectorOptions struct {
 	segmentDir string
 	osOnly     bool
 	standby    bool
+
+	redact         bool
+	redactPatterns []string
+
+	parallel    int
+	hostTimeout time.Duration
 }
 
 // Sub Command: Log Collector
@@ -31,7 +40,9 @@ var logCollectorCmd = &cobra.Command{
 	Use:   "gp_log_collector",
 	Short: "easy log collection",
 	Long: "\ngp_log_collector is used to automate Greenplum database log collection. \n" +
-		"Run without options, gp_log_collector will gather today's master and standby logs",
+		"Run without options, gp_log_collector will gather today's master logs only. \n" +
+		"The standby master's logs are only gathered with --collect-standby, which needs a database connection. \n" +
+		"Add --c, --hostnames or --failed-segs for segments",
 	Run: func(cmd *cobra.Command, args []string) {
 		// Handle default values as mentioned in FIXMEs
 		if lcOpts.workingDir == "" {
@@ -41,7 +52,7 @@ var logCollectorCmd = &cobra.Command{
 		}
 
 		if lcOpts.segmentDir == "" {
-			lcOpts.segmentDir = "/tmp"
+			lcOpts.segmentDir = defaultSegmentDir
 		}
 
 		// Handle default dates (current date if not specified)
@@ -57,8 +68,18 @@ var logCollectorCmd = &cobra.Command{
 		timestamp := time.Now().Format("20060102_150405")
 		archiveName := filepath.Join(lcOpts.workingDir, fmt.Sprintf("gpmt_logs_%s.tar.gz", timestamp))
 
+		// The database is optional: without it we fall back to local paths
+		var querier db.Querier
+		client, err := openClient(cmd.Context())
+		if err != nil {
+			log.Warnf("Unable to query the database for the log directory: %s", connectionHint(err))
+		} else {
+			defer client.Close()
+			querier = client
+		}
+
 		// Call the actual log collector function
-		if err := logCollector(archiveName); err != nil {
+		if err := logCollector(cmd.Context(), querier, &remote.SSHExecutor{}, archiveName, lcOpts); err != nil {
 			fmt.Printf("Error collecting logs: %v\n", err)
 			os.Exit(1)
 		}
@@ -67,21 +88,23 @@ var logCollectorCmd = &cobra.Command{
 
 // All the usage flags of the log collector
 func flagsLogCollector() {
-	logCollectorCmd.Flags().BoolVar(&lcOpts.failedOnly, "failed-segs", false, "Query gp_configuration_history for list of faulted content ids")
-	logCollectorCmd.Flags().IntVar(&lcOpts.freeSpace, "free-space", 10, "default=10  Free space threshold which will abort log collection if reached")
-	logCollectorCmd.Flags().StringArrayVar(&lcOpts.contentIds, "c", nil, "Space seperated list of content ids")
+	logCollectorCmd.Flags().BoolVar(&lcOpts.failedOnly, "failed-segs", false, "Collect the primaries and mirrors of every content id whose status changed in gp_configuration_history between --start and --end")
+	logCollectorCmd.Flags().IntVar(&lcOpts.freeSpace, "free-space", 10, "Abort log collection if it would leave less than this percentage of --dir or --segdir free (0 disables the check)")
+	logCollectorCmd.Flags().StringArrayVar(&lcOpts.contentIds, "c", nil, "Comma or space separated list of content ids whose primary and mirror logs to collect")
 	logCollectorCmd.Flags().BoolVar(&lcOpts.noPrompt, "no-prompts", false, "Accept all prompts")
-	logCollectorCmd.Flags().StringVarP(&lcOpts.hostfile, "hostfile", "f", "", "Read hostnames from a hostfile")
-	logCollectorCmd.Flags().StringArrayVarP(&lcOpts.hostnames, "hostnames", "n", nil, "Space seperated list of hostnames")
-	// FIXME: If date is empty string startDate and endDate it should default to current date
-	logCollectorCmd.Flags().StringVar(&lcOpts.startDate, "start", "", "Start date for logs to collect (defaults to current date)")
-	logCollectorCmd.Flags().StringVar(&lcOpts.endDate, "end", "", "End date for logs to collect (defaults to current date)")
+	logCollectorCmd.Flags().StringVarP(&lcOpts.hostfile, "hostfile", "f", "", "Collect the logs of every segment on the hosts listed in a hostfile")
+	logCollectorCmd.Flags().StringArrayVarP(&lcOpts.hostnames, "hostnames", "n", nil, "Comma or space separated list of hosts whose segment logs to collect")
+	logCollectorCmd.Flags().StringVar(&lcOpts.startDate, "start", "", "Start of the logs to collect as YYYY-MM-DD or 'YYYY-MM-DD HH:MM' (defaults to current date)")
+	logCollectorCmd.Flags().StringVar(&lcOpts.endDate, "end", "", "End of the logs to collect as YYYY-MM-DD or 'YYYY-MM-DD HH:MM', inclusive (defaults to current date)")
 	// FIXME: If workingDir is empty string it should default to cwd
 	logCollectorCmd.Flags().StringVar(&lcOpts.workingDir, "dir", "", "Working directory (defaults to current directory)")
-	// FIXME: If segmentDir is empty string it should default to /tmp
-	logCollectorCmd.Flags().StringVar(&lcOpts.segmentDir, "segdir", "", "Segment temporary directory (defaults to /tmp)")
-	logCollectorCmd.Flags().BoolVar(&lcOpts.osOnly, "os-only", false, "Only collect minimal infrastucture information")
-	logCollectorCmd.Flags().BoolVar(&lcOpts.standby, "collect-standby", false, "Collect information from the standby master")
+	logCollectorCmd.Flags().StringVar(&lcOpts.segmentDir, "segdir", "", "Directory on each segment host to stage logs in before copying (defaults to /tmp)")
+	logCollectorCmd.Flags().BoolVar(&lcOpts.osOnly, "os-only", false, "Only collect host diagnostics (kernel, sysctl, ulimits, memory, disks, THP, time sync, dmesg) from the master and segment hosts")
+	logCollectorCmd.Flags().BoolVar(&lcOpts.redact, "redact", false, "Mask passwords, IP addresses and the literals of debug_query_string in the archived copies")
+	logCollectorCmd.Flags().StringArrayVar(&lcOpts.redactPatterns, "redact-pattern", nil, "Also mask everything matching this regular expression (implies --redact)")
+	logCollectorCmd.Flags().IntVar(&lcOpts.parallel, "parallel", defaultParallelHosts, "Number of hosts to collect from at the same time")
+	logCollectorCmd.Flags().DurationVar(&lcOpts.hostTimeout, "host-timeout", defaultHostTimeout, "Skip a host whose logs or diagnostics take longer than this to list or copy (0 disables the limit)")
+	logCollectorCmd.Flags().BoolVar(&lcOpts.standby, "collect-standby", false, "Also collect the logs, pg_hba.conf and postgresql.conf of the standby master (not collected by default)")
 }
 
 func init() {
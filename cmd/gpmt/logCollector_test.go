@@ -1,113 +1,375 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
 )
 
 // Test to verify that our log directory parsing handles various result formats correctly
 func TestLogDirectoryParsing(t *testing.T) {
-	// This test simulates the result parsing logic without requiring a real database
-	
+	// The in-memory querier stands in for the database
 	testCases := []struct {
 		name           string
-		resultData     []map[string]interface{}
+		resultData     [][]interface{}
 		expectedResult string
 		expectError    bool
 	}{
 		{
 			name: "normal string result",
-			resultData: []map[string]interface{}{
-				{"?column?": "/data/coordinator/gpseg-1/log"},
+			resultData: [][]interface{}{
+				{"/data/coordinator/gpseg-1"},
 			},
 			expectedResult: "/data/coordinator/gpseg-1/log",
 			expectError:    false,
 		},
 		{
 			name: "string with whitespace",
-			resultData: []map[string]interface{}{
-				{"?column?": "  /data/coordinator/gpseg-1/log  \n"},
+			resultData: [][]interface{}{
+				{"  /data/coordinator/gpseg-1  \n"},
 			},
 			expectedResult: "/data/coordinator/gpseg-1/log",
 			expectError:    false,
 		},
 		{
 			name: "byte array result",
-			resultData: []map[string]interface{}{
-				{"?column?": []byte("/data/coordinator/gpseg-1/log")},
+			resultData: [][]interface{}{
+				{[]byte("/data/coordinator/gpseg-1")},
 			},
 			expectedResult: "/data/coordinator/gpseg-1/log",
 			expectError:    false,
 		},
 		{
 			name: "empty string result",
-			resultData: []map[string]interface{}{
-				{"?column?": ""},
+			resultData: [][]interface{}{
+				{""},
 			},
 			expectedResult: "",
 			expectError:    true,
 		},
 		{
 			name: "whitespace only result",
-			resultData: []map[string]interface{}{
-				{"?column?": "  \n  \t  "},
+			resultData: [][]interface{}{
+				{"  \n  \t  "},
 			},
 			expectedResult: "",
 			expectError:    true,
 		},
+		{
+			name: "first valid row wins",
+			resultData: [][]interface{}{
+				{nil},
+				{"/data/coordinator/gpseg-1"},
+			},
+			expectedResult: "/data/coordinator/gpseg-1/log",
+			expectError:    false,
+		},
 		{
 			name:           "no results",
-			resultData:     []map[string]interface{}{},
+			resultData:     [][]interface{}{},
 			expectedResult: "",
 			expectError:    true,
 		},
 	}
-	
+
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Simulate the parsing logic from getLogDirectoryFromDB
-			var logDir string
-			var foundValid bool
-			
-			if len(tc.resultData) == 0 {
-				foundValid = false
-			} else {
-				for _, row := range tc.resultData {
-					for _, value := range row {
-						var candidate string
-						if str, ok := value.(string); ok {
-							candidate = str
-						} else if bytes, ok := value.([]byte); ok && len(bytes) > 0 {
-							candidate = string(bytes)
-						} else {
-							continue
-						}
-						
-						// Apply the same trimming logic as the real function
-						trimmed := strings.TrimSpace(candidate)
-						if trimmed != "" {
-							logDir = trimmed
-							foundValid = true
-							break
-						}
-					}
-					if foundValid {
-						break
-					}
-				}
-			}
-			
+			querier := dbtest.NewQuerier()
+			querier.Info = dbtest.GreenplumInfo(dbtest.Greenplum7Version, "group")
+			querier.Handle(`from gp_segment_configuration`,
+				db.NewResult([]db.Column{{Name: "datadir", DatabaseType: "TEXT"}}, tc.resultData...))
+
+			logDir, err := getLogDirectoryFromDB(context.Background(), querier)
+
 			if tc.expectError {
-				if foundValid {
+				if err == nil {
 					t.Errorf("Expected error for case '%s', but got result: %s", tc.name, logDir)
 				}
 			} else {
-				if !foundValid {
-					t.Errorf("Expected result for case '%s', but got error", tc.name)
+				if err != nil {
+					t.Errorf("Expected result for case '%s', but got error: %v", tc.name, err)
 				} else if logDir != tc.expectedResult {
 					t.Errorf("Expected result '%s' for case '%s', but got '%s'", tc.expectedResult, tc.name, logDir)
 				}
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestLogDirectoryQueryError(t *testing.T) {
+	querier := dbtest.NewQuerier()
+	querier.Info = dbtest.GreenplumInfo(dbtest.Greenplum6Version, "queue")
+	querier.HandleError(`from gp_segment_configuration`, errors.New("permission denied"))
+
+	if logDir, err := getLogDirectoryFromDB(context.Background(), querier); err == nil {
+		t.Errorf("Expected an error, but got result: %s", logDir)
+	}
+}
+
+// Test getLogDirectoryFromDB end to end against the in-process test server
+func TestGetLogDirectoryFromDB(t *testing.T) {
+	testCases := []struct {
+		name           string
+		version        string
+		datadirs       []interface{}
+		expectedResult string
+		expectError    bool
+	}{
+		{
+			name:           "greenplum 7 uses log",
+			version:        dbtest.Greenplum7Version,
+			datadirs:       []interface{}{"/data/coordinator/gpseg-1"},
+			expectedResult: "/data/coordinator/gpseg-1/log",
+		},
+		{
+			name:           "greenplum 6 uses pg_log",
+			version:        dbtest.Greenplum6Version,
+			datadirs:       []interface{}{"  /data/master/gpseg-1\n"},
+			expectedResult: "/data/master/gpseg-1/pg_log",
+		},
+		{
+			name:        "null datadir",
+			version:     dbtest.Greenplum7Version,
+			datadirs:    []interface{}{nil},
+			expectError: true,
+		},
+		{
+			name:        "no rows",
+			version:     dbtest.Greenplum7Version,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := dbtest.NewServer()
+			if err != nil {
+				t.Fatalf("Failed to start the test server: %v", err)
+			}
+			defer server.Close()
+
+			server.Greenplum(tc.version, "queue")
+			response := dbtest.Response{Columns: []dbtest.Column{{Name: "datadir", Type: dbtest.TypeText}}}
+			for _, datadir := range tc.datadirs {
+				response.Rows = append(response.Rows, []interface{}{datadir})
+			}
+			server.Handle(`from gp_segment_configuration`, response)
+
+			client, err := db.NewClient(server.ConnString())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer client.Close()
+
+			logDir, err := getLogDirectoryFromDB(context.Background(), client)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error for case '%s', but got result: %s", tc.name, logDir)
+				}
+			} else if err != nil {
+				t.Errorf("Expected result for case '%s', but got error: %v", tc.name, err)
+			} else if logDir != tc.expectedResult {
+				t.Errorf("Expected result '%s' for case '%s', but got '%s'", tc.expectedResult, tc.name, logDir)
+			}
+		})
+	}
+}
+
+// List the names of every entry in a tar.gz archive but the manifest, sorted.
+func archiveEntries(t *testing.T, archiveName string) []string {
+	t.Helper()
+	file, err := os.Open(archiveName)
+	if err != nil {
+		t.Fatalf("Failed to open the archive: %v", err)
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Failed to read the archive: %v", err)
+	}
+	tr := tar.NewReader(gr)
+
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read the archive: %v", err)
+		}
+		if header.Name != manifestName {
+			names = append(names, header.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List the collected logs in an archive, leaving out the catalog snapshots.
+func logEntries(t *testing.T, archiveName string) []string {
+	t.Helper()
+	var names []string
+	for _, name := range archiveEntries(t, archiveName) {
+		if !strings.HasPrefix(name, catalogArchiveDir+"/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// clusterQuerier fakes a cluster of the given version made of segments. The
+// coordinator's data directory answers the log directory lookup.
+func clusterQuerier(t *testing.T, version string, segments []db.Segment) *dbtest.Querier {
+	t.Helper()
+	resourceManager := "group"
+	if version == dbtest.Greenplum6Version {
+		resourceManager = "queue"
+	}
+	querier := dbtest.NewQuerier()
+	querier.Info = dbtest.GreenplumInfo(version, resourceManager)
+
+	for _, segment := range segments {
+		if segment.ContentID == db.CoordinatorContentID && segment.Role == db.RolePrimary {
+			querier.Handle(`from gp_segment_configuration`,
+				db.NewResult([]db.Column{{Name: "datadir", DatabaseType: "TEXT"}}, []interface{}{segment.DataDir}))
+			querier.Segments(segments)
+			return querier
+		}
+	}
+	t.Fatalf("No coordinator among the segments %+v", segments)
+	return nil
+}
+
+func TestLogCollectorDateFilter(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	dataDir := t.TempDir()
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, modTime := range map[string]string{
+		"gpdb-2024-01-14_000000.csv": "2024-01-14 23:59:59",
+		"gpdb-2024-01-15_000000.csv": "2024-01-15 23:59:59",
+		"gpdb-2024-01-16_000000.csv": "2024-01-16 10:00:00",
+		"startup.log":                "2024-01-15 13:00:00",
+		"old.log":                    "2023-12-01 08:00:00",
+	} {
+		path := filepath.Join(logDir, name)
+		if err := os.WriteFile(path, []byte("log line\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, localTime(modTime), localTime(modTime)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: dataDir},
+	})
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2024-01-15 12:00", endDate: "2024-01-15"}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	expected := []string{"gpdb-2024-01-15_000000.csv", "startup.log"}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+}
+
+// A file that disappears after it was listed is recorded in the manifest,
+// and the archive is kept with the others.
+func TestAddFileToTarMissing(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	logDir := t.TempDir()
+	kept := filepath.Join(logDir, "gpdb-2024-01-15_000000.csv")
+	if err := os.WriteFile(kept, []byte("log line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(logDir, "gpdb-2024-01-16_000000.csv")
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	err := writeArchive(archiveName, &archiveManifest{}, nil, func(aw *archiveWriter) error {
+		for _, path := range []string{removed, kept} {
+			if err := addFileToTar(aw, path, logDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the archive to be written, got %v", err)
+	}
+
+	if content := archiveFile(t, archiveName, "gpdb-2024-01-15_000000.csv"); content != "log line\n" {
+		t.Errorf("Unexpected content %q", content)
+	}
+	manifest := readManifest(t, archiveName)
+	if len(manifest.Errors) != 1 || manifest.Errors[0].Path != removed {
+		t.Errorf("Expected the failure of %s to be recorded, got %+v", removed, manifest.Errors)
+	}
+}
+
+// Read one entry of a tar.gz archive.
+func archiveFile(t *testing.T, archiveName string, name string) string {
+	t.Helper()
+	file, err := os.Open(archiveName)
+	if err != nil {
+		t.Fatalf("Failed to open the archive: %v", err)
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Failed to read the archive: %v", err)
+	}
+	tr := tar.NewReader(gr)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			t.Fatalf("No %s in the archive", name)
+		}
+		if err != nil {
+			t.Fatalf("Failed to read the archive: %v", err)
+		}
+		if header.Name == name {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", name, err)
+			}
+			return string(data)
+		}
+	}
+}
+
+func TestResultCSV(t *testing.T) {
+	result := db.NewResult(
+		[]db.Column{{Name: "time", DatabaseType: "TIMESTAMPTZ"}, {Name: "dbid", DatabaseType: "INT2"}, {Name: "desc", DatabaseType: "TEXT"}},
+		[]interface{}{time.Date(2024, 1, 15, 14, 5, 0, 0, time.UTC), int64(3), `FTS: content 1 "down"`},
+		[]interface{}{nil, nil, []byte("a,b")},
+	)
+	data, err := resultCSV(result)
+	if err != nil {
+		t.Fatalf("resultCSV failed: %v", err)
+	}
+	expected := "time,dbid,desc\n2024-01-15 14:05:00+00,3,\"FTS: content 1 \"\"down\"\"\"\n,,\"a,b\"\n"
+	if string(data) != expected {
+		t.Errorf("Expected %q, got %q", expected, data)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Accepted layouts for --start and --end, each paired with its precision. An
+// --end value covers the whole of its last unit, so "--end 2024-01-15" runs to
+// midnight and "--end '2024-01-15 14:30'" to 14:31.
+var windowLayouts = []struct {
+	layout    string
+	precision time.Duration
+}{
+	{"2006-01-02", 24 * time.Hour},
+	{"2006-01-02 15", time.Hour},
+	{"2006-01-02 15:04", time.Minute},
+	{"2006-01-02 15:04:05", time.Second},
+}
+
+// Greenplum names its CSV logs after the time they were opened, e.g.
+// gpdb-2024-01-15_093000.csv with the default log_filename.
+var logFileTimePattern = regexp.MustCompile(`(\d{4}-\d{2}-\d{2})(?:_(\d{6}))?`)
+
+// timeWindow is the span of time to collect logs for. The end is exclusive.
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// parseTimeWindow builds the collection window from the --start and --end
+// flags, read in the local time zone like the server's log file names.
+func parseTimeWindow(start string, end string) (timeWindow, error) {
+	startTime, _, err := parseWindowBound(start)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid --start: %w", err)
+	}
+	endTime, precision, err := parseWindowBound(end)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid --end: %w", err)
+	}
+
+	window := timeWindow{start: startTime, end: endTime.Add(precision)}
+	if !window.end.After(window.start) {
+		return timeWindow{}, fmt.Errorf("--end %q is before --start %q", end, start)
+	}
+	return window, nil
+}
+
+// Parse a single --start or --end value, returning its precision as well.
+func parseWindowBound(value string) (time.Time, time.Duration, error) {
+	value = strings.Replace(strings.TrimSpace(value), "T", " ", 1)
+	for _, candidate := range windowLayouts {
+		if parsed, err := time.ParseInLocation(candidate.layout, value, time.Local); err == nil {
+			return parsed, candidate.precision, nil
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("%q is not a date (YYYY-MM-DD) or time (YYYY-MM-DD HH[:MM[:SS]])", value)
+}
+
+// logFileTime returns the time a log file was opened, taken from its name.
+func logFileTime(name string) (time.Time, bool) {
+	match := logFileTimePattern.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+	layout, value := "2006-01-02", match[1]
+	if match[2] != "" {
+		layout, value = "2006-01-02_150405", match[1]+"_"+match[2]
+	}
+	parsed, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return parsed, true
+}
+
+// String describes the window for progress output.
+func (window timeWindow) String() string {
+	const layout = "2006-01-02 15:04:05"
+	return fmt.Sprintf("%s to %s", window.start.Format(layout), window.end.Format(layout))
+}
+
+// includesFile reports whether a log file may hold entries inside the window.
+// A file holds entries from the time in its name up to its last write, so it
+// is kept when that span overlaps the window. Without a time in the name we
+// only know when writing stopped, so anything written to since the window
+// opened is kept.
+func (window timeWindow) includesFile(name string, modTime time.Time) bool {
+	if modTime.Before(window.start) {
+		return false
+	}
+	if opened, ok := logFileTime(name); ok {
+		return opened.Before(window.end)
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func localTime(value string) time.Time {
+	parsed, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	testCases := []struct {
+		name        string
+		start       string
+		end         string
+		expected    timeWindow
+		expectError bool
+	}{
+		{
+			name:     "whole days",
+			start:    "2024-01-15",
+			end:      "2024-01-16",
+			expected: timeWindow{start: localTime("2024-01-15 00:00:00"), end: localTime("2024-01-17 00:00:00")},
+		},
+		{
+			name:     "single day",
+			start:    "2024-01-15",
+			end:      "2024-01-15",
+			expected: timeWindow{start: localTime("2024-01-15 00:00:00"), end: localTime("2024-01-16 00:00:00")},
+		},
+		{
+			name:     "minute precision",
+			start:    "2024-01-15 14:00",
+			end:      "2024-01-15T14:30",
+			expected: timeWindow{start: localTime("2024-01-15 14:00:00"), end: localTime("2024-01-15 14:31:00")},
+		},
+		{
+			name:     "hour precision",
+			start:    "2024-01-15 14",
+			end:      "2024-01-15 15",
+			expected: timeWindow{start: localTime("2024-01-15 14:00:00"), end: localTime("2024-01-15 16:00:00")},
+		},
+		{
+			name:     "second precision",
+			start:    "2024-01-15 14:00:00",
+			end:      "2024-01-15 14:00:59",
+			expected: timeWindow{start: localTime("2024-01-15 14:00:00"), end: localTime("2024-01-15 14:01:00")},
+		},
+		{
+			name:        "end before start",
+			start:       "2024-01-16",
+			end:         "2024-01-15",
+			expectError: true,
+		},
+		{
+			name:        "not a date",
+			start:       "yesterday",
+			end:         "2024-01-15",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			window, err := parseTimeWindow(tc.start, tc.end)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", window)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !window.start.Equal(tc.expected.start) || !window.end.Equal(tc.expected.end) {
+				t.Errorf("Expected %s, got %s", tc.expected, window)
+			}
+		})
+	}
+}
+
+func TestLogFileTime(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected time.Time
+		ok       bool
+	}{
+		{name: "gpdb-2024-01-15_093000.csv", expected: localTime("2024-01-15 09:30:00"), ok: true},
+		{name: "gpdb-2024-01-15_000000.csv.gz", expected: localTime("2024-01-15 00:00:00"), ok: true},
+		{name: "gpdb-2024-01-15.csv", expected: localTime("2024-01-15 00:00:00"), ok: true},
+		{name: "startup.log", ok: false},
+		{name: "gpdb-2024-13-45_000000.csv", ok: false},
+	}
+
+	for _, tc := range testCases {
+		parsed, ok := logFileTime(tc.name)
+		if ok != tc.ok || !parsed.Equal(tc.expected) {
+			t.Errorf("logFileTime(%q) = %s, %t; expected %s, %t", tc.name, parsed, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestWindowIncludesFile(t *testing.T) {
+	window, err := parseTimeWindow("2024-01-15 14:00", "2024-01-15 15:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		file     string
+		modTime  string
+		expected bool
+	}{
+		{name: "opened inside the window", file: "gpdb-2024-01-15_143000.csv", modTime: "2024-01-15 16:00:00", expected: true},
+		{name: "opened before and still written in the window", file: "gpdb-2024-01-15_000000.csv", modTime: "2024-01-15 23:59:59", expected: true},
+		{name: "finished before the window", file: "gpdb-2024-01-15_000000.csv", modTime: "2024-01-15 13:59:00", expected: false},
+		{name: "opened after the window", file: "gpdb-2024-01-15_150100.csv", modTime: "2024-01-15 18:00:00", expected: false},
+		{name: "opened in the last minute", file: "gpdb-2024-01-15_150059.csv", modTime: "2024-01-15 18:00:00", expected: true},
+		{name: "no date written since", file: "startup.log", modTime: "2024-01-20 10:00:00", expected: true},
+		{name: "no date written before", file: "startup.log", modTime: "2024-01-14 10:00:00", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if included := window.includesFile(tc.file, localTime(tc.modTime)); included != tc.expected {
+				t.Errorf("Expected includesFile(%s, %s) to be %t", tc.file, tc.modTime, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the manifest at the root of every archive
+const manifestName = "MANIFEST.json"
+
+// archiveManifest records what an archive holds, where each file came from
+// and what could not be collected. It is written as the archive's last entry.
+type archiveManifest struct {
+	GpmtVersion    string          `json:"gpmt_version"`
+	CommandLine    []string        `json:"command_line"`
+	ClusterVersion string          `json:"cluster_version,omitempty"`
+	Created        time.Time       `json:"created"`
+	Window         *manifestWindow `json:"time_window,omitempty"`
+	Entries        []manifestEntry `json:"entries"`
+	Errors         []manifestError `json:"errors,omitempty"`
+
+	// Redactions lists the rules applied to every file with --redact
+	Redactions []manifestRedaction `json:"redactions,omitempty"`
+
+	// Guards Errors, which hosts worked on in parallel add to
+	mu sync.Mutex
+}
+
+// manifestWindow is the time window the logs were collected for.
+type manifestWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// manifestEntry describes one file of the archive. SourcePath is empty for
+// content gpmt generated itself, such as query results.
+type manifestEntry struct {
+	Name       string    `json:"name"`
+	Host       string    `json:"host"`
+	SourcePath string    `json:"source_path,omitempty"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	SHA256     string    `json:"sha256"`
+}
+
+// manifestError is a host, or a single file on it, that was not collected.
+type manifestError struct {
+	Host  string `json:"host"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// manifestRedaction is a redaction rule applied to the archive and how many
+// values it masked.
+type manifestRedaction struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	Pattern     string `json:"pattern,omitempty"`
+	Matches     int    `json:"matches"`
+}
+
+// newArchiveManifest starts the manifest of a collection run. The cluster
+// version is only known when the database is reachable.
+func newArchiveManifest(ctx context.Context, querier db.Querier) *archiveManifest {
+	manifest := &archiveManifest{
+		GpmtVersion: gpmtVersion,
+		CommandLine: maskCommandLine(os.Args),
+		Created:     time.Now(),
+		Entries:     []manifestEntry{},
+	}
+	if querier != nil {
+		if info, err := querier.ServerInfo(ctx); err == nil {
+			manifest.ClusterVersion = info.VersionString
+		} else {
+			log.Debugf("Failed to detect the server version for the manifest: %v", err)
+		}
+	}
+	return manifest
+}
+
+// Flags whose values are kept out of the manifest
+var maskedFlags = []string{"--password", "--redact-pattern"}
+
+// maskCommandLine hides the values of maskedFlags, as the archive is meant to
+// be shared.
+func maskCommandLine(args []string) []string {
+	masked := make([]string, len(args))
+	copy(masked, args)
+	for idx, arg := range masked {
+		for _, flag := range maskedFlags {
+			switch {
+			case arg == flag && idx+1 < len(masked):
+				masked[idx+1] = "********"
+			case strings.HasPrefix(arg, flag+"="):
+				masked[idx] = flag + "=********"
+			}
+		}
+	}
+	return masked
+}
+
+// setWindow records the time window the logs were collected for.
+func (manifest *archiveManifest) setWindow(window timeWindow) {
+	manifest.Window = &manifestWindow{Start: window.start, End: window.end}
+}
+
+// addError records a host, or a file on it when path is set, that could not
+// be collected.
+func (manifest *archiveManifest) addError(host string, path string, err error) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	manifest.Errors = append(manifest.Errors, manifestError{Host: host, Path: path, Error: err.Error()})
+}
+
+// archiveWriter writes the entries of an archive, recording each of them in
+// the manifest along with its checksum. With a redactor, every entry is
+// redacted first, through a temporary file in tempDir.
+type archiveWriter struct {
+	tw       *tar.Writer
+	manifest *archiveManifest
+	redactor *redactor
+	tempDir  string
+}
+
+// writeEntry adds a file read from content to the archive. host and
+// sourcePath say where the file was collected from. Exactly header.Size bytes
+// are archived: a log still being written is cut at the size it had when it
+// was listed, and one that can't be read to that size is padded with zeros
+// and recorded in the manifest as an error.
+func (aw *archiveWriter) writeEntry(header *tar.Header, host string, sourcePath string, content io.Reader) error {
+	size := header.Size
+	source := &sourceReader{r: io.LimitReader(content, size)}
+	content = source
+	if aw.redactor != nil {
+		redacted, err := aw.redact(header.Name, content)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(redacted.Name())
+		defer redacted.Close()
+
+		redactedSize, err := redacted.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err := redacted.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		header.Size = redactedSize
+		content = redacted
+	}
+
+	if err := aw.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	out := io.MultiWriter(aw.tw, hash)
+	written, err := io.CopyN(out, content, header.Size)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if written < header.Size {
+		if _, err := io.CopyN(out, zeroReader{}, header.Size-written); err != nil {
+			return err
+		}
+	}
+	if readErr := source.incomplete(size); readErr != nil {
+		log.Warnf("Archived %s from %s incompletely: %v", header.Name, host, readErr)
+		aw.manifest.addError(host, sourcePath, readErr)
+	}
+
+	aw.manifest.Entries = append(aw.manifest.Entries, manifestEntry{
+		Name:       header.Name,
+		Host:       host,
+		SourcePath: sourcePath,
+		Size:       header.Size,
+		ModTime:    header.ModTime,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+	})
+	return nil
+}
+
+// sourceReader reads the content of an entry, counting the bytes read. A
+// read error ends the content early instead of failing the archive; it is
+// kept for incomplete to report.
+type sourceReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.n += int64(n)
+	if err != nil && err != io.EOF {
+		sr.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// incomplete explains why fewer than size bytes were read, if they were.
+func (sr *sourceReader) incomplete(size int64) error {
+	switch {
+	case sr.err != nil:
+		return fmt.Errorf("read failed after %d of %d bytes: %w", sr.n, size, sr.err)
+	case sr.n < size:
+		return fmt.Errorf("file shrank from %d to %d bytes while being archived", size, sr.n)
+	}
+	return nil
+}
+
+// zeroReader pads entries whose source came up short.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// redact writes the redacted content of an entry to a temporary file, as its
+// size has to be known before it is added to the archive.
+func (aw *archiveWriter) redact(name string, content io.Reader) (*os.File, error) {
+	redacted, err := os.CreateTemp(aw.tempDir, ".gpmt_redact_*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file for redaction: %w", err)
+	}
+	if err := aw.redactor.redact(name, content, redacted); err != nil {
+		redacted.Close()
+		os.Remove(redacted.Name())
+		return nil, fmt.Errorf("failed to redact %s: %w", name, err)
+	}
+	return redacted, nil
+}
+
+// writeManifest adds the manifest itself as the last entry of the archive.
+func (aw *archiveWriter) writeManifest() error {
+	if aw.redactor != nil {
+		// Errors often quote addresses and paths as well
+		for idx := range aw.manifest.Errors {
+			aw.manifest.Errors[idx].Error = aw.redactor.redactText(aw.manifest.Errors[idx].Error)
+		}
+		aw.manifest.Redactions = aw.redactor.applied()
+	}
+	data, err := json.MarshalIndent(aw.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to format the manifest: %w", err)
+	}
+	data = append(data, '\n')
+	header := &tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := aw.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = aw.tw.Write(data)
+	return err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+func TestMaskCommandLine(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"gpmt", "gp_log_collector", "--c", "0"}, []string{"gpmt", "gp_log_collector", "--c", "0"}},
+		{[]string{"gpmt", "--password", "secret", "gp_log_collector"}, []string{"gpmt", "--password", "********", "gp_log_collector"}},
+		{[]string{"gpmt", "--password=secret"}, []string{"gpmt", "--password=********"}},
+		{[]string{"gpmt", "gp_log_collector", "--redact-pattern", "acme-[0-9]+"}, []string{"gpmt", "gp_log_collector", "--redact-pattern", "********"}},
+	}
+
+	for _, tc := range testCases {
+		if masked := maskCommandLine(tc.args); !reflect.DeepEqual(masked, tc.expected) {
+			t.Errorf("Expected %v, got %v", tc.expected, masked)
+		}
+	}
+}
+
+func TestHostLogsSourcePath(t *testing.T) {
+	target := hostLogs{host: "smdw", bundles: []remoteBundle{
+		{sourceDir: "/data/coordinator/gpseg-1/log", archiveDir: "log"},
+		{sourceDir: "/data/coordinator/gpseg-1"},
+	}}
+	testCases := map[string]string{
+		"log/gpdb-2024-01-15_000000.csv": "/data/coordinator/gpseg-1/log/gpdb-2024-01-15_000000.csv",
+		"pg_hba.conf":                    "/data/coordinator/gpseg-1/pg_hba.conf",
+		"logfile":                        "/data/coordinator/gpseg-1/logfile",
+	}
+	for name, expected := range testCases {
+		if source := target.sourcePath(name); source != expected {
+			t.Errorf("Expected %s to come from %s, got %s", name, expected, source)
+		}
+	}
+}
+
+// readManifest decodes the manifest of a tar.gz archive.
+func readManifest(t *testing.T, archiveName string) *archiveManifest {
+	t.Helper()
+	manifest := &archiveManifest{}
+	if err := json.Unmarshal([]byte(archiveFile(t, archiveName, manifestName)), manifest); err != nil {
+		t.Fatalf("Failed to decode the manifest: %v", err)
+	}
+	return manifest
+}
+
+// The manifest lists where every file came from and which host failed.
+func TestLogCollectorManifest(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	logDir := filepath.Join(root, "primary1", "log")
+	for _, dir := range []string{logDir, filepath.Join(root, "coordinator", "log")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte("ok\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "primary1")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	executor := &unreachableExecutor{Executor: remote.LocalExecutor{}, down: "sdw1"}
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2024-01-15", endDate: "2100-01-01", contentIds: []string{"0,1"}, segmentDir: t.TempDir()}
+	if err := logCollector(context.Background(), querier, executor, archiveName, opts); err == nil {
+		t.Fatal("Expected an error for the unreachable host")
+	}
+
+	manifest := readManifest(t, archiveName)
+	if manifest.GpmtVersion != gpmtVersion || manifest.ClusterVersion != querier.Info.VersionString {
+		t.Errorf("Unexpected versions %q and %q", manifest.GpmtVersion, manifest.ClusterVersion)
+	}
+	if manifest.Window == nil || !manifest.Window.Start.Equal(localTime("2024-01-15 00:00:00")) ||
+		!manifest.Window.End.Equal(localTime("2100-01-02 00:00:00")) {
+		t.Errorf("Unexpected time window %+v", manifest.Window)
+	}
+
+	checksum := sha256.Sum256([]byte("ok\n"))
+	expected := manifestEntry{
+		Name:       "sdw2/gpseg1-p/startup.log",
+		Host:       "sdw2",
+		SourcePath: filepath.Join(logDir, "startup.log"),
+		Size:       3,
+		SHA256:     hex.EncodeToString(checksum[:]),
+	}
+	var found bool
+	for _, entry := range manifest.Entries {
+		if entry.Name != expected.Name {
+			continue
+		}
+		found = true
+		entry.ModTime = expected.ModTime
+		if entry != expected {
+			t.Errorf("Expected entry %+v, got %+v", expected, entry)
+		}
+	}
+	if !found {
+		t.Errorf("No %s in the manifest: %+v", expected.Name, manifest.Entries)
+	}
+
+	failedHosts := map[string]bool{}
+	for _, collectionErr := range manifest.Errors {
+		failedHosts[collectionErr.Host] = true
+	}
+	if !failedHosts["sdw1"] || failedHosts["sdw2"] {
+		t.Errorf("Expected only the failure of sdw1 to be recorded, got %+v", manifest.Errors)
+	}
+}
+
+// failingReader returns its data, then fails.
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("input/output error")
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+// Entries hold exactly the size of their header, whatever their source
+// turns out to hold by the time it is read.
+func TestArchiveWriterEntrySize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		size     int64
+		content  io.Reader
+		expected string
+		failed   bool
+	}{
+		{name: "same.csv", size: 4, content: strings.NewReader("abcd"), expected: "abcd"},
+		{name: "grown.csv", size: 4, content: strings.NewReader("abcdefgh"), expected: "abcd"},
+		{name: "shrunk.csv", size: 4, content: strings.NewReader("ab"), expected: "ab\x00\x00", failed: true},
+		{name: "unreadable.csv", size: 4, content: &failingReader{data: []byte("abc")}, expected: "abc\x00", failed: true},
+	}
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	manifest := newArchiveManifest(context.Background(), nil)
+	err := writeArchive(archiveName, manifest, nil, func(aw *archiveWriter) error {
+		for _, tc := range testCases {
+			header := &tar.Header{Name: tc.name, Mode: 0644, Size: tc.size}
+			if err := aw.writeEntry(header, "cdw", "/data/log/"+tc.name, tc.content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to write the archive: %v", err)
+	}
+
+	manifest = readManifest(t, archiveName)
+	failedPaths := map[string]bool{}
+	for _, collectionErr := range manifest.Errors {
+		failedPaths[collectionErr.Path] = true
+	}
+	for _, tc := range testCases {
+		if content := archiveFile(t, archiveName, tc.name); content != tc.expected {
+			t.Errorf("Expected %s to hold %q, got %q", tc.name, tc.expected, content)
+		}
+		if failed := failedPaths["/data/log/"+tc.name]; failed != tc.failed {
+			t.Errorf("Expected an error recorded for %s to be %v, got %v", tc.name, tc.failed, failed)
+		}
+	}
+	checksum := sha256.Sum256([]byte("ab\x00\x00"))
+	for _, entry := range manifest.Entries {
+		if entry.Name == "shrunk.csv" && (entry.Size != 4 || entry.SHA256 != hex.EncodeToString(checksum[:])) {
+			t.Errorf("Expected the padded content in the manifest, got %+v", entry)
+		}
+	}
+}
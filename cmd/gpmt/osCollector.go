@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archive directory holding the host diagnostics, one subdirectory per host
+const osArchiveDir = "os"
+
+// Marks the start of each diagnostic's output in the combined script output
+const osSectionMarker = "==> gpmt diagnostic:"
+
+// Kernel settings that the Greenplum installation guide asks to be tuned
+var greenplumSysctls = []string{
+	"kernel.shmmax", "kernel.shmmni", "kernel.shmall", "kernel.sem",
+	"kernel.sysrq", "kernel.core_uses_pid", "kernel.core_pattern",
+	"kernel.msgmnb", "kernel.msgmax", "kernel.msgmni",
+	"net.ipv4.tcp_syncookies", "net.ipv4.ip_forward", "net.ipv4.conf.default.accept_source_route",
+	"net.ipv4.tcp_tw_recycle", "net.ipv4.tcp_max_syn_backlog", "net.ipv4.conf.all.arp_filter",
+	"net.ipv4.ip_local_port_range", "net.core.netdev_max_backlog", "net.core.rmem_max", "net.core.wmem_max",
+	"vm.overcommit_memory", "vm.overcommit_ratio", "vm.swappiness", "vm.zone_reclaim_mode",
+	"vm.dirty_expire_centisecs", "vm.dirty_writeback_centisecs", "vm.dirty_background_ratio",
+	"vm.dirty_ratio", "vm.dirty_background_bytes", "vm.dirty_bytes", "vm.min_free_kbytes",
+}
+
+// osDiagnostic is one host fact, gathered by a shell snippet whose output
+// becomes <name>.txt in the host's directory. Snippets use run for external
+// commands so a missing one is noted in the output rather than failing.
+type osDiagnostic struct {
+	name   string
+	script func(dataDirs []string) string
+}
+
+var osDiagnostics = []osDiagnostic{
+	{"kernel", func([]string) string {
+		return "run uname -a; cat /etc/os-release"
+	}},
+	{"sysctl", func([]string) string {
+		return "run sysctl " + strings.Join(greenplumSysctls, " ")
+	}},
+	{"ulimits", func([]string) string {
+		return "ulimit -a; cat /etc/security/limits.conf /etc/security/limits.d/*.conf"
+	}},
+	{"memory", func([]string) string {
+		return "run free -m; cat /proc/meminfo; cat /proc/swaps"
+	}},
+	{"disk_usage", func(dataDirs []string) string {
+		if len(dataDirs) == 0 {
+			return "run df -hP"
+		}
+		quoted := make([]string, len(dataDirs))
+		for idx, dataDir := range dataDirs {
+			quoted[idx] = remote.Quote(dataDir)
+		}
+		return "run df -hP " + strings.Join(quoted, " ") + "; run du -sh " + strings.Join(quoted, " ")
+	}},
+	{"mounts", func([]string) string {
+		return "cat /proc/mounts"
+	}},
+	{"transparent_hugepages", func([]string) string {
+		return "for f in /sys/kernel/mm/transparent_hugepage/enabled /sys/kernel/mm/transparent_hugepage/defrag; do echo \"$f: $(cat $f 2>&1)\"; done"
+	}},
+	{"time_sync", func([]string) string {
+		return "run timedatectl; run chronyc tracking; run chronyc sources; run ntpq -p"
+	}},
+	{"dmesg", func([]string) string {
+		return "run dmesg -T | tail -n 500"
+	}},
+}
+
+// osTarget is a host to gather diagnostics from, with the Greenplum data
+// directories it holds.
+type osTarget struct {
+	host     string
+	local    bool
+	dataDirs []string
+}
+
+// osDiagnosticsScript builds a single script gathering every diagnostic, so
+// each host only needs one round trip. Each diagnostic's output follows a
+// marker line naming it, and the script always succeeds.
+func osDiagnosticsScript(dataDirs []string) string {
+	var script strings.Builder
+	script.WriteString(`run() { if command -v "$1" >/dev/null 2>&1; then "$@"; else echo "$1: command not found"; fi; }` + "\n")
+	for _, diagnostic := range osDiagnostics {
+		fmt.Fprintf(&script, "echo %s\n", remote.Quote(osSectionMarker+diagnostic.name))
+		fmt.Fprintf(&script, "{ %s; } 2>&1\n", diagnostic.script(dataDirs))
+	}
+	script.WriteString("exit 0\n")
+	return script.String()
+}
+
+// splitOSSections splits the script output into each diagnostic's output.
+func splitOSSections(output []byte) map[string][]byte {
+	sections := make(map[string][]byte)
+	var name string
+	for _, line := range bytes.SplitAfter(output, []byte("\n")) {
+		if marker := strings.TrimSpace(string(line)); strings.HasPrefix(marker, osSectionMarker) {
+			name = strings.TrimPrefix(marker, osSectionMarker)
+			sections[name] = []byte{}
+			continue
+		}
+		if name != "" {
+			sections[name] = append(sections[name], line...)
+		}
+	}
+	return sections
+}
+
+// osTargets lists the coordinator and the segment hosts to gather from.
+// Without a database only the coordinator, this machine, is known. When
+// segments were selected only their hosts are included, otherwise every host
+// in the cluster is.
+func osTargets(ctx context.Context, querier db.Querier, opts LogCollectorOptions) ([]osTarget, error) {
+	if querier == nil {
+		target := osTarget{host: localHostname(), local: true}
+		if dataDir := os.Getenv("MASTER_DATA_DIRECTORY"); dataDir != "" {
+			target.dataDirs = []string{dataDir}
+		}
+		log.Warn("Only gathering diagnostics from this host as the database is unreachable")
+		return []osTarget{target}, nil
+	}
+
+	segments, err := db.ListSegments(ctx, querier)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := segmentHosts(ctx, querier, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, target := range selected {
+		wanted[target.host] = true
+	}
+
+	byHost := make(map[string]*osTarget)
+	var coordinator string
+	for _, segment := range segments {
+		isCoordinator := segment.ContentID == db.CoordinatorContentID && segment.Role == db.RolePrimary
+		if isCoordinator {
+			coordinator = segment.Hostname
+		} else if len(wanted) > 0 && !wanted[segment.Hostname] {
+			continue
+		}
+		target, ok := byHost[segment.Hostname]
+		if !ok {
+			target = &osTarget{host: segment.Hostname}
+			byHost[segment.Hostname] = target
+		}
+		target.local = target.local || isCoordinator
+		target.dataDirs = append(target.dataDirs, segment.DataDir)
+	}
+
+	// The coordinator first, then the other hosts by name
+	targets := make([]osTarget, 0, len(byHost))
+	for _, target := range byHost {
+		targets = append(targets, *target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if (targets[i].host == coordinator) != (targets[j].host == coordinator) {
+			return targets[i].host == coordinator
+		}
+		return targets[i].host < targets[j].host
+	})
+	return targets, nil
+}
+
+// osCollector gathers host diagnostics from the coordinator and the segment
+// hosts into an archive, instead of any logs, from several hosts at once. A
+// host that cannot be reached or runs past --host-timeout is reported and
+// skipped. The diagnostics are redacted when redact is set.
+func osCollector(ctx context.Context, querier db.Querier, executor remote.Executor, archiveName string,
+	redact *redactor, opts LogCollectorOptions) error {
+	targets, err := osTargets(ctx, querier, opts)
+	if err != nil {
+		return err
+	}
+
+	manifest := newArchiveManifest(ctx, querier)
+
+	fmt.Printf("Starting host diagnostics collection...\n")
+	fmt.Printf("Diagnostics will be archived to: %s\n", archiveName)
+
+	pool := newHostPool(opts)
+	sections := make([]map[string][]byte, len(targets))
+	finished := 0
+	var failedHosts []string
+	err = writeArchive(archiveName, manifest, redact, func(aw *archiveWriter) error {
+		err := pool.run(ctx, len(targets), func(ctx context.Context, idx int) error {
+			var err error
+			sections[idx], err = gatherOSDiagnostics(ctx, executor, targets[idx])
+			return err
+		}, func(idx int, err error) error {
+			target := targets[idx]
+			finished++
+			progress := fmt.Sprintf("[%d/%d] %s", finished, len(targets), target.host)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				fmt.Printf("%s: failed\n", progress)
+				log.Warnf("Failed to collect host diagnostics from %s: %v", target.host, err)
+				manifest.addError(target.host, "", err)
+				failedHosts = append(failedHosts, target.host)
+				return nil
+			}
+
+			for _, diagnostic := range osDiagnostics {
+				name := path.Join(osArchiveDir, target.host, diagnostic.name+".txt")
+				if err := addBytesToTar(aw, name, target.host, sections[idx][diagnostic.name]); err != nil {
+					return err
+				}
+			}
+			sections[idx] = nil
+			fmt.Printf("%s: done\n", progress)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(failedHosts) > 0 {
+		return fmt.Errorf("failed to collect host diagnostics from %s", strings.Join(failedHosts, ", "))
+	}
+	fmt.Println("Host diagnostics collection complete.")
+	return nil
+}
+
+// gatherOSDiagnostics runs the diagnostics script on one host and returns
+// each diagnostic's output by name.
+func gatherOSDiagnostics(ctx context.Context, executor remote.Executor, target osTarget) (map[string][]byte, error) {
+	if target.local {
+		// gpmt runs on the coordinator, so there is no need to ssh to it
+		executor = remote.LocalExecutor{}
+	}
+	output, err := remote.Output(ctx, executor, target.host, osDiagnosticsScript(target.dataDirs))
+	if err != nil {
+		return nil, err
+	}
+
+	sections := splitOSSections(output)
+	for _, diagnostic := range osDiagnostics {
+		if _, ok := sections[diagnostic.name]; !ok {
+			return nil, fmt.Errorf("no output for %s", diagnostic.name)
+		}
+	}
+	return sections, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+func TestSplitOSSections(t *testing.T) {
+	output := []byte("noise\n" + osSectionMarker + "kernel\nLinux cdw 5.14\n" + osSectionMarker + "memory\n" + osSectionMarker + "dmesg\nline 1\nline 2")
+	sections := splitOSSections(output)
+	expected := map[string][]byte{
+		"kernel": []byte("Linux cdw 5.14\n"),
+		"memory": {},
+		"dmesg":  []byte("line 1\nline 2"),
+	}
+	if !reflect.DeepEqual(sections, expected) {
+		t.Errorf("Expected %q, got %q", expected, sections)
+	}
+}
+
+// The script runs with whatever this machine has installed, and every
+// diagnostic still produces a section.
+func TestOSDiagnosticsScript(t *testing.T) {
+	sections, err := gatherOSDiagnostics(context.Background(), nil, osTarget{host: "cdw", local: true, dataDirs: []string{t.TempDir()}})
+	if err != nil {
+		t.Fatalf("gatherOSDiagnostics failed: %v", err)
+	}
+	for _, diagnostic := range osDiagnostics {
+		if _, ok := sections[diagnostic.name]; !ok {
+			t.Errorf("No section for %s", diagnostic.name)
+		}
+	}
+	if !strings.Contains(string(sections["mounts"]), " / ") {
+		t.Errorf("Expected the root mount in the mounts section, got %q", sections["mounts"])
+	}
+}
+
+func TestOSDiagnosticsMissingCommand(t *testing.T) {
+	script := strings.SplitN(osDiagnosticsScript(nil), "\n", 2)[0] + "\nrun gpmt-no-such-command --version\necho after\n"
+	output, err := remote.Output(context.Background(), remote.LocalExecutor{}, "cdw", script)
+	if err != nil {
+		t.Fatalf("Expected a missing command to be tolerated, got %v", err)
+	}
+	if string(output) != "gpmt-no-such-command: command not found\nafter\n" {
+		t.Errorf("Unexpected output %q", output)
+	}
+}
+
+func TestOSTargets(t *testing.T) {
+	segments := append([]db.Segment{
+		{DBID: 6, ContentID: -1, Role: "m", Hostname: "scdw", Address: "scdw", DataDir: "/data/standby/gpseg-1"},
+	}, testSegments...)
+	querier := dbtest.NewQuerier()
+	querier.Segments(segments)
+
+	targets, err := osTargets(context.Background(), querier, LogCollectorOptions{})
+	if err != nil {
+		t.Fatalf("osTargets failed: %v", err)
+	}
+	expected := []osTarget{
+		{host: "cdw", local: true, dataDirs: []string{"/data/coordinator/gpseg-1"}},
+		{host: "scdw", dataDirs: []string{"/data/standby/gpseg-1"}},
+		{host: "sdw1", dataDirs: []string{"/data/primary/gpseg0", "/data/mirror/gpseg1"}},
+		{host: "sdw2", dataDirs: []string{"/data/mirror/gpseg0", "/data/primary/gpseg1"}},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, targets)
+	}
+
+	targets, err = osTargets(context.Background(), querier, LogCollectorOptions{hostnames: []string{"sdw2"}})
+	if err != nil {
+		t.Fatalf("osTargets failed: %v", err)
+	}
+	if len(targets) != 2 || targets[0].host != "cdw" || targets[1].host != "sdw2" {
+		t.Errorf("Expected the coordinator and sdw2, got %+v", targets)
+	}
+}
+
+func TestLogCollectorOSOnly(t *testing.T) {
+	root := t.TempDir()
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "primary1")},
+	}
+	for _, segment := range segments {
+		if err := os.MkdirAll(segment.DataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	executor := &unreachableExecutor{Executor: remote.LocalExecutor{}, down: "sdw2"}
+	archiveName := filepath.Join(t.TempDir(), "os.tar.gz")
+	err := logCollector(context.Background(), querier, executor, archiveName, LogCollectorOptions{osOnly: true})
+	if err == nil || !strings.Contains(err.Error(), "sdw2") {
+		t.Errorf("Expected an error naming sdw2, got %v", err)
+	}
+
+	var expected []string
+	for _, host := range []string{"cdw", "sdw1"} {
+		for _, diagnostic := range osDiagnostics {
+			expected = append(expected, "os/"+host+"/"+diagnostic.name+".txt")
+		}
+	}
+	entries := archiveEntries(t, archiveName)
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected archive entries %v, got %v", expected, entries)
+	}
+	for _, name := range expected {
+		found := false
+		for _, entry := range entries {
+			found = found || entry == name
+		}
+		if !found {
+			t.Errorf("Expected %s in the archive, got %v", name, entries)
+		}
+	}
+	if usage := archiveFile(t, archiveName, "os/sdw1/disk_usage.txt"); !strings.Contains(usage, "primary0") {
+		t.Errorf("Expected the segment data directory in the disk usage, got %q", usage)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Position of debug_query_string in the Greenplum 6 and 7 CSV log format
+const debugQueryStringField = 24
+
+// What masked values are replaced with
+const (
+	redactedValue  = "********"
+	redactedString = "'***'"
+	redactedNumber = "***"
+	redactedIPv4   = "x.x.x.x"
+	redactedIPv6   = "x:x:x:x:x:x:x:x"
+)
+
+// Manifest name of the debug_query_string literal masking, which is not a
+// pattern rule
+const queryLiteralsRule = "query_literals"
+
+// redactionRule masks every match of a pattern, replacing it with
+// replacement, which may refer to the pattern's groups as in
+// regexp.Expand. A private rule's pattern is left out of the manifest, as
+// --redact-pattern values tend to spell out what they hide.
+type redactionRule struct {
+	name        string
+	description string
+	pattern     *regexp.Regexp
+	replacement string
+	private     bool
+}
+
+// The rules --redact always applies. Only quoted or assigned passwords are
+// masked, so messages such as "password authentication failed" are kept.
+// IPv6 addresses are only recognised written out in full, as the compressed
+// forms cannot be told apart from SQL casts such as 1::int.
+var defaultRedactionRules = []redactionRule{
+	{
+		name:        "password",
+		description: "quoted password clauses, e.g. PASSWORD 'secret'",
+		pattern:     regexp.MustCompile(`(?i)(\bpassword\s*(?:[=:]\s*)?)(?:'(?:[^']|'')*'|"[^"]*")`),
+		replacement: "${1}'" + redactedValue + "'",
+	},
+	{
+		name:        "password_setting",
+		description: "unquoted password settings, e.g. password=secret",
+		pattern:     regexp.MustCompile(`(?i)(\bpassword\s*[=:]\s*)[^\s'",;)]+`),
+		replacement: "${1}" + redactedValue,
+	},
+	{
+		name:        "ipv4_address",
+		description: "IPv4 addresses",
+		pattern:     regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`),
+		replacement: redactedIPv4,
+	},
+	{
+		name:        "ipv6_address",
+		description: "uncompressed IPv6 addresses",
+		pattern:     regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b`),
+		replacement: redactedIPv6,
+	},
+}
+
+// redactor rewrites archived copies of collected files with sensitive data
+// masked, counting what each rule matched for the manifest.
+type redactor struct {
+	rules          []redactionRule
+	matches        []int // per rule
+	literalMatches int
+}
+
+// newRedactor builds the redactor for --redact, adding a rule for each
+// --redact-pattern. It returns nil when redaction was not asked for.
+func newRedactor(opts LogCollectorOptions) (*redactor, error) {
+	if !opts.redact && len(opts.redactPatterns) == 0 {
+		return nil, nil
+	}
+
+	rules := append([]redactionRule{}, defaultRedactionRules...)
+	for idx, expression := range opts.redactPatterns {
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --redact-pattern %q: %w", expression, err)
+		}
+		rules = append(rules, redactionRule{
+			name:        "pattern",
+			description: fmt.Sprintf("--redact-pattern #%d", idx+1),
+			pattern:     pattern,
+			replacement: redactedValue,
+			private:     true,
+		})
+	}
+	return &redactor{rules: rules, matches: make([]int, len(rules))}, nil
+}
+
+// applied describes every rule and how often it matched, for the manifest.
+func (r *redactor) applied() []manifestRedaction {
+	redactions := []manifestRedaction{{
+		Rule:        queryLiteralsRule,
+		Description: "string and numeric literals in debug_query_string",
+		Matches:     r.literalMatches,
+	}}
+	for idx, rule := range r.rules {
+		redaction := manifestRedaction{Rule: rule.name, Description: rule.description, Matches: r.matches[idx]}
+		if !rule.private {
+			redaction.Pattern = rule.pattern.String()
+		}
+		redactions = append(redactions, redaction)
+	}
+	return redactions
+}
+
+// redact copies content to out with sensitive data masked. CSV files are
+// rewritten field by field so the literals of debug_query_string in
+// Greenplum logs can be masked as well; anything else line by line.
+func (r *redactor) redact(name string, content io.Reader, out io.Writer) error {
+	if strings.EqualFold(path.Ext(name), ".csv") {
+		return r.redactCSV(content, out)
+	}
+
+	reader := bufio.NewReader(content)
+	writer := bufio.NewWriter(out)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if _, writeErr := writer.WriteString(r.redactText(line)); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			return writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// redactCSV masks every field of a CSV file. Quotes are parsed lazily so that
+// the last record of a log still being written is kept even if it was cut
+// short.
+func (r *redactor) redactCSV(content io.Reader, out io.Writer) error {
+	reader := csv.NewReader(content)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	writer := csv.NewWriter(out)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only Greenplum logs have that many fields
+		if len(record) > debugQueryStringField {
+			record[debugQueryStringField] = r.redactQueryLiterals(record[debugQueryStringField])
+		}
+		for idx, field := range record {
+			record[idx] = r.redactText(field)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// redactText applies every rule to text.
+func (r *redactor) redactText(text string) string {
+	for ruleIdx, rule := range r.rules {
+		matches := rule.pattern.FindAllStringSubmatchIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var redacted []byte
+		last := 0
+		for _, match := range matches {
+			redacted = append(redacted, text[last:match[0]]...)
+			redacted = rule.pattern.ExpandString(redacted, rule.replacement, text, match)
+			last = match[1]
+		}
+		text = string(append(redacted, text[last:]...))
+		r.matches[ruleIdx] += len(matches)
+	}
+	return text
+}
+
+// redactQueryLiterals masks the string and numeric literals of a SQL
+// statement, keeping keywords, identifiers, quoted identifiers and $n
+// parameters.
+func (r *redactor) redactQueryLiterals(query string) string {
+	var redacted strings.Builder
+	for idx := 0; idx < len(query); {
+		ch := query[idx]
+		switch {
+		case ch == '\'':
+			idx = stringLiteralEnd(query, idx+1, false)
+			redacted.WriteString(redactedString)
+			r.literalMatches++
+		case (ch == 'e' || ch == 'E') && idx+1 < len(query) && query[idx+1] == '\'':
+			// E'...' allows backslash escapes
+			idx = stringLiteralEnd(query, idx+2, true)
+			redacted.WriteString(redactedString)
+			r.literalMatches++
+		case ch == '"':
+			end := idx + 1
+			for end < len(query) && query[end] != '"' {
+				end++
+			}
+			end = min(end+1, len(query))
+			redacted.WriteString(query[idx:end])
+			idx = end
+		case isIdentifierStart(ch) || ch == '$':
+			// Identifiers and parameters may contain digits
+			end := idx + 1
+			for end < len(query) && (isIdentifierStart(query[end]) || isDigit(query[end]) || query[end] == '$') {
+				end++
+			}
+			redacted.WriteString(query[idx:end])
+			idx = end
+		case isDigit(ch) || (ch == '.' && idx+1 < len(query) && isDigit(query[idx+1])):
+			idx = numericLiteralEnd(query, idx)
+			redacted.WriteString(redactedNumber)
+			r.literalMatches++
+		default:
+			redacted.WriteByte(ch)
+			idx++
+		}
+	}
+	return redacted.String()
+}
+
+// stringLiteralEnd finds the end of a string literal whose content starts at
+// idx. A doubled quote does not end it, nor, with escapes, a backslashed one.
+func stringLiteralEnd(query string, idx int, escapes bool) int {
+	for idx < len(query) {
+		switch {
+		case escapes && query[idx] == '\\':
+			idx += 2
+		case query[idx] == '\'' && idx+1 < len(query) && query[idx+1] == '\'':
+			idx += 2
+		case query[idx] == '\'':
+			return idx + 1
+		default:
+			idx++
+		}
+	}
+	return len(query)
+}
+
+// numericLiteralEnd finds the end of a number such as 42, 3.14 or 1.5e-3.
+func numericLiteralEnd(query string, idx int) int {
+	for idx < len(query) && (isDigit(query[idx]) || query[idx] == '.') {
+		idx++
+	}
+	if idx < len(query) && (query[idx] == 'e' || query[idx] == 'E') {
+		exponent := idx + 1
+		if exponent < len(query) && (query[exponent] == '+' || query[exponent] == '-') {
+			exponent++
+		}
+		if exponent < len(query) && isDigit(query[exponent]) {
+			idx = exponent
+			for idx < len(query) && isDigit(query[idx]) {
+				idx++
+			}
+		}
+	}
+	return idx
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isIdentifierStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch >= 0x80
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{
+			name:     "password clause",
+			text:     "statement: CREATE ROLE app LOGIN ENCRYPTED PASSWORD 'it''s secret';",
+			expected: "statement: CREATE ROLE app LOGIN ENCRYPTED PASSWORD '********';",
+		},
+		{
+			name:     "connection string",
+			text:     "host=mdw user=gpadmin password=hunter2 dbname=postgres",
+			expected: "host=mdw user=gpadmin password=******** dbname=postgres",
+		},
+		{
+			name:     "authentication failure is kept",
+			text:     `FATAL: password authentication failed for user "gpadmin"`,
+			expected: `FATAL: password authentication failed for user "gpadmin"`,
+		},
+		{
+			name:     "IPv4 address",
+			text:     "connection received: host=10.12.0.254 port=50122",
+			expected: "connection received: host=x.x.x.x port=50122",
+		},
+		{
+			name:     "IPv6 address",
+			text:     "host all all fe80:0:0:0:202:b3ff:fe1e:8329/128 md5",
+			expected: "host all all x:x:x:x:x:x:x:x/128 md5",
+		},
+		{
+			name:     "versions are not addresses",
+			text:     "PostgreSQL 12.12 (Greenplum Database 7.1.0 build commit:e7c2b1f)",
+			expected: "PostgreSQL 12.12 (Greenplum Database 7.1.0 build commit:e7c2b1f)",
+		},
+		{
+			name:     "custom pattern",
+			text:     "relation \"acme_customers\" does not exist",
+			expected: "relation \"********_customers\" does not exist",
+		},
+	}
+
+	redact, err := newRedactor(LogCollectorOptions{redactPatterns: []string{`acme`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if redacted := redact.redactText(tc.text); redacted != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestRedactQueryLiterals(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"select * from t1 where id = 42 and name = 'bob'", "select * from t1 where id = *** and name = '***'"},
+		{"insert into t values (1.5e-3, E'it\\'s', 'it''s', .5)", "insert into t values (***, '***', '***', ***)"},
+		{`select "col 1", col_2 from "T'1" where x = $1`, `select "col 1", col_2 from "T'1" where x = $1`},
+		{"select 'unterminated", "select '***'"},
+		{"update t set type='x'", "update t set type='***'"},
+	}
+
+	redact, err := newRedactor(LogCollectorOptions{redact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		if redacted := redact.redactQueryLiterals(tc.query); redacted != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, redacted)
+		}
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	if redact, err := newRedactor(LogCollectorOptions{}); redact != nil || err != nil {
+		t.Errorf("Expected no redactor without --redact, got %v, %v", redact, err)
+	}
+	if _, err := newRedactor(LogCollectorOptions{redactPatterns: []string{"("}}); err == nil {
+		t.Error("Expected an error for an invalid --redact-pattern")
+	}
+}
+
+// gpLogRecord builds a Greenplum CSV log record with the given message and
+// debug_query_string.
+func gpLogRecord(message string, query string) []string {
+	record := make([]string, 30)
+	record[0] = "2024-01-15 10:00:00.000000 UTC"
+	record[5] = "10.0.0.7"
+	record[18] = message
+	record[debugQueryStringField] = query
+	return record
+}
+
+func TestRedactCSV(t *testing.T) {
+	var log bytes.Buffer
+	writer := csv.NewWriter(&log)
+	writer.Write(gpLogRecord("statement: select * from accounts where owner = 'alice'", "select * from accounts\nwhere owner = 'alice'"))
+	writer.Write(gpLogRecord("statement: ALTER ROLE bob PASSWORD 'hunter2'", "ALTER ROLE bob PASSWORD 'hunter2'"))
+	writer.Flush()
+	// A record still being written when the log was collected
+	log.WriteString(`2024-01-15 10:00:01.000000 UTC,"gpadmin","postgres",p1,th1,"10.0.0.8","unfinished`)
+
+	redact, err := newRedactor(LogCollectorOptions{redact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := redact.redact("gpseg0/log/gpdb-2024-01-15_000000.csv", &log, &out); err != nil {
+		t.Fatalf("redact failed: %v", err)
+	}
+
+	reader := csv.NewReader(strings.NewReader(out.String()))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("Expected valid CSV, got %v\n%s", err, out.String())
+	}
+	if len(records) != 3 || records[2][6] != "unfinished" {
+		t.Fatalf("Expected the cut short record to be kept, got %q", records)
+	}
+	first, second := records[0], records[1]
+	if first[5] != redactedIPv4 || first[debugQueryStringField] != "select * from accounts\nwhere owner = '***'" {
+		t.Errorf("Unexpected first record %q", first)
+	}
+	if first[18] != "statement: select * from accounts where owner = 'alice'" {
+		t.Errorf("Expected the message to keep its literals, got %q", first[18])
+	}
+	if second[18] != "statement: ALTER ROLE bob PASSWORD '********'" {
+		t.Errorf("Expected the password to be masked, got %q", second[18])
+	}
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "10.0.0.8") {
+		t.Errorf("Sensitive data left in\n%s", out.String())
+	}
+}
+
+func TestLogCollectorRedact(t *testing.T) {
+	logDir := filepath.Join(t.TempDir(), "log")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MASTER_DATA_DIRECTORY", filepath.Dir(logDir))
+	if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte("listening on 192.168.1.20\nsecret project zeus\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", redact: true, redactPatterns: []string{"zeus"}}
+	if err := logCollector(context.Background(), nil, nil, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	if content := archiveFile(t, archiveName, "log/startup.log"); content != "listening on x.x.x.x\nsecret project ********\n" {
+		t.Errorf("Unexpected redacted content %q", content)
+	}
+	if err := verifyArchive(archiveName, &bytes.Buffer{}); err != nil {
+		t.Errorf("Expected the redacted archive to verify: %v", err)
+	}
+
+	matches := map[string]int{}
+	for _, redaction := range readManifest(t, archiveName).Redactions {
+		matches[redaction.Rule] += redaction.Matches
+		if redaction.Rule == "pattern" && redaction.Pattern != "" {
+			t.Errorf("Expected the custom pattern to be kept out of the manifest, got %q", redaction.Pattern)
+		}
+	}
+	if matches["ipv4_address"] != 1 || matches["pattern"] != 1 {
+		t.Errorf("Unexpected redaction counts %v", matches)
+	}
+	if _, ok := matches[queryLiteralsRule]; !ok {
+		t.Errorf("Expected %s in the manifest, got %v", queryLiteralsRule, matches)
+	}
+}
@@ -9,7 +9,11 @@ Licensed under the Apache License, Version 2.0 (the "License")
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/bluethumpasaurus/gpmt2/pkg/db"
@@ -40,6 +44,9 @@ var (
 	// DB connection details
 	connString db.ConnString //FIXME/TODO: Do we need a separate wrapper for DB?
 
+	// pg_service.conf service to take connection details from
+	connService string
+
 	// logging flags
 	logOpts = logOptions{LogFile: fmt.Sprintf("/gpmt_log_%s", time.Now().Format("2006-01-02"))}
 )
@@ -81,10 +88,56 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// openClient builds a pooled database client from the global connection
+// flags, filling anything not given on the command line from the libpq
+// environment, service file and ~/.pgpass. The caller owns the client and
+// must close it when done.
+func openClient(ctx context.Context) (*db.Client, error) {
+	resolved, err := db.ResolveConnString(connString, connService)
+	if err != nil {
+		return nil, err
+	}
+	connString = resolved
+
+	client, err := db.NewClientContext(ctx, connString)
+	if err != nil {
+		return nil, err
+	}
+	if connected := client.ConnString(); connected.Hostname != connString.Hostname || connected.Port != connString.Port {
+		log.Warnf("Connected to standby coordinator %s:%d", connected.Hostname, connected.Port)
+	}
+	return client, nil
+}
+
+// connectionHint turns a database connection error into a short, actionable
+// message for the user.
+func connectionHint(err error) string {
+	switch {
+	case errors.Is(err, db.ErrConnectionRefused):
+		return fmt.Sprintf("the database is not accepting connections on %s:%d; check that it is running and that --hostname/--port are correct", connString.Hostname, connString.Port)
+	case errors.Is(err, db.ErrAuthFailed):
+		return fmt.Sprintf("authentication failed for user %q; check --username/--password and pg_hba.conf", connString.Username)
+	case errors.Is(err, db.ErrDatabaseNotExist):
+		return fmt.Sprintf("database %q does not exist; pass an existing one with --database", connString.Database)
+	case errors.Is(err, db.ErrSSL):
+		return fmt.Sprintf("TLS connection failed (%v); check --sslmode and the certificates given with --sslrootcert/--sslcert/--sslkey", err)
+	case errors.Is(err, db.ErrTimeout):
+		return fmt.Sprintf("timed out connecting to %s:%d; check network access to the coordinator", connString.Hostname, connString.Port)
+	case errors.Is(err, db.ErrHostUnreachable):
+		return fmt.Sprintf("unable to reach %s; check that --hostname resolves and that the coordinator is reachable", connString.Hostname)
+	}
+	return err.Error()
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Ctrl-C or SIGTERM cancels the command context, which in turn cancels any
+// statement still running on the server.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -102,11 +155,24 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&logOpts.LogDir, "log-directory", "/tmp", "Directory where the logfile should be created") // TODO - logfile default may change
 
 	// Database connection parameters.
-	rootCmd.PersistentFlags().StringVar(&connString.Hostname, "hostname", "localhost", "Hostname where the database is hosted")
-	rootCmd.PersistentFlags().IntVar(&connString.Port, "port", 5432, "Port number of the master database")
-	rootCmd.PersistentFlags().StringVar(&connString.Database, "database", "template1", "Database name to connect")
-	rootCmd.PersistentFlags().StringVar(&connString.Username, "username", "gpadmin", "Username that is used to connect to database")
-	rootCmd.PersistentFlags().StringVar(&connString.Password, "password", "", "Password for the user")
+	// Anything left unset falls back to PGHOST, PGPORT, PGDATABASE, PGUSER and
+	// PGPASSWORD, then ~/.pgpass, before the built in defaults.
+	rootCmd.PersistentFlags().StringVar(&connString.Hostname, "hostname", "", "Hostname where the database is hosted (default $PGHOST or "+db.DefaultHostname+")")
+	rootCmd.PersistentFlags().IntVar(&connString.Port, "port", 0, fmt.Sprintf("Port number of the master database (default $PGPORT or %d)", db.DefaultPort))
+	rootCmd.PersistentFlags().StringVar(&connString.Database, "database", "", "Database name to connect (default $PGDATABASE or "+db.DefaultDatabase+")")
+	rootCmd.PersistentFlags().StringVar(&connString.Username, "username", "", "Username that is used to connect to database (default $PGUSER or "+db.DefaultUsername+")")
+	rootCmd.PersistentFlags().StringVar(&connString.Password, "password", "", "Password for the user (prefer $PGPASSWORD or ~/.pgpass)")
+	rootCmd.PersistentFlags().StringVar(&connString.StandbyHostname, "standby-host", "", "Standby coordinator to try when the coordinator is unreachable")
+	rootCmd.PersistentFlags().IntVar(&connString.StandbyPort, "standby-port", 0, "Port of the standby coordinator (defaults to --port)")
+	rootCmd.PersistentFlags().IntVar(&connString.Retries, "retries", 0, "Number of times to retry connecting when the database is unavailable")
+	rootCmd.PersistentFlags().DurationVar(&connString.RetryBackoff, "retry-backoff", time.Second, "Initial wait between connection retries, doubled after each attempt")
+	rootCmd.PersistentFlags().StringVar(&connString.SSLMode, "sslmode", "", "TLS mode: disable, require, verify-ca or verify-full (default $PGSSLMODE or disable)")
+	rootCmd.PersistentFlags().StringVar(&connString.SSLRootCert, "sslrootcert", "", "CA certificate used to verify the server (default $PGSSLROOTCERT)")
+	rootCmd.PersistentFlags().StringVar(&connString.SSLCert, "sslcert", "", "Client certificate for TLS authentication (default $PGSSLCERT)")
+	rootCmd.PersistentFlags().StringVar(&connString.SSLKey, "sslkey", "", "Private key for the client certificate (default $PGSSLKEY)")
+	rootCmd.PersistentFlags().StringVar(&connService, "service", "", "Connection service name from pg_service.conf (default $PGSERVICE)")
+	rootCmd.PersistentFlags().DurationVar(&connString.StatementTimeout, "statement-timeout", 0, "Server side statement_timeout for every gpmt session; 0 uses the server default")
+	rootCmd.PersistentFlags().DurationVar(&connString.QueryTimeout, "query-timeout", 0, "Cancel any query running longer than this (e.g. 30s, 5m); 0 disables the limit")
 
 	// Attach the sub command to the root command.
 	rootCmd.AddCommand(versionCmd)
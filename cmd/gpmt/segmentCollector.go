@@ -0,0 +1,503 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// Where segment hosts stage logs when --segdir is not given.
+const defaultSegmentDir = "/tmp"
+
+// How long the remote staging directory may take to clean up once the
+// collection itself has finished or been cancelled.
+const stageCleanupTimeout = 30 * time.Second
+
+// hostLogs is the set of segments whose logs are collected from one host,
+// and once planned, the bundles of files to collect from them.
+type hostLogs struct {
+	host     string
+	segments []db.Segment
+	bundles  []remoteBundle
+
+	// archiveDir is the top level archive directory for the host's files;
+	// empty means the hostname.
+	archiveDir string
+}
+
+// remoteBundle is a set of files copied from one directory on a host into one
+// directory of the host's part of the archive.
+type remoteBundle struct {
+	sourceDir  string
+	archiveDir string // relative to the host's archive directory
+	files      []remoteLogFile
+}
+
+// root is where the host's files go in the archive.
+func (target hostLogs) root() string {
+	if target.archiveDir != "" {
+		return target.archiveDir
+	}
+	return target.host
+}
+
+// size is the total size of the planned files.
+func (target hostLogs) size() uint64 {
+	var total uint64
+	for _, bundle := range target.bundles {
+		for _, file := range bundle.files {
+			total += uint64(file.size)
+		}
+	}
+	return total
+}
+
+// largest is the size of the largest planned file.
+func (target hostLogs) largest() uint64 {
+	var largest uint64
+	for _, bundle := range target.bundles {
+		for _, file := range bundle.files {
+			largest = max(largest, uint64(file.size))
+		}
+	}
+	return largest
+}
+
+// remoteLogFile is a log file found on a segment host.
+type remoteLogFile struct {
+	path    string // relative to the segment's log directory
+	size    int64
+	modTime time.Time
+}
+
+// splitListFlag flattens repeated list flags, each of which may also hold a
+// comma or space separated list, e.g. "--c 0,1 --c 2".
+func splitListFlag(values []string) []string {
+	var items []string
+	for _, value := range values {
+		items = append(items, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	return items
+}
+
+// readHostfile reads one hostname per line, ignoring blank lines and
+// # comments, as the gpssh -f hostfiles do.
+func readHostfile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hostfile: %w", err)
+	}
+	defer file.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		if host := strings.TrimSpace(line); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hostfile: %w", err)
+	}
+	return hosts, nil
+}
+
+// selectedHosts gathers the hosts named with --hostnames and --hostfile.
+func selectedHosts(opts LogCollectorOptions) ([]string, error) {
+	hosts := splitListFlag(opts.hostnames)
+	if opts.hostfile != "" {
+		fromFile, err := readHostfile(opts.hostfile)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, fromFile...)
+	}
+	return hosts, nil
+}
+
+// selectedContentIDs parses the content ids given with --c.
+func selectedContentIDs(opts LogCollectorOptions) ([]int, error) {
+	var contentIDs []int
+	for _, value := range splitListFlag(opts.contentIds) {
+		contentID, err := strconv.Atoi(value)
+		if err != nil || contentID < 0 {
+			return nil, fmt.Errorf("invalid content id %q", value)
+		}
+		contentIDs = append(contentIDs, contentID)
+	}
+	return contentIDs, nil
+}
+
+// selectSegments picks the primaries and mirrors with any of contentIDs or
+// living on any of hosts. Every content id and host must match at least one
+// segment, so that a typo is not silently ignored.
+func selectSegments(segments []db.Segment, contentIDs []int, hosts []string) ([]db.Segment, error) {
+	wantContent := make(map[int]bool, len(contentIDs))
+	for _, contentID := range contentIDs {
+		wantContent[contentID] = false
+	}
+	wantHost := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		wantHost[host] = false
+	}
+
+	var selected []db.Segment
+	for _, segment := range segments {
+		if segment.ContentID == db.CoordinatorContentID {
+			continue
+		}
+		_, byContent := wantContent[segment.ContentID]
+		_, byHostname := wantHost[segment.Hostname]
+		_, byAddress := wantHost[segment.Address]
+		if !byContent && !byHostname && !byAddress {
+			continue
+		}
+		if byContent {
+			wantContent[segment.ContentID] = true
+		}
+		if byHostname {
+			wantHost[segment.Hostname] = true
+		}
+		if byAddress {
+			wantHost[segment.Address] = true
+		}
+		selected = append(selected, segment)
+	}
+
+	for _, contentID := range contentIDs {
+		if !wantContent[contentID] {
+			return nil, fmt.Errorf("no segment has content id %d", contentID)
+		}
+	}
+	for _, host := range hosts {
+		if !wantHost[host] {
+			return nil, fmt.Errorf("no segment runs on host %q", host)
+		}
+	}
+	return selected, nil
+}
+
+// groupByHost splits segments by the host they run on, sorted by hostname.
+func groupByHost(segments []db.Segment) []hostLogs {
+	byHost := make(map[string][]db.Segment)
+	for _, segment := range segments {
+		byHost[segment.Hostname] = append(byHost[segment.Hostname], segment)
+	}
+
+	hosts := make([]hostLogs, 0, len(byHost))
+	for host, segments := range byHost {
+		hosts = append(hosts, hostLogs{host: host, segments: segments})
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].host < hosts[j].host
+	})
+	return hosts
+}
+
+// segmentHosts resolves the segment selection flags, plus any content ids in
+// extraContentIDs, against gp_segment_configuration. It returns nil when no
+// segments were asked for.
+func segmentHosts(ctx context.Context, querier db.Querier, opts LogCollectorOptions, extraContentIDs []int) ([]hostLogs, error) {
+	contentIDs, err := selectedContentIDs(opts)
+	if err != nil {
+		return nil, err
+	}
+	contentIDs = append(contentIDs, extraContentIDs...)
+	hosts, err := selectedHosts(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentIDs) == 0 && len(hosts) == 0 {
+		return nil, nil
+	}
+	if querier == nil {
+		return nil, fmt.Errorf("collecting segment logs needs a database connection to find the segments")
+	}
+
+	segments, err := db.ListSegments(ctx, querier)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectSegments(segments, contentIDs, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return groupByHost(selected), nil
+}
+
+// segmentArchiveDir is where a segment's logs go under its host's directory,
+// e.g. gpseg0-p. The role keeps a primary and its mirror apart when they
+// share a host.
+func segmentArchiveDir(segment db.Segment) string {
+	return fmt.Sprintf("gpseg%d-%s", segment.ContentID, segment.Role)
+}
+
+// planHostLogs lists the log files of every segment on a host that may hold
+// entries inside window, along with the standby's configuration files. A
+// segment whose files cannot be listed is reported, recorded in the manifest
+// and skipped.
+func planHostLogs(ctx context.Context, executor remote.Executor, target *hostLogs, logDirName string,
+	window timeWindow, manifest *archiveManifest) {
+	for _, segment := range target.segments {
+		if segment.ContentID == db.CoordinatorContentID {
+			if err := planStandbyLogs(ctx, executor, target, segment, logDirName, window, manifest); err != nil {
+				log.Warnf("Skipping the standby coordinator: %v", err)
+				manifest.addError(target.host, segment.DataDir, err)
+			}
+			continue
+		}
+
+		bundle, err := planLogBundle(ctx, executor, target.host, segment, logDirName, window)
+		if err != nil {
+			log.Warnf("Skipping %s: %v", segment, err)
+			manifest.addError(target.host, path.Join(segment.DataDir, logDirName), err)
+			continue
+		}
+		bundle.archiveDir = segmentArchiveDir(segment)
+		target.bundles = append(target.bundles, bundle)
+	}
+}
+
+// planLogBundle lists the files in a segment's log directory that may hold
+// entries inside window.
+func planLogBundle(ctx context.Context, executor remote.Executor, host string, segment db.Segment,
+	logDirName string, window timeWindow) (remoteBundle, error) {
+	bundle := remoteBundle{sourceDir: path.Join(segment.DataDir, logDirName)}
+	files, err := listRemoteLogs(ctx, executor, host, bundle.sourceDir)
+	if err != nil {
+		return remoteBundle{}, err
+	}
+
+	for _, file := range files {
+		if window.includesFile(path.Base(file.path), file.modTime) {
+			bundle.files = append(bundle.files, file)
+		}
+	}
+	log.Debugf("Collecting %d of %d log files from %s", len(bundle.files), len(files), segment)
+	return bundle, nil
+}
+
+// fetchHostLogs stages every planned bundle of a host into stageDir on that
+// host, then streams the staged tree back into a local tar file created in
+// spoolDir. The caller merges and removes the spool file; the remote staging
+// directory is always removed.
+func fetchHostLogs(ctx context.Context, executor remote.Executor, target hostLogs,
+	stageDir string, spoolDir string) (string, error) {
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stageCleanupTimeout)
+		defer cancel()
+		if err := executor.Run(cleanupCtx, target.host, "rm -rf "+remote.Quote(stageDir), nil, io.Discard); err != nil {
+			log.Warnf("Failed to remove the staging directory %s on %s: %v", stageDir, target.host, err)
+		}
+	}()
+
+	if err := executor.Run(ctx, target.host, "mkdir -p "+remote.Quote(stageDir), nil, io.Discard); err != nil {
+		return "", fmt.Errorf("failed to create the staging directory: %w", err)
+	}
+
+	for _, bundle := range target.bundles {
+		if len(bundle.files) == 0 {
+			continue
+		}
+		var selected bytes.Buffer
+		for _, file := range bundle.files {
+			selected.WriteString(file.path)
+			selected.WriteByte(0)
+		}
+
+		bundleStage := path.Join(stageDir, bundle.archiveDir)
+		stage := fmt.Sprintf("mkdir -p %s && cd %s && xargs -0 cp -p --parents -t %s",
+			remote.Quote(bundleStage), remote.Quote(bundle.sourceDir), remote.Quote(bundleStage))
+		if err := executor.Run(ctx, target.host, stage, &selected, io.Discard); err != nil {
+			return "", fmt.Errorf("failed to stage %s: %w", bundle.sourceDir, err)
+		}
+	}
+
+	spool, err := os.CreateTemp(spoolDir, ".gpmt_"+target.host+"_*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a local spool file: %w", err)
+	}
+	defer spool.Close()
+
+	if err := executor.Run(ctx, target.host, "tar -C "+remote.Quote(stageDir)+" -cf - .", nil, spool); err != nil {
+		os.Remove(spool.Name())
+		return "", fmt.Errorf("failed to copy the staged logs: %w", err)
+	}
+	if err := spool.Close(); err != nil {
+		os.Remove(spool.Name())
+		return "", fmt.Errorf("failed to write the local spool file: %w", err)
+	}
+	return spool.Name(), nil
+}
+
+// listRemoteLogs lists every file under a log directory on host.
+func listRemoteLogs(ctx context.Context, executor remote.Executor, host string, logDir string) ([]remoteLogFile, error) {
+	return listRemoteFiles(ctx, executor, host, logDir, "-type f")
+}
+
+// listRemoteFiles lists the files under dir on host matching the find
+// expression, with paths relative to dir.
+func listRemoteFiles(ctx context.Context, executor remote.Executor, host string, dir string, expression string) ([]remoteLogFile, error) {
+	output, err := remote.Output(ctx, executor, host, "find "+remote.Quote(dir)+" "+expression+` -printf '%T@ %s %P\0'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	var files []remoteLogFile
+	for _, record := range strings.Split(string(output), "\x00") {
+		if record == "" {
+			continue
+		}
+		fields := strings.SplitN(record, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected find output %q", record)
+		}
+		modTime, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected modification time %q", fields[0])
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file size %q", fields[1])
+		}
+		seconds := int64(modTime)
+		files = append(files, remoteLogFile{
+			path:    fields[2],
+			size:    size,
+			modTime: time.Unix(seconds, int64((modTime-float64(seconds))*1e9)),
+		})
+	}
+	return files, nil
+}
+
+// sourcePath maps a file's path relative to the host's archive directory back
+// to where it was found on the host.
+func (target hostLogs) sourcePath(name string) string {
+	var source *remoteBundle
+	for idx, bundle := range target.bundles {
+		if bundle.archiveDir != "" && name != bundle.archiveDir && !strings.HasPrefix(name, bundle.archiveDir+"/") {
+			continue
+		}
+		if source == nil || len(bundle.archiveDir) > len(source.archiveDir) {
+			source = &target.bundles[idx]
+		}
+	}
+	if source == nil {
+		return ""
+	}
+	return path.Join(source.sourceDir, strings.TrimPrefix(strings.TrimPrefix(name, source.archiveDir), "/"))
+}
+
+// mergeSpool copies every file in a spooled host tar into the archive under
+// the host's archive directory.
+func mergeSpool(aw *archiveWriter, spoolName string, target hostLogs) error {
+	root := target.root()
+	spool, err := os.Open(spoolName)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	tr := tar.NewReader(spool)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the files copied for %s: %w", root, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		header.Name = path.Join(root, name)
+		if err := aw.writeEntry(header, target.host, target.sourcePath(name), tr); err != nil {
+			return err
+		}
+		fmt.Printf("  - Archived %s\n", header.Name)
+	}
+}
+
+// collectSegmentLogs fetches the planned logs of several hosts at once, as
+// many as --parallel allows, and archives each host's logs as soon as they
+// arrive. A host that fails or runs past --host-timeout is reported and
+// skipped so the rest of the cluster is still collected, and returned in
+// failed. The error is only set when the archive itself could not be written
+// or ctx was cancelled.
+func collectSegmentLogs(ctx context.Context, executor remote.Executor, aw *archiveWriter, hosts []hostLogs,
+	opts LogCollectorOptions, spoolDir string) (failed []string, err error) {
+	runID := fmt.Sprintf("%s_%d", time.Now().Format("20060102_150405"), os.Getpid())
+	segmentDir := opts.segmentDir
+	if segmentDir == "" {
+		segmentDir = defaultSegmentDir
+	}
+
+	pool := newHostPool(opts)
+	fmt.Printf("Collecting logs from %d hosts, %d at a time\n", len(hosts), pool.parallel)
+
+	spools := make([]string, len(hosts))
+	started := make([]time.Time, len(hosts))
+	finished := 0
+	err = pool.run(ctx, len(hosts), func(ctx context.Context, idx int) error {
+		target := hosts[idx]
+		started[idx] = time.Now()
+		// A host may be collected twice, e.g. for a segment and the standby
+		stageDir := path.Join(segmentDir, fmt.Sprintf("gpmt_%s_%s", runID, target.root()))
+		var err error
+		spools[idx], err = fetchHostLogs(ctx, executor, target, stageDir, spoolDir)
+		return err
+	}, func(idx int, fetchErr error) error {
+		target := hosts[idx]
+		finished++
+		progress := fmt.Sprintf("[%d/%d] %s", finished, len(hosts), target.host)
+		if fetchErr != nil {
+			fmt.Printf("%s: failed\n", progress)
+			log.Warnf("Failed to collect logs from %s: %v", target.host, fetchErr)
+			aw.manifest.addError(target.host, "", fetchErr)
+			failed = append(failed, target.host)
+			return nil
+		}
+
+		err := mergeSpool(aw, spools[idx], target)
+		os.Remove(spools[idx])
+		spools[idx] = ""
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: collected %s in %s\n", progress, formatBytes(target.size()),
+			time.Since(started[idx]).Round(100*time.Millisecond))
+		return nil
+	})
+
+	// Hosts that finished after the archive failed leave their spools behind
+	for _, spoolName := range spools {
+		if spoolName != "" {
+			os.Remove(spoolName)
+		}
+	}
+	if err != nil {
+		return failed, err
+	}
+	return failed, ctx.Err()
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+var testSegments = []db.Segment{
+	{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: "/data/coordinator/gpseg-1"},
+	{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1-1", DataDir: "/data/primary/gpseg0"},
+	{DBID: 4, ContentID: 0, Role: "m", Hostname: "sdw2", Address: "sdw2-1", DataDir: "/data/mirror/gpseg0"},
+	{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2-1", DataDir: "/data/primary/gpseg1"},
+	{DBID: 5, ContentID: 1, Role: "m", Hostname: "sdw1", Address: "sdw1-1", DataDir: "/data/mirror/gpseg1"},
+}
+
+func TestSplitListFlag(t *testing.T) {
+	items := splitListFlag([]string{"0,1", "2 3", " 4 ,, 5 "})
+	expected := []string{"0", "1", "2", "3", "4", "5"}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Expected %v, got %v", expected, items)
+	}
+}
+
+func TestReadHostfile(t *testing.T) {
+	hostfile := filepath.Join(t.TempDir(), "hostfile")
+	if err := os.WriteFile(hostfile, []byte("sdw1\n\n# spare\nsdw2  # rack 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := readHostfile(hostfile)
+	if err != nil {
+		t.Fatalf("readHostfile failed: %v", err)
+	}
+	if expected := []string{"sdw1", "sdw2"}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+}
+
+func TestSelectSegments(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentIDs  []int
+		hosts       []string
+		expected    []int
+		expectError bool
+	}{
+		{name: "content id selects primary and mirror", contentIDs: []int{0}, expected: []int{2, 4}},
+		{name: "hostname", hosts: []string{"sdw2"}, expected: []int{4, 3}},
+		{name: "address", hosts: []string{"sdw1-1"}, expected: []int{2, 5}},
+		{name: "union", contentIDs: []int{1}, hosts: []string{"sdw1"}, expected: []int{2, 3, 5}},
+		{name: "coordinator host has no segments", hosts: []string{"cdw"}, expectError: true},
+		{name: "unknown content id", contentIDs: []int{7}, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := selectSegments(testSegments, tc.contentIDs, tc.hosts)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", selected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var dbids []int
+			for _, segment := range selected {
+				dbids = append(dbids, segment.DBID)
+			}
+			if !reflect.DeepEqual(dbids, tc.expected) {
+				t.Errorf("Expected dbids %v, got %v", tc.expected, dbids)
+			}
+		})
+	}
+}
+
+func TestSegmentHostsNeedsDatabase(t *testing.T) {
+	if _, err := segmentHosts(context.Background(), nil, LogCollectorOptions{contentIds: []string{"0"}}, nil); err == nil {
+		t.Error("Expected an error selecting segments without a database")
+	}
+	if hosts, err := segmentHosts(context.Background(), nil, LogCollectorOptions{}, nil); err != nil || hosts != nil {
+		t.Errorf("Expected no hosts and no error without a selection, got %v, %v", hosts, err)
+	}
+}
+
+func TestListRemoteLogs(t *testing.T) {
+	logDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(logDir, "archive"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"gpdb-2024-01-15_000000.csv", "archive/old file.csv"} {
+		if err := os.WriteFile(filepath.Join(logDir, name), []byte("12345"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := localTime("2024-01-15 10:00:00")
+	if err := os.Chtimes(filepath.Join(logDir, "archive/old file.csv"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := listRemoteLogs(context.Background(), remote.LocalExecutor{}, "sdw1", logDir)
+	if err != nil {
+		t.Fatalf("listRemoteLogs failed: %v", err)
+	}
+	found := map[string]remoteLogFile{}
+	for _, file := range files {
+		found[file.path] = file
+	}
+	if len(found) != 2 || found["gpdb-2024-01-15_000000.csv"].size != 5 {
+		t.Fatalf("Unexpected listing: %+v", files)
+	}
+	if old := found["archive/old file.csv"]; !old.modTime.Equal(modTime) {
+		t.Errorf("Expected modification time %s, got %s", modTime, old.modTime)
+	}
+
+	if _, err := listRemoteLogs(context.Background(), remote.LocalExecutor{}, "sdw1", filepath.Join(logDir, "missing")); err == nil {
+		t.Error("Expected an error listing a missing directory")
+	}
+}
+
+// Collect from two "hosts" whose data directories live in temporary
+// directories, using the local executor in place of ssh.
+func TestLogCollectorSegments(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	writeLog := func(dataDir string, name string, modTime string) {
+		path := filepath.Join(root, dataDir, "log", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(dataDir+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, localTime(modTime), localTime(modTime)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLog("coordinator", "gpdb-2024-01-15_000000.csv", "2024-01-15 12:00:00")
+	writeLog("primary0", "gpdb-2024-01-15_000000.csv", "2024-01-15 12:00:00")
+	writeLog("primary0", "gpdb-2024-01-10_000000.csv", "2024-01-10 12:00:00")
+	writeLog("mirror0", "gpdb-2024-01-15_000000.csv", "2024-01-15 12:00:00")
+	writeLog("primary1", "gpdb-2024-01-15_000000.csv", "2024-01-15 12:00:00")
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 4, ContentID: 0, Role: "m", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "mirror0")},
+		{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "primary1")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	segDir := t.TempDir()
+	outDir := t.TempDir()
+	archiveName := filepath.Join(outDir, "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2024-01-15", endDate: "2024-01-15", contentIds: []string{"0"}, segmentDir: segDir}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	expected := []string{
+		"gpdb-2024-01-15_000000.csv",
+		"sdw1/gpseg0-p/gpdb-2024-01-15_000000.csv",
+		"sdw2/gpseg0-m/gpdb-2024-01-15_000000.csv",
+	}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+
+	// Neither the remote staging directories nor the local spools are left
+	for _, dir := range []string{segDir, outDir} {
+		leftovers, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range leftovers {
+			if !strings.HasSuffix(entry.Name(), ".tar.gz") {
+				t.Errorf("Unexpected file left behind in %s: %s", dir, entry.Name())
+			}
+		}
+	}
+}
+
+// A primary and its mirror on the same host write logs of the same names,
+// which must not overwrite each other in the archive.
+func TestLogCollectorPrimaryAndMirrorOnOneHost(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	for _, dir := range []string{"coordinator", "primary0", "mirror0"} {
+		logDir := filepath.Join(root, dir, "log")
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte(dir+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 3, ContentID: 0, Role: "m", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "mirror0")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", contentIds: []string{"0"}, segmentDir: t.TempDir()}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	expected := []string{"sdw1/gpseg0-m/startup.log", "sdw1/gpseg0-p/startup.log", "startup.log"}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+	for name, content := range map[string]string{"sdw1/gpseg0-p/startup.log": "primary0\n", "sdw1/gpseg0-m/startup.log": "mirror0\n"} {
+		if got := archiveFile(t, archiveName, name); got != content {
+			t.Errorf("Expected %s to hold %q, got %q", name, content, got)
+		}
+	}
+}
+
+// A host that cannot be reached is reported without losing the others.
+func TestCollectSegmentLogsHostFailure(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	logDir := filepath.Join(root, "primary1", "log")
+	for _, dir := range []string{logDir, filepath.Join(root, "coordinator", "log")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte("ok\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "primary1")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	executor := &unreachableExecutor{Executor: remote.LocalExecutor{}, down: "sdw1"}
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", hostnames: []string{"sdw1,sdw2"}, segmentDir: t.TempDir()}
+	err := logCollector(context.Background(), querier, executor, archiveName, opts)
+	if err == nil || !strings.Contains(err.Error(), "sdw1") {
+		t.Errorf("Expected an error naming sdw1, got %v", err)
+	}
+
+	expected := []string{"sdw2/gpseg1-p/startup.log"}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+}
+
+// unreachableExecutor fails every command sent to one host.
+type unreachableExecutor struct {
+	remote.Executor
+	down string
+}
+
+func (executor *unreachableExecutor) Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	if host == executor.down {
+		return &remote.CommandError{Host: host, Command: command, Stderr: "ssh: connect to host " + host + ": No route to host", Err: errors.New("exit status 255")}
+	}
+	return executor.Executor.Run(ctx, host, command, stdin, stdout)
+}
+
+// hangingExecutor never answers for one host, until it is cancelled.
+type hangingExecutor struct {
+	remote.Executor
+	hung string
+}
+
+func (executor *hangingExecutor) Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	if host == executor.hung && !strings.HasPrefix(command, "rm -rf ") {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return executor.Executor.Run(ctx, host, command, stdin, stdout)
+}
+
+// A host that stops responding is timed out and skipped while the others are
+// collected alongside it.
+func TestCollectSegmentLogsHostTimeout(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	for _, dir := range []string{"coordinator", "primary0", "primary1", "primary2"} {
+		logDir := filepath.Join(root, dir, "log")
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(logDir, "startup.log"), []byte(dir+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+		{DBID: 3, ContentID: 1, Role: "p", Hostname: "sdw2", Address: "sdw2", DataDir: filepath.Join(root, "primary1")},
+		{DBID: 4, ContentID: 2, Role: "p", Hostname: "sdw3", Address: "sdw3", DataDir: filepath.Join(root, "primary2")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	executor := &hangingExecutor{Executor: remote.LocalExecutor{}, hung: "sdw2"}
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", contentIds: []string{"0,1,2"},
+		segmentDir: t.TempDir(), parallel: 2, hostTimeout: 200 * time.Millisecond}
+	err := logCollector(context.Background(), querier, executor, archiveName, opts)
+	if err == nil || !strings.Contains(err.Error(), "sdw2") {
+		t.Errorf("Expected an error naming sdw2, got %v", err)
+	}
+
+	expected := []string{"sdw1/gpseg0-p/startup.log", "sdw3/gpseg2-p/startup.log", "startup.log"}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+
+	var timedOut bool
+	for _, collectionErr := range readManifest(t, archiveName).Errors {
+		timedOut = timedOut || (collectionErr.Host == "sdw2" && strings.Contains(collectionErr.Error, "timed out"))
+	}
+	if !timedOut {
+		t.Errorf("Expected the timeout of sdw2 in the manifest, got %+v", readManifest(t, archiveName).Errors)
+	}
+}
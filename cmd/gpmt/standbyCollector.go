@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archive directory holding everything collected from the standby coordinator
+const standbyArchiveDir = "standby"
+
+// Configuration files collected from the standby's data directory
+var standbyConfigFiles = []string{"pg_hba.conf", "postgresql.conf"}
+
+// findStandby looks up the standby coordinator, the mirror of content -1. It
+// returns nil when the cluster has no standby.
+func findStandby(ctx context.Context, querier db.Querier) (*db.Segment, error) {
+	if querier == nil {
+		return nil, fmt.Errorf("--collect-standby needs a database connection to find the standby coordinator")
+	}
+	segments, err := db.ListSegments(ctx, querier)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if segment.ContentID == db.CoordinatorContentID && segment.Role == db.RoleMirror {
+			return &segment, nil
+		}
+	}
+	return nil, nil
+}
+
+// standbyHost is the collection target for the standby coordinator, kept in
+// its own archive directory whatever host it runs on.
+func standbyHost(standby db.Segment) hostLogs {
+	return hostLogs{host: standby.Hostname, segments: []db.Segment{standby}, archiveDir: standbyArchiveDir}
+}
+
+// planStandbyLogs plans the standby's log directory, laid out as in its data
+// directory, along with its configuration files. A configuration file that
+// is missing or cannot be listed is reported and recorded in the manifest
+// without giving up the logs.
+func planStandbyLogs(ctx context.Context, executor remote.Executor, target *hostLogs, standby db.Segment,
+	logDirName string, window timeWindow, manifest *archiveManifest) error {
+	logs, err := planLogBundle(ctx, executor, target.host, standby, logDirName, window)
+	if err != nil {
+		return err
+	}
+	logs.archiveDir = logDirName
+	target.bundles = append(target.bundles, logs)
+
+	names := make([]string, len(standbyConfigFiles))
+	for idx, name := range standbyConfigFiles {
+		names[idx] = "-name " + remote.Quote(name)
+	}
+	expression := fmt.Sprintf(`-maxdepth 1 -type f \( %s \)`, strings.Join(names, " -o "))
+	configs, err := listRemoteFiles(ctx, executor, target.host, standby.DataDir, expression)
+	if err != nil {
+		log.Warnf("Skipping the standby's configuration files: %v", err)
+		manifest.addError(target.host, path.Clean(standby.DataDir), err)
+		return nil
+	}
+
+	found := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		found[config.path] = true
+	}
+	for _, name := range standbyConfigFiles {
+		if !found[name] {
+			configPath := path.Join(standby.DataDir, name)
+			log.Warnf("Skipping %s:%s: not found", target.host, configPath)
+			manifest.addError(target.host, configPath, errors.New("configuration file not found"))
+		}
+	}
+	if len(configs) > 0 {
+		target.bundles = append(target.bundles, remoteBundle{sourceDir: standby.DataDir, files: configs})
+	}
+	return nil
+}
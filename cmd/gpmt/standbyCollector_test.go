@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/bluethumpasaurus/gpmt2/pkg/remote"
+)
+
+func TestFindStandby(t *testing.T) {
+	querier := dbtest.NewQuerier()
+	querier.Segments(testSegments)
+	standby, err := findStandby(context.Background(), querier)
+	if err != nil || standby != nil {
+		t.Errorf("Expected no standby, got %v, %v", standby, err)
+	}
+
+	withStandby := append([]db.Segment{
+		{DBID: 6, ContentID: -1, Role: "m", Hostname: "scdw", Address: "scdw", DataDir: "/data/standby/gpseg-1"},
+	}, testSegments...)
+	querier.Segments(withStandby)
+	standby, err = findStandby(context.Background(), querier)
+	if err != nil || standby == nil || standby.DBID != 6 {
+		t.Errorf("Expected the standby with dbid 6, got %v, %v", standby, err)
+	}
+
+	if _, err := findStandby(context.Background(), nil); err == nil {
+		t.Error("Expected an error without a database connection")
+	}
+}
+
+func TestLogCollectorStandby(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	writeFile := func(name string, content string) {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("coordinator/pg_log/startup.log", "coordinator\n")
+	writeFile("standby/pg_log/startup.log", "standby\n")
+	writeFile("standby/pg_log/gpdb-2001-01-01_000000.csv", "too old\n")
+	writeFile("standby/pg_hba.conf", "host all all 0.0.0.0/0 md5\n")
+	writeFile("standby/postgresql.conf", "port = 5432\n")
+	writeFile("standby/postgresql.auto.conf", "\n")
+	old := localTime("2001-01-01 12:00:00")
+	if err := os.Chtimes(filepath.Join(root, "standby/pg_log/gpdb-2001-01-01_000000.csv"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 4, ContentID: -1, Role: "m", Hostname: "scdw", Address: "scdw", DataDir: filepath.Join(root, "standby")},
+		{DBID: 2, ContentID: 0, Role: "p", Hostname: "sdw1", Address: "sdw1", DataDir: filepath.Join(root, "primary0")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum6Version, segments)
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2020-01-01", endDate: "2100-01-01", standby: true, segmentDir: t.TempDir()}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	expected := []string{
+		"standby/pg_hba.conf",
+		"standby/pg_log/startup.log",
+		"standby/postgresql.conf",
+		"startup.log",
+	}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+	if content := archiveFile(t, archiveName, "standby/pg_log/startup.log"); content != "standby\n" {
+		t.Errorf("Expected the standby's own log, got %q", content)
+	}
+}
+
+// A configuration file missing from the standby is recorded in the manifest
+// and does not cost the standby's logs.
+func TestLogCollectorStandbyMissingConfig(t *testing.T) {
+	t.Setenv("MASTER_DATA_DIRECTORY", "")
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"coordinator/log/startup.log": "coordinator\n",
+		"standby/log/startup.log":     "standby\n",
+		"standby/pg_hba.conf":         "host all all 0.0.0.0/0 md5\n",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments := []db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", Hostname: "cdw", Address: "cdw", DataDir: filepath.Join(root, "coordinator")},
+		{DBID: 4, ContentID: -1, Role: "m", Hostname: "scdw", Address: "scdw", DataDir: filepath.Join(root, "standby")},
+	}
+	querier := clusterQuerier(t, dbtest.Greenplum7Version, segments)
+
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	opts := LogCollectorOptions{startDate: "2000-01-01", endDate: "2100-01-01", standby: true, segmentDir: t.TempDir()}
+	if err := logCollector(context.Background(), querier, remote.LocalExecutor{}, archiveName, opts); err != nil {
+		t.Fatalf("logCollector failed: %v", err)
+	}
+
+	expected := []string{"standby/log/startup.log", "standby/pg_hba.conf", "startup.log"}
+	if entries := logEntries(t, archiveName); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected archive entries %v, got %v", expected, entries)
+	}
+
+	missing := filepath.Join(root, "standby", "postgresql.conf")
+	var recorded bool
+	for _, collectionErr := range readManifest(t, archiveName).Errors {
+		recorded = recorded || (collectionErr.Host == "scdw" && collectionErr.Path == missing)
+	}
+	if !recorded {
+		t.Errorf("Expected %s to be recorded as missing, got %+v", missing, readManifest(t, archiveName).Errors)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// Sub Command: Verify Archive
+// This command checks a gp_log_collector archive against its manifest
+var verifyArchiveCmd = &cobra.Command{
+	Use:   "verify-archive ARCHIVE",
+	Short: "check an archive against its manifest",
+	Long: "\nverify-archive checks that every file listed in the MANIFEST.json of a \n" +
+		"gp_log_collector archive is present with the recorded size and SHA-256, \n" +
+		"and that the archive holds nothing else",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := verifyArchive(args[0], cmd.OutOrStdout()); err != nil {
+			fmt.Printf("Error verifying archive: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// archivedFile is the size and checksum of a file as found in an archive.
+type archivedFile struct {
+	size   int64
+	sha256 string
+}
+
+// readArchive checksums every regular file of a tar.gz archive and decodes
+// its manifest.
+func readArchive(archiveName string) (map[string]archivedFile, *archiveManifest, error) {
+	file, err := os.Open(archiveName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", archiveName, err)
+	}
+	tr := tar.NewReader(gr)
+
+	files := make(map[string]archivedFile)
+	var manifest *archiveManifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", archiveName, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if header.Name == manifestName {
+			manifest = &archiveManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("failed to read %s: %w", manifestName, err)
+			}
+			continue
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		files[header.Name] = archivedFile{size: size, sha256: hex.EncodeToString(hash.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%s has no %s", archiveName, manifestName)
+	}
+	return files, manifest, nil
+}
+
+// verifyArchive checks every file of an archive against its manifest and
+// reports any missing, changed or unlisted file to out. The collection errors
+// recorded in the manifest are listed too, but do not fail the check.
+func verifyArchive(archiveName string, out io.Writer) error {
+	files, manifest, err := readArchive(archiveName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Archive created %s by gpmt %s\n", manifest.Created.Format("2006-01-02 15:04:05"), manifest.GpmtVersion)
+	if manifest.ClusterVersion != "" {
+		fmt.Fprintf(out, "Cluster: %s\n", manifest.ClusterVersion)
+	}
+	if len(manifest.Redactions) > 0 {
+		fmt.Fprintf(out, "Redacted with:\n")
+		for _, redaction := range manifest.Redactions {
+			fmt.Fprintf(out, "  - %s (%s): %d masked\n", redaction.Rule, redaction.Description, redaction.Matches)
+		}
+	}
+
+	var problems []string
+	listed := make(map[string]bool, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		listed[entry.Name] = true
+		found, ok := files[entry.Name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: missing", entry.Name))
+		case found.size != entry.Size:
+			problems = append(problems, fmt.Sprintf("%s: size is %d, expected %d", entry.Name, found.size, entry.Size))
+		case found.sha256 != entry.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", entry.Name))
+		}
+	}
+	var unlisted []string
+	for name := range files {
+		if !listed[name] {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		problems = append(problems, fmt.Sprintf("%s: not in the manifest", name))
+	}
+
+	if len(manifest.Errors) > 0 {
+		fmt.Fprintf(out, "The collection recorded %d errors:\n", len(manifest.Errors))
+		for _, collectionErr := range manifest.Errors {
+			source := collectionErr.Host
+			if collectionErr.Path != "" {
+				source += ":" + collectionErr.Path
+			}
+			fmt.Fprintf(out, "  - %s: %s\n", source, collectionErr.Error)
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(out, "  ! %s\n", problem)
+		}
+		return fmt.Errorf("%d problems found in %s", len(problems), archiveName)
+	}
+	fmt.Fprintf(out, "All %d files match %s\n", len(manifest.Entries), manifestName)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(verifyArchiveCmd)
+}
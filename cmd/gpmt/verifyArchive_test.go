@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rewriteArchive copies a tar.gz archive, letting edit change, drop (nil) or
+// keep each entry's content.
+func rewriteArchive(t *testing.T, archiveName string, edit func(name string, data []byte) []byte) string {
+	t.Helper()
+	file, err := os.Open(archiveName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data = edit(header.Name, data); data == nil {
+			continue
+		}
+		header.Size = int64(len(data))
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten := filepath.Join(t.TempDir(), "rewritten.tar.gz")
+	if err := os.WriteFile(rewritten, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return rewritten
+}
+
+func TestVerifyArchive(t *testing.T) {
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	manifest := &archiveManifest{GpmtVersion: gpmtVersion}
+	err := writeArchive(archiveName, manifest, nil, func(aw *archiveWriter) error {
+		if err := addBytesToTar(aw, "gpdb-2024-01-15_000000.csv", "cdw", []byte("coordinator\n")); err != nil {
+			return err
+		}
+		return addBytesToTar(aw, "sdw1/gpseg0-p/gpdb-2024-01-15_000000.csv", "sdw1", []byte("segment\n"))
+	})
+	if err != nil {
+		t.Fatalf("writeArchive failed: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		edit     func(name string, data []byte) []byte
+		expected string
+	}{
+		{
+			name: "untouched",
+			edit: func(name string, data []byte) []byte { return data },
+		},
+		{
+			name: "changed file",
+			edit: func(name string, data []byte) []byte {
+				if strings.HasPrefix(name, "sdw1/") {
+					return []byte("SEGMENT\n")
+				}
+				return data
+			},
+			expected: "sdw1/gpseg0-p/gpdb-2024-01-15_000000.csv: checksum mismatch",
+		},
+		{
+			name: "truncated file",
+			edit: func(name string, data []byte) []byte {
+				if strings.HasPrefix(name, "sdw1/") {
+					return []byte("seg")
+				}
+				return data
+			},
+			expected: "sdw1/gpseg0-p/gpdb-2024-01-15_000000.csv: size is 3, expected 8",
+		},
+		{
+			name: "missing file",
+			edit: func(name string, data []byte) []byte {
+				if strings.HasPrefix(name, "sdw1/") {
+					return nil
+				}
+				return data
+			},
+			expected: "sdw1/gpseg0-p/gpdb-2024-01-15_000000.csv: missing",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := verifyArchive(rewriteArchive(t, archiveName, tc.edit), &out)
+			if tc.expected == "" {
+				if err != nil {
+					t.Errorf("Expected the archive to verify, got %v\n%s", err, out.String())
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected verification to fail, got\n%s", out.String())
+			}
+			if !strings.Contains(out.String(), tc.expected) {
+				t.Errorf("Expected %q in the output, got\n%s", tc.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestVerifyArchiveWithoutManifest(t *testing.T) {
+	archiveName := filepath.Join(t.TempDir(), "logs.tar.gz")
+	if err := writeArchive(archiveName, &archiveManifest{}, nil, func(aw *archiveWriter) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	stripped := rewriteArchive(t, archiveName, func(name string, data []byte) []byte {
+		if name == manifestName {
+			return nil
+		}
+		return data
+	})
+	if err := verifyArchive(stripped, io.Discard); err == nil || !strings.Contains(err.Error(), manifestName) {
+		t.Errorf("Expected an error about the missing manifest, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pool defaults used when the ConnString does not set its own limits. A
+// diagnostic run issues many short catalog queries, so we keep a handful of
+// connections warm rather than reconnecting for every statement.
+const (
+	defaultMaxOpenConns    = 4
+	defaultMaxIdleConns    = 2
+	defaultConnMaxLifetime = 30 * time.Minute
+)
+
+// Client is a pooled handle to the database built from a ConnString. It is
+// safe for concurrent use by multiple goroutines and must be closed exactly
+// once by whoever created it.
+type Client struct {
+	connString ConnString
+	db         *sql.DB
+
+	// Prepared statements keyed by their SQL, shared by every caller
+	stmtLock sync.Mutex
+	stmts    map[string]*Stmt
+
+	// Server version and capabilities, looked up on first use
+	infoLock sync.Mutex
+	info     *ServerInfo
+}
+
+// NewClient opens a connection pool using the supplied connection details and
+// verifies that the database is reachable. Connection failures are returned as
+// a *ConnectionError.
+func NewClient(connString ConnString) (*Client, error) {
+	return NewClientContext(context.Background(), connString)
+}
+
+// NewClientContext is NewClient with a context bounding the initial
+// connection attempt. Connecting is retried according to connString.Retries,
+// and the standby coordinator is tried when the coordinator is unreachable.
+// The returned client's ConnString reflects the host actually connected to.
+func NewClientContext(ctx context.Context, connString ConnString) (*Client, error) {
+	return connectWithRetry(ctx, connString)
+}
+
+// Make a single attempt at connecting to the host in connString.
+func connectOnce(ctx context.Context, connString ConnString) (*Client, error) {
+	uri := connString.uri()
+	log.WithField("uri", connString.redactedURI()).Debug("Connecting to the database")
+
+	if err := connString.validateSSL(); err != nil {
+		return nil, connString.connectionError(fmt.Errorf("%w: %v", ErrSSL, err))
+	}
+
+	connector, err := newConnector(uri)
+	if err != nil {
+		return nil, connString.connectionError(err)
+	}
+	handle := sql.OpenDB(connector)
+	connString.configurePool(handle)
+
+	if err := handle.PingContext(ctx); err != nil {
+		handle.Close()
+		return nil, connString.connectionError(err)
+	}
+
+	return &Client{connString: connString, db: handle, stmts: make(map[string]*Stmt)}, nil
+}
+
+// Build a pq connector for the URI. The driver panics on some unsupported
+// libpq environment variables, so turn that into an ordinary error rather than
+// letting it escape the package.
+func newConnector(uri string) (connector *pq.Connector, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid connection settings: %v", r)
+		}
+	}()
+	return pq.NewConnector(uri)
+}
+
+// Connect is a convenience wrapper around NewClient.
+func (connString ConnString) Connect() (*Client, error) {
+	return NewClient(connString)
+}
+
+// ConnString returns the connection details the client was built from.
+func (client *Client) ConnString() ConnString {
+	return client.connString
+}
+
+// Close releases every prepared statement and connection held by the pool.
+// The client must not be used afterwards.
+func (client *Client) Close() error {
+	client.stmtLock.Lock()
+	for query, stmt := range client.stmts {
+		if err := stmt.stmt.Close(); err != nil {
+			log.Debugf("Failed to close prepared statement: %v", err)
+		}
+		delete(client.stmts, query)
+	}
+	client.stmtLock.Unlock()
+
+	if err := client.db.Close(); err != nil {
+		log.Warn("Failed to close database connection")
+		return err
+	}
+	return nil
+}
+
+// Apply the pool limits from the ConnString, falling back to our defaults.
+func (connString ConnString) configurePool(handle *sql.DB) {
+	maxOpen := connString.MaxOpenConns
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenConns
+	}
+	maxIdle := connString.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	lifetime := connString.ConnMaxLifetime
+	if lifetime <= 0 {
+		lifetime = defaultConnMaxLifetime
+	}
+
+	handle.SetMaxOpenConns(maxOpen)
+	handle.SetMaxIdleConns(maxIdle)
+	handle.SetConnMaxLifetime(lifetime)
+}
+
+// Derive the context a single statement runs under. When the ConnString sets
+// a QueryTimeout and the caller has not already set an earlier deadline, the
+// statement gets its own deadline. Cancelling the returned context makes the
+// driver send a cancel request so the backend stops as well.
+func (client *Client) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := client.connString.QueryTimeout
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Execute the query that was supplied. Values from user input must always
+// be passed as args and referenced as $1, $2, ... in the query rather than
+// formatted into it. We will send the error back to the user so that they can
+// decide if they want to keep the error or exit the code, so no err will be
+// handled here.
+func (client *Client) ExecuteQuery(query string, args ...interface{}) (*Result, error) {
+	return client.ExecuteQueryContext(context.Background(), query, args...)
+}
+
+// ExecuteQueryContext is ExecuteQuery with cancellation. If ctx is cancelled
+// or the query timeout expires, the statement is cancelled on the server and
+// the returned error wraps the context error.
+func (client *Client) ExecuteQueryContext(ctx context.Context, query string, args ...interface{}) (*Result, error) {
+	// Execute the query to the database.
+	log.Debug("Executing the statement: " + query)
+	return client.run(ctx, func(ctx context.Context) (*sql.Rows, error) {
+		return client.db.QueryContext(ctx, query, args...)
+	})
+}
+
+// Prepare returns a prepared statement for query, preparing it on first use.
+// Statements are cached on the client and shared by all callers, so the same
+// SQL is only parsed once per connection in the pool; they are released by
+// Client.Close.
+func (client *Client) Prepare(ctx context.Context, query string) (*Stmt, error) {
+	client.stmtLock.Lock()
+	defer client.stmtLock.Unlock()
+
+	if stmt, ok := client.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	log.Debug("Preparing the statement: " + query)
+	prepared, err := client.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	stmt := &Stmt{client: client, query: query, stmt: prepared}
+	client.stmts[query] = stmt
+	return stmt, nil
+}
+
+// Run a query under the client's timeout and buffer its result.
+func (client *Client) run(ctx context.Context, query func(context.Context) (*sql.Rows, error)) (*Result, error) {
+	ctx, cancel := client.queryContext(ctx)
+	defer cancel()
+
+	rows, err := query(ctx)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	result, err := readResult(rows)
+	return result, queryError(ctx, err)
+}
+
+// Stmt is a prepared statement owned by a Client. It is safe for concurrent
+// use.
+type Stmt struct {
+	client *Client
+	query  string
+	stmt   *sql.Stmt
+}
+
+// Query executes the prepared statement with the given bind arguments.
+func (stmt *Stmt) Query(ctx context.Context, args ...interface{}) (*Result, error) {
+	log.Debug("Executing the prepared statement: " + stmt.query)
+	return stmt.client.run(ctx, func(ctx context.Context) (*sql.Rows, error) {
+		return stmt.stmt.QueryContext(ctx, args...)
+	})
+}
+
+// Array wraps a Go slice so it can be passed as a single array bind argument,
+// e.g. "where content = any($1)" with Array([]int64{0, 1}).
+func Array(values interface{}) interface{} {
+	return pq.Array(values)
+}
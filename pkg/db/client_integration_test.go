@@ -0,0 +1,547 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+	"github.com/bluethumpasaurus/gpmt2/pkg/db/dbtest"
+	"github.com/lib/pq"
+)
+
+func newServer(t *testing.T) *dbtest.Server {
+	server, err := dbtest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start the test server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func newClient(t *testing.T, connString db.ConnString) *db.Client {
+	client, err := db.NewClient(connString)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestExecuteQuery(t *testing.T) {
+	server := newServer(t)
+	server.Handle(`from pg_class`, dbtest.Response{
+		Columns: []dbtest.Column{{Name: "relname", Type: dbtest.TypeName}, {Name: "relpages", Type: dbtest.TypeInt4}, {Name: "reloptions", Type: dbtest.TypeTextArray}},
+		Rows: [][]interface{}{
+			{"pg_class", 14, nil},
+			{"sales", 1024, []string{"appendonly=true", "compresstype=zstd"}},
+		},
+	})
+	client := newClient(t, server.ConnString())
+
+	result, err := client.ExecuteQuery("select relname, relpages, reloptions from pg_class")
+	if err != nil {
+		t.Fatalf("ExecuteQuery failed: %v", err)
+	}
+	if names := strings.Join(result.ColumnNames(), ","); names != "relname,relpages,reloptions" {
+		t.Errorf("Unexpected columns %s", names)
+	}
+	if result.Columns[1].DatabaseType != "INT4" {
+		t.Errorf("Expected INT4, got %s", result.Columns[1].DatabaseType)
+	}
+	if name, _ := result.Rows[1].String("relname"); name != "sales" {
+		t.Errorf("Expected sales, got %s", name)
+	}
+	if pages, _ := result.Rows[1].Int64("relpages"); pages != 1024 {
+		t.Errorf("Expected 1024 pages, got %d", pages)
+	}
+	if options, _ := result.Rows[1].Value("reloptions"); len(options.([]string)) != 2 {
+		t.Errorf("Expected two reloptions, got %v", options)
+	}
+
+	// Every session must be read-only and identify itself
+	params := server.StartupParams()[0]
+	if params["default_transaction_read_only"] != "on" || params["application_name"] != "gpmt" {
+		t.Errorf("Unexpected startup parameters %v", params)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	server := newServer(t)
+	server.Handle(`from missing`, dbtest.Response{Err: &dbtest.Error{Code: "42P01", Message: `relation "missing" does not exist`}})
+	client := newClient(t, server.ConnString())
+
+	_, err := client.ExecuteQuery("select * from missing")
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "42P01" {
+		t.Errorf("Expected the 42P01 error, got %v", err)
+	}
+
+	// The connection must still be usable afterwards
+	server.Handle(`select 1`, dbtest.Response{Columns: []dbtest.Column{{Name: "one", Type: dbtest.TypeInt4}}, Rows: [][]interface{}{{1}}})
+	if _, err := client.ExecuteQuery("select 1 as one"); err != nil {
+		t.Errorf("Expected the client to recover, got %v", err)
+	}
+}
+
+func TestBindArgumentsAndPreparedStatements(t *testing.T) {
+	server := newServer(t)
+	server.HandleFunc(`where content = \$1`, func(query string, args []interface{}) dbtest.Response {
+		response := dbtest.Response{Columns: []dbtest.Column{{Name: "hostname", Type: dbtest.TypeText}, {Name: "port", Type: dbtest.TypeInt4}}}
+		if args != nil && args[0] == "0" {
+			response.Rows = [][]interface{}{{"sdw1", 6000}}
+		}
+		return response
+	})
+	client := newClient(t, server.ConnString())
+	ctx := context.Background()
+
+	result, err := client.ExecuteQueryContext(ctx, "select hostname, port from gp_segment_configuration where content = $1", 0)
+	if err != nil {
+		t.Fatalf("ExecuteQueryContext failed: %v", err)
+	}
+	if port, _ := result.Rows[0].Int64("port"); result.Len() != 1 || port != 6000 {
+		t.Errorf("Unexpected result %+v", result.Rows)
+	}
+
+	const query = "select hostname, port from gp_segment_configuration where content = $1"
+	stmt, err := client.Prepare(ctx, query)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	again, _ := client.Prepare(ctx, query)
+	if stmt != again {
+		t.Errorf("Expected the prepared statement to be cached")
+	}
+	for _, content := range []int{0, 1} {
+		result, err := stmt.Query(ctx, content)
+		if err != nil {
+			t.Fatalf("Stmt.Query failed: %v", err)
+		}
+		if expected := 1 - content; result.Len() != expected {
+			t.Errorf("Expected %d rows for content %d, got %d", expected, content, result.Len())
+		}
+	}
+
+	// The hostile value reaches the server as a bind argument, not SQL
+	for _, received := range server.Queries() {
+		if strings.Contains(received, "drop table") {
+			t.Errorf("Bind argument leaked into the query text: %s", received)
+		}
+	}
+	if _, err := client.ExecuteQueryContext(ctx, query, "0; drop table x"); err != nil {
+		t.Errorf("Expected the argument to be sent separately, got %v", err)
+	}
+}
+
+func TestBindNullAndBytea(t *testing.T) {
+	server := newServer(t)
+	var received [][]interface{}
+	server.HandleFunc(`select \$1::text as label, \$2::bytea as payload`, func(query string, args []interface{}) dbtest.Response {
+		response := dbtest.Response{Columns: []dbtest.Column{{Name: "label", Type: dbtest.TypeText}, {Name: "payload", Type: dbtest.TypeBytea}}}
+		if args != nil {
+			received = append(received, args)
+			payload, _ := args[1].(string)
+			response.Rows = [][]interface{}{{args[0], []byte(payload)}}
+		}
+		return response
+	})
+	client := newClient(t, server.ConnString())
+	ctx := context.Background()
+
+	const query = "select $1::text as label, $2::bytea as payload"
+	payload := []byte{0x00, 0x01, 0xff}
+	stmt, err := client.Prepare(ctx, query)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	for name, run := range map[string]func() (*db.Result, error){
+		"ExecuteQueryContext": func() (*db.Result, error) { return client.ExecuteQueryContext(ctx, query, nil, payload) },
+		"Stmt.Query":          func() (*db.Result, error) { return stmt.Query(ctx, nil, payload) },
+	} {
+		received = nil
+		result, err := run()
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if len(received) != 1 || received[0][0] != nil {
+			t.Errorf("%s: expected NULL to be bound, got %v", name, received)
+		}
+		if label, _ := result.Rows[0].Value("label"); label != nil {
+			t.Errorf("%s: expected a NULL label, got %#v", name, label)
+		}
+		if value, _ := result.Rows[0].Value("payload"); !bytes.Equal(value.([]byte), payload) {
+			t.Errorf("%s: expected the payload %x back, got %#v", name, payload, value)
+		}
+	}
+}
+
+func TestPreparedStatementCache(t *testing.T) {
+	server := newServer(t)
+	server.HandleFunc(`from pg_stat_activity where pid = \$1`, func(query string, args []interface{}) dbtest.Response {
+		response := dbtest.Response{Columns: []dbtest.Column{{Name: "state", Type: dbtest.TypeText}}}
+		if args != nil {
+			response.Rows = [][]interface{}{{"active"}}
+		}
+		return response
+	})
+	client, err := db.NewClient(server.ConnString())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	ctx := context.Background()
+
+	const query = "select state from pg_stat_activity where pid = $1"
+	first, err := client.Prepare(ctx, query)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	for pid := 1; pid <= 3; pid++ {
+		stmt, err := client.Prepare(ctx, query)
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		if stmt != first {
+			t.Errorf("Expected the cached statement to be returned")
+		}
+		if result, err := stmt.Query(ctx, pid); err != nil || result.Len() != 1 {
+			t.Errorf("Expected one row for pid %d, got %v (%v)", pid, result, err)
+		}
+	}
+
+	parses := 0
+	for _, received := range server.Queries() {
+		if received == query {
+			parses++
+		}
+	}
+	if parses != 1 {
+		t.Errorf("Expected the statement to be parsed once, got %d", parses)
+	}
+
+	if server.ClosedStatements() != 0 {
+		t.Errorf("Expected the statement to stay prepared until Close")
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if closed := server.ClosedStatements(); closed != 1 {
+		t.Errorf("Expected Close to release the prepared statement, got %d closed", closed)
+	}
+}
+
+func TestStreamingRows(t *testing.T) {
+	server := newServer(t)
+	rows := make([][]interface{}, 1000)
+	for idx := range rows {
+		rows[idx] = []interface{}{idx}
+	}
+	server.Handle(`from gp_toolkit.__gp_log_master_ext`, dbtest.Response{
+		Columns: []dbtest.Column{{Name: "n", Type: dbtest.TypeInt8}},
+		Rows:    rows,
+	})
+	client := newClient(t, server.ConnString())
+	ctx := context.Background()
+
+	seen := 0
+	err := client.Each(ctx, "select n from gp_toolkit.__gp_log_master_ext", func(row db.Row) error {
+		seen++
+		if seen == 10 {
+			return db.ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil || seen != 10 {
+		t.Errorf("Expected to stop after 10 rows without error, got %d rows (%v)", seen, err)
+	}
+
+	iterator, err := client.QueryRows(ctx, "select n from gp_toolkit.__gp_log_master_ext")
+	if err != nil {
+		t.Fatalf("QueryRows failed: %v", err)
+	}
+	total := int64(0)
+	for iterator.Next() {
+		value, _ := iterator.Row().Int64("n")
+		total += value
+	}
+	if err := iterator.Err(); err != nil {
+		t.Errorf("Unexpected iteration error: %v", err)
+	}
+	iterator.Close()
+	if total != 999*1000/2 {
+		t.Errorf("Expected the sum of all rows, got %d", total)
+	}
+
+	boom := errors.New("boom")
+	if err := client.Each(ctx, "select n from gp_toolkit.__gp_log_master_ext", func(db.Row) error { return boom }); err != boom {
+		t.Errorf("Expected the callback error, got %v", err)
+	}
+}
+
+func TestRowsReleaseConnection(t *testing.T) {
+	server := newServer(t)
+	rows := make([][]interface{}, 1000)
+	for idx := range rows {
+		rows[idx] = []interface{}{idx}
+	}
+	server.Handle(`from gp_toolkit.__gp_log_master_ext`, dbtest.Response{
+		Columns: []dbtest.Column{{Name: "n", Type: dbtest.TypeInt8}},
+		Rows:    rows,
+	})
+	server.Handle(`select 1`, dbtest.Response{Columns: []dbtest.Column{{Name: "one", Type: dbtest.TypeInt4}}, Rows: [][]interface{}{{1}}})
+
+	// With a single connection, any query left holding it blocks the next
+	connString := server.ConnString()
+	connString.MaxOpenConns = 1
+	client := newClient(t, connString)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const query = "select n from gp_toolkit.__gp_log_master_ext"
+
+	testCases := []struct {
+		name        string
+		run         func() error
+		expectedErr error
+	}{
+		{
+			name: "close before exhausted",
+			run: func() error {
+				iterator, err := client.QueryRows(ctx, query)
+				if err != nil {
+					return err
+				}
+				iterator.Next()
+				return iterator.Close()
+			},
+		},
+		{
+			name: "stop iteration",
+			run: func() error {
+				return client.Each(ctx, query, func(db.Row) error { return db.ErrStopIteration })
+			},
+		},
+		{
+			name: "callback error",
+			run: func() error {
+				return client.Each(ctx, query, func(db.Row) error { return errBoom })
+			},
+			expectedErr: errBoom,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.run(); err != tc.expectedErr {
+				t.Errorf("Expected %v, got %v", tc.expectedErr, err)
+			}
+			if _, err := client.ExecuteQueryContext(ctx, "select 1 as one"); err != nil {
+				t.Errorf("Expected the connection to be released, got %v", err)
+			}
+		})
+	}
+}
+
+var errBoom = errors.New("boom")
+
+func TestRowsScanError(t *testing.T) {
+	server := newServer(t)
+	server.Handle(`from pg_hba_file_rules`, dbtest.Response{
+		Columns: []dbtest.Column{{Name: "address", Type: dbtest.TypeInet}},
+		Rows:    [][]interface{}{{"10.0.0.1"}, {"10.0.0.2"}, {"not-an-ip"}, {"10.0.0.4"}},
+	})
+	client := newClient(t, server.ConnString())
+	ctx := context.Background()
+	const query = "select address from pg_hba_file_rules"
+
+	iterator, err := client.QueryRows(ctx, query)
+	if err != nil {
+		t.Fatalf("QueryRows failed: %v", err)
+	}
+	seen := 0
+	for iterator.Next() {
+		seen++
+	}
+	if seen != 2 || iterator.Err() == nil {
+		t.Errorf("Expected to stop with an error after 2 rows, got %d rows (%v)", seen, iterator.Err())
+	}
+	if iterator.Next() {
+		t.Errorf("Expected no more rows after the error")
+	}
+	iterator.Close()
+
+	seen = 0
+	err = client.Each(ctx, query, func(db.Row) error {
+		seen++
+		return nil
+	})
+	if seen != 2 || err == nil || !strings.Contains(err.Error(), "not-an-ip") {
+		t.Errorf("Expected the scan error after 2 rows, got %d rows (%v)", seen, err)
+	}
+}
+
+func TestQueryTimeoutCancelsOnServer(t *testing.T) {
+	server := newServer(t)
+	server.Handle(`pg_sleep`, dbtest.Response{
+		Columns: []dbtest.Column{{Name: "pg_sleep", Type: dbtest.TypeText}},
+		Rows:    [][]interface{}{{""}},
+		Delay:   10 * time.Second,
+	})
+	connString := server.ConnString()
+	connString.QueryTimeout = 100 * time.Millisecond
+	client := newClient(t, connString)
+
+	start := time.Now()
+	_, err := client.ExecuteQuery("select pg_sleep(60)")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the query to be cut short, took %v", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Cancels() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Cancels() == 0 {
+		t.Errorf("Expected a cancel request to reach the server")
+	}
+}
+
+func TestConnectionFailures(t *testing.T) {
+	server := newServer(t)
+	server.Password = "secret"
+	server.OnStartup = func(params map[string]string) *dbtest.Error {
+		if params["database"] != "template1" {
+			return &dbtest.Error{Code: "3D000", Message: `database "` + params["database"] + `" does not exist`}
+		}
+		return nil
+	}
+
+	connString := server.ConnString()
+	connString.Password = "wrong"
+	if _, err := db.NewClient(connString); !errors.Is(err, db.ErrAuthFailed) {
+		t.Errorf("Expected ErrAuthFailed, got %v", err)
+	}
+
+	connString = server.ConnString()
+	connString.Database = "nope"
+	if _, err := db.NewClient(connString); !errors.Is(err, db.ErrDatabaseNotExist) {
+		t.Errorf("Expected ErrDatabaseNotExist, got %v", err)
+	}
+
+	connString = server.ConnString()
+	connString.SSLMode = db.SSLModeRequire
+	if _, err := db.NewClient(connString); !errors.Is(err, db.ErrSSL) {
+		t.Errorf("Expected ErrSSL from a server without TLS, got %v", err)
+	}
+
+	newClient(t, server.ConnString())
+}
+
+func TestStandbyFailover(t *testing.T) {
+	standby := newServer(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to reserve a local port: %v", err)
+	}
+	downPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	connString := standby.ConnString()
+	connString.Port = downPort
+	connString.StandbyHostname = "127.0.0.1"
+	connString.StandbyPort = standby.Port()
+
+	client := newClient(t, connString)
+	if connected := client.ConnString(); connected.Port != standby.Port() {
+		t.Errorf("Expected to be connected to the standby on %d, got %d", standby.Port(), connected.Port)
+	}
+}
+
+func TestStandbyFailoverUnresolvable(t *testing.T) {
+	standby := newServer(t)
+
+	connString := standby.ConnString()
+	connString.Hostname = "cdw.invalid"
+	connString.StandbyHostname = "127.0.0.1"
+	connString.StandbyPort = standby.Port()
+
+	client := newClient(t, connString)
+	if connected := client.ConnString(); connected.Hostname != "127.0.0.1" || connected.Port != standby.Port() {
+		t.Errorf("Expected to be connected to the standby on %d, got %s:%d", standby.Port(), connected.Hostname, connected.Port)
+	}
+}
+
+func TestServerInfoAndSegments(t *testing.T) {
+	server := newServer(t)
+	server.Greenplum(dbtest.Greenplum7Version, "group")
+	server.Segments([]db.Segment{
+		{DBID: 1, ContentID: -1, Role: "p", PreferredRole: "p", Mode: "n", Status: "u", Port: 5432, Hostname: "cdw", Address: "cdw", DataDir: "/data/coordinator/gpseg-1"},
+		{DBID: 2, ContentID: 0, Role: "p", PreferredRole: "p", Mode: "s", Status: "u", Port: server.Port(), Hostname: "localhost", Address: "127.0.0.1", DataDir: "/data/primary/gpseg0"},
+		{DBID: 3, ContentID: 0, Role: "m", PreferredRole: "m", Mode: "s", Status: "u", Port: server.Port(), Hostname: "localhost", Address: "127.0.0.1", DataDir: "/data/mirror/gpseg0"},
+	})
+	client := newClient(t, server.ConnString())
+	ctx := context.Background()
+
+	info, err := client.ServerInfo(ctx)
+	if err != nil {
+		t.Fatalf("ServerInfo failed: %v", err)
+	}
+	if !info.IsGreenplum || info.GreenplumVersion.Major != 7 || !info.UsesResourceGroups() || !info.HasGPToolkit("gp_log_system") {
+		t.Errorf("Unexpected server info %+v", info)
+	}
+
+	segments, err := client.Segments(ctx)
+	if err != nil || len(segments) != 3 {
+		t.Fatalf("Expected 3 segments, got %d (%v)", len(segments), err)
+	}
+	mirror, err := client.Segment(ctx, 0, db.RoleMirror)
+	if err != nil || mirror.DBID != 3 {
+		t.Errorf("Expected dbid 3 for the content 0 mirror, got %+v (%v)", mirror, err)
+	}
+
+	results := client.RunOnSegments(ctx, segments[1:], 2, func(ctx context.Context, segment db.Segment, segClient *db.Client) error {
+		if segment.Role == db.RoleMirror {
+			return errors.New("mirror check failed")
+		}
+		return nil
+	})
+	if results[0].Err != nil || results[1].Err == nil {
+		t.Errorf("Expected only the mirror to fail, got %+v", results)
+	}
+
+	utility := 0
+	for _, params := range server.StartupParams() {
+		if params["gp_role"] == "utility" {
+			utility++
+		}
+	}
+	if utility != 2 {
+		t.Errorf("Expected two utility mode connections, got %d", utility)
+	}
+}
+
+func TestExecuteWriteQuery(t *testing.T) {
+	server := newServer(t)
+	server.Handle(`pg_cancel_backend`, dbtest.Response{
+		Columns: []dbtest.Column{{Name: "signalled", Type: dbtest.TypeBool}},
+		Rows:    [][]interface{}{{true}},
+	})
+	client := newClient(t, server.ConnString())
+
+	signalled, err := client.CancelBackend(context.Background(), 4242)
+	if err != nil || !signalled {
+		t.Fatalf("Expected the backend to be signalled, got %v (%v)", signalled, err)
+	}
+
+	queries := strings.Join(server.Queries(), "\n")
+	if !strings.Contains(queries, "BEGIN READ WRITE") || !strings.Contains(queries, "COMMIT") {
+		t.Errorf("Expected an explicit read-write transaction, got:\n%s", queries)
+	}
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConfigurePool(t *testing.T) {
+	testCases := []struct {
+		name        string
+		connString  ConnString
+		expectedMax int
+	}{
+		{
+			name:        "defaults",
+			connString:  ConnString{},
+			expectedMax: defaultMaxOpenConns,
+		},
+		{
+			name:        "explicit limits",
+			connString:  ConnString{MaxOpenConns: 8, MaxIdleConns: 3, ConnMaxLifetime: time.Minute},
+			expectedMax: 8,
+		},
+		{
+			name:        "idle capped at open",
+			connString:  ConnString{MaxOpenConns: 1, MaxIdleConns: 5},
+			expectedMax: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// sql.Open does not dial, so no database is needed here
+			handle, err := sql.Open("postgres", tc.connString.uri())
+			if err != nil {
+				t.Fatalf("sql.Open failed: %v", err)
+			}
+			defer handle.Close()
+
+			tc.connString.configurePool(handle)
+			if got := handle.Stats().MaxOpenConnections; got != tc.expectedMax {
+				t.Errorf("Expected max open connections %d, got %d", tc.expectedMax, got)
+			}
+		})
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	testCases := []struct {
+		name          string
+		timeout       time.Duration
+		parentTimeout time.Duration
+		expectLimit   time.Duration
+	}{
+		{name: "no timeout", expectLimit: 0},
+		{name: "timeout applied", timeout: time.Minute, expectLimit: time.Minute},
+		{name: "earlier parent deadline wins", timeout: time.Hour, parentTimeout: time.Minute, expectLimit: time.Minute},
+		{name: "later parent deadline loses", timeout: time.Minute, parentTimeout: time.Hour, expectLimit: time.Minute},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Client{connString: ConnString{QueryTimeout: tc.timeout}}
+
+			parent := context.Background()
+			if tc.parentTimeout > 0 {
+				var cancel context.CancelFunc
+				parent, cancel = context.WithTimeout(parent, tc.parentTimeout)
+				defer cancel()
+			}
+
+			ctx, cancel := client.queryContext(parent)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if tc.expectLimit == 0 {
+				if ok {
+					t.Errorf("Expected no deadline, got %v", deadline)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Expected a deadline around %v", tc.expectLimit)
+			}
+			if remaining := time.Until(deadline); remaining > tc.expectLimit || remaining < tc.expectLimit-time.Second {
+				t.Errorf("Expected deadline in about %v, got %v", tc.expectLimit, remaining)
+			}
+		})
+	}
+}
+
+func TestQueryErrorWrapsContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := queryError(ctx, errors.New("pq: canceling statement due to user request"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled to be wrapped, got %v", err)
+	}
+	if queryError(ctx, nil) != nil {
+		t.Errorf("Expected nil error to stay nil")
+	}
+}
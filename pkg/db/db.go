@@ -9,24 +9,12 @@ Licensed under the Apache License, Version 2.0 (the "License")
 package db
 
 import (
-	"database/sql"
-	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-
-	_ "github.com/lib/pq"
-	log "github.com/sirupsen/logrus"
 )
 
-// globally defined, because the db object/connection should generally be in go
-// FIXME: Should this be exported?
-var db *sql.DB
-
-// MetalScanner is ... FIXME
-type MetalScanner struct {
-	valid bool
-	value interface{}
-}
-
 // ConnString contains the connection details for the database
 type ConnString struct {
 	Hostname string
@@ -34,139 +22,93 @@ type ConnString struct {
 	Username string
 	Password string
 	Database string
-}
 
-// Scan for any unsigned 8-bit integers or bytes
-func (scanner *MetalScanner) getBytes(src interface{}) []byte {
-	if a, ok := src.([]uint8); ok {
-		return a
-	}
-	return nil
+	// TLS settings, named after their libpq equivalents. An empty SSLMode
+	// means "disable".
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// Optional standby coordinator, tried whenever the coordinator refuses
+	// connections or times out. A zero StandbyPort means the same port.
+	StandbyHostname string
+	StandbyPort     int
+
+	// Retries is how many more times to try connecting after a failure that
+	// may be transient, waiting RetryBackoff (doubling each time) in between.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// RuntimeParams are server settings sent in the startup packet, such as
+	// gp_session_role=utility for a segment connection.
+	RuntimeParams map[string]string
+
+	// ApplicationName overrides DefaultApplicationName, and StatementTimeout
+	// sets the server side statement_timeout when non-zero.
+	ApplicationName  string
+	StatementTimeout time.Duration
+
+	// QueryTimeout bounds every statement run through a Client; zero means
+	// no limit beyond the caller's context.
+	QueryTimeout time.Duration
+
+	// Connection pool limits; zero values use the package defaults.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
 }
 
-// Scan the column data type and send back its value.
-func (scanner *MetalScanner) Scan(src interface{}) error {
-	switch src.(type) {
-	case int64:
-		if value, ok := src.(int64); ok {
-			scanner.value = value
-			scanner.valid = true
-		}
-	case float64:
-		if value, ok := src.(float64); ok {
-			scanner.value = value
-			scanner.valid = true
-		}
-	case bool:
-		if value, ok := src.(bool); ok {
-			scanner.value = value
-			scanner.valid = true
-		}
-	case string:
-		value := scanner.getBytes(src)
-		scanner.value = string(value)
-		scanner.valid = true
-	case []byte:
-		value := scanner.getBytes(src)
-		scanner.value = string(value)
-		scanner.valid = true
-	case time.Time:
-		if value, ok := src.(time.Time); ok {
-			scanner.value = value
-			scanner.valid = true
-		}
-	case nil:
-		scanner.value = nil
-		scanner.valid = true
-	}
-	return nil
+// Build the driver connection string from the connection details.
+func (connString ConnString) uri() string {
+	return connString.buildURI(connString.Password)
 }
 
-// Establish a connection to the database.
-func (connString *ConnString) establishConnection() {
-	var err error
-	uri := fmt.Sprintf("user=%v password=%v host=%v port=%v dbname=%v sslmode=disable",
-		connString.Username, connString.Password, connString.Hostname, connString.Port, connString.Database)
-	log.WithField("uri", uri).Debug("Connecting to the database using the connection string: " + uri)
-	db, err = sql.Open("postgres", uri)
-	if err != nil {
-		log.Error(err)
-		log.Panic("Failed to establish a connection to database")
-	}
-	err = db.Ping()
-	if err != nil {
-		log.Panic("Failed to ping database")
+// The connection string with the password masked, safe for logging.
+func (connString ConnString) redactedURI() string {
+	if connString.Password == "" {
+		return connString.buildURI("")
 	}
+	return connString.buildURI("********")
 }
 
-// Close the database connection once the query has been executed
-func (connString *ConnString) closeConnection() {
-	err := db.Close()
-	if err != nil {
-		log.Warn("Failed to close database connection")
-		log.Warn(err)
+func (connString ConnString) buildURI(password string) string {
+	params := []string{
+		"user=" + quoteParam(connString.Username),
+		"host=" + quoteParam(connString.Hostname),
+		"port=" + strconv.Itoa(connString.Port),
+		"dbname=" + quoteParam(connString.Database),
+		"sslmode=" + connString.sslMode(),
 	}
-}
-
-// Execute the query that was supplied. We will send the error back to the user
-// so that they can decide if they want to keep the error or exit the code, so
-// no err will be handled here.
-func (connString *ConnString) ExecuteQuery(query string) ([]map[string]interface{}, error) {
-
-	// Make a connection to the database
-	connString.establishConnection()
-
-	// close database connection once done
-	defer connString.closeConnection()
-
-	// Initialize a data array map, which we will return
-	var data []map[string]interface{}
-
-	// Execute the query to the database.
-	log.Debug("Executing the statement: " + query)
-	rows, err := db.Query(query)
-	if err != nil {
-		return data, err
+	for _, param := range []struct{ key, value string }{
+		{"sslrootcert", connString.SSLRootCert},
+		{"sslcert", connString.SSLCert},
+		{"sslkey", connString.SSLKey},
+	} {
+		if param.value != "" {
+			params = append(params, param.key+"="+quoteParam(param.value))
+		}
 	}
-	defer rows.Close()
-
-	// Get all the column names from the query provided by the users.
-	columns, err := rows.Columns()
-	if err != nil {
-		return data, err
+	// Sort the session parameters so the string is stable
+	session := connString.sessionParams()
+	keys := make([]string, 0, len(session))
+	for key := range session {
+		keys = append(keys, key)
 	}
-
-	// scan row by row for the queries result
-	for rows.Next() {
-
-		// Create a interface map based on the number of columns
-		// so that we can store the scanned row
-		row := make([]interface{}, len(columns))
-		for idx := range columns {
-			row[idx] = new(MetalScanner)
-		}
-
-		// Scan for the rows and placed it on the interface map (row)
-		err := rows.Scan(row...)
-		if err != nil {
-			return data, err
-		}
-
-		// A temp placeholder
-		temp := make(map[string]interface{})
-
-		// Now lets create a JSON for that output
-		for idx, column := range columns {
-			var scanner = row[idx].(*MetalScanner)
-			temp[column] = scanner.value
-		}
-
-		// Store that on the data array map
-		data = append(data, temp)
-
+	sort.Strings(keys)
+	for _, key := range keys {
+		params = append(params, key+"="+quoteParam(session[key]))
 	}
+	// An empty password must be left out entirely, otherwise the driver
+	// treats it as supplied and never consults ~/.pgpass.
+	if password != "" {
+		params = append(params, "password="+quoteParam(password))
+	}
+	return strings.Join(params, " ")
+}
 
-	// Send the data back to the user for further
-	// manipulation or to what their code depends
-	return data, nil
+// Quote a value for a libpq key=value connection string.
+func quoteParam(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + escaped + "'"
 }
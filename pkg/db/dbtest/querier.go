@@ -0,0 +1,154 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+)
+
+// Querier is an in-memory db.Querier that answers queries from canned
+// results, for unit testing the gpmt tools without any network.
+type Querier struct {
+	// Info is returned by ServerInfo. When nil, ServerInfo runs the usual
+	// catalog queries against the canned results instead.
+	Info *db.ServerInfo
+
+	lock    sync.Mutex
+	rules   []rule
+	queries []string
+}
+
+type rule struct {
+	pattern *regexp.Regexp
+	fn      func(query string, args []interface{}) (*db.Result, error)
+}
+
+var _ db.Querier = (*Querier)(nil)
+
+// NewQuerier returns a Querier with no canned results.
+func NewQuerier() *Querier {
+	return &Querier{}
+}
+
+// Handle answers every query matching pattern, a case-insensitive regular
+// expression, with result. Later registrations take precedence.
+func (fake *Querier) Handle(pattern string, result *db.Result) {
+	fake.HandleFunc(pattern, func(string, []interface{}) (*db.Result, error) {
+		return result, nil
+	})
+}
+
+// HandleError fails every query matching pattern with err.
+func (fake *Querier) HandleError(pattern string, err error) {
+	fake.HandleFunc(pattern, func(string, []interface{}) (*db.Result, error) {
+		return nil, err
+	})
+}
+
+// HandleFunc answers every query matching pattern by calling fn with the
+// query and its bind arguments.
+func (fake *Querier) HandleFunc(pattern string, fn func(query string, args []interface{}) (*db.Result, error)) {
+	compiled := regexp.MustCompile("(?is)" + pattern)
+	fake.lock.Lock()
+	fake.rules = append(fake.rules, rule{pattern: compiled, fn: fn})
+	fake.lock.Unlock()
+}
+
+// Segments answers db.ListSegments with segments.
+func (fake *Querier) Segments(segments []db.Segment) {
+	columns := []db.Column{
+		{Name: "dbid", DatabaseType: "INT2"},
+		{Name: "content", DatabaseType: "INT2"},
+		{Name: "role", DatabaseType: "CHAR"},
+		{Name: "preferred_role", DatabaseType: "CHAR"},
+		{Name: "mode", DatabaseType: "CHAR"},
+		{Name: "status", DatabaseType: "CHAR"},
+		{Name: "port", DatabaseType: "INT4"},
+		{Name: "hostname", DatabaseType: "TEXT"},
+		{Name: "address", DatabaseType: "TEXT"},
+		{Name: "datadir", DatabaseType: "TEXT"},
+	}
+	rows := make([][]interface{}, len(segments))
+	for idx, segment := range segments {
+		rows[idx] = []interface{}{int64(segment.DBID), int64(segment.ContentID), segment.Role, segment.PreferredRole,
+			segment.Mode, segment.Status, int64(segment.Port), segment.Hostname, segment.Address, segment.DataDir}
+	}
+	fake.Handle(`select dbid, content, role\b.*from gp_segment_configuration`, db.NewResult(columns, rows...))
+}
+
+// Queries returns every query received so far, in order.
+func (fake *Querier) Queries() []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return append([]string(nil), fake.queries...)
+}
+
+// ExecuteQueryContext implements db.Querier.
+func (fake *Querier) ExecuteQueryContext(ctx context.Context, query string, args ...interface{}) (*db.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fake.lock.Lock()
+	fake.queries = append(fake.queries, query)
+	rules := append([]rule(nil), fake.rules...)
+	fake.lock.Unlock()
+
+	for idx := len(rules) - 1; idx >= 0; idx-- {
+		if rules[idx].pattern.MatchString(query) {
+			return rules[idx].fn(query, args)
+		}
+	}
+	return nil, fmt.Errorf("dbtest: no result scripted for query: %s", query)
+}
+
+// Each implements db.Querier.
+func (fake *Querier) Each(ctx context.Context, query string, fn func(db.Row) error, args ...interface{}) error {
+	result, err := fake.ExecuteQueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		if err := fn(row); err != nil {
+			if errors.Is(err, db.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ServerInfo implements db.Querier.
+func (fake *Querier) ServerInfo(ctx context.Context) (*db.ServerInfo, error) {
+	if fake.Info != nil {
+		return fake.Info, nil
+	}
+	return db.LookupServerInfo(ctx, fake)
+}
+
+// GreenplumInfo returns the ServerInfo for a version string, with the given
+// resource manager and gp_toolkit relations, for use as Querier.Info.
+func GreenplumInfo(version string, resourceManager string, gpToolkit ...string) *db.ServerInfo {
+	info, err := db.ParseVersion(version)
+	if err != nil {
+		panic(err)
+	}
+	info.ResourceManager = resourceManager
+	for _, relation := range gpToolkit {
+		info.GPToolkitRelations[relation] = true
+	}
+	return info
+}
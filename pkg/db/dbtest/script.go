@@ -0,0 +1,202 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package dbtest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+)
+
+// Oid identifies a column type in a RowDescription.
+type Oid uint32
+
+// Type oids for the columns the gpmt catalog queries return.
+const (
+	TypeBool        Oid = 16
+	TypeBytea       Oid = 17
+	TypeChar        Oid = 18
+	TypeName        Oid = 19
+	TypeInt8        Oid = 20
+	TypeInt2        Oid = 21
+	TypeInt2Vector  Oid = 22
+	TypeInt4        Oid = 23
+	TypeText        Oid = 25
+	TypeOid         Oid = 26
+	TypeJSON        Oid = 114
+	TypeFloat8      Oid = 701
+	TypeInet        Oid = 869
+	TypeTextArray   Oid = 1009
+	TypeVarchar     Oid = 1043
+	TypeTimestamp   Oid = 1114
+	TypeTimestamptz Oid = 1184
+	TypeInterval    Oid = 1186
+	TypeNumeric     Oid = 1700
+	TypeUUID        Oid = 2950
+)
+
+// Column describes one column of a scripted result.
+type Column struct {
+	Name string
+	Type Oid
+}
+
+// Error is an ErrorResponse with a SQLSTATE code.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Response is the scripted answer to a query. Rows hold Go values that are
+// sent in their PostgreSQL text form: nil is NULL, strings are sent as is,
+// numbers, booleans, times and []string are formatted. Delay holds the answer
+// back, and a cancel request arriving during the delay aborts the query with
+// SQLSTATE 57014.
+type Response struct {
+	Columns []Column
+	Rows    [][]interface{}
+	// Tag overrides the command tag, which defaults to "SELECT n"
+	Tag   string
+	Err   *Error
+	Delay time.Duration
+}
+
+// HandlerFunc computes a response. args holds the bind arguments as strings
+// (nil for NULL); it is nil for simple queries and when the statement is
+// being described, so the columns must not depend on it. A handler can be
+// called more than once for the same query.
+type HandlerFunc func(query string, args []interface{}) Response
+
+// Handle answers every query matching pattern, a case-insensitive regular
+// expression, with response. Later registrations take precedence.
+func (server *Server) Handle(pattern string, response Response) {
+	server.HandleFunc(pattern, func(string, []interface{}) Response {
+		return response
+	})
+}
+
+// HandleFunc answers every query matching pattern by calling fn.
+func (server *Server) HandleFunc(pattern string, fn HandlerFunc) {
+	compiled := regexp.MustCompile("(?is)" + pattern)
+	server.lock.Lock()
+	server.handlers = append(server.handlers, handler{pattern: compiled, fn: fn})
+	server.lock.Unlock()
+}
+
+// Version strings of the releases the tests pretend to be.
+const (
+	Greenplum6Version = "PostgreSQL 9.4.26 (Greenplum Database 6.25.3 build commit:367edc6b4dfd909fe38fc288ade9e294d74e3f9a Open Source) on x86_64-unknown-linux-gnu, compiled by gcc (GCC) 6.4.0, 64-bit"
+	Greenplum7Version = "PostgreSQL 12.12 (Greenplum Database 7.1.0 build commit:e7c2b1f14bb42a1018ac57d14f4436880e0a0515 Open Source) on x86_64-pc-linux-gnu, compiled by gcc (GCC) 8.5.0, 64-bit"
+)
+
+// Greenplum scripts the queries behind Client.ServerInfo: version(), the
+// resource manager setting and a typical gp_toolkit schema.
+func (server *Server) Greenplum(version string, resourceManager string) {
+	server.Handle(`select version\(\)`, Response{
+		Columns: []Column{{Name: "version", Type: TypeText}},
+		Rows:    [][]interface{}{{version}},
+	})
+	server.Handle(`from pg_settings where name = 'gp_resource_manager'`, Response{
+		Columns: []Column{{Name: "setting", Type: TypeText}},
+		Rows:    [][]interface{}{{resourceManager}},
+	})
+	server.Handle(`n\.nspname = 'gp_toolkit'`, Response{
+		Columns: []Column{{Name: "relname", Type: TypeName}},
+		Rows: [][]interface{}{
+			{"gp_log_system"}, {"gp_log_database"}, {"__gp_log_master_ext"}, {"__gp_log_segment_ext"},
+			{"gp_resgroup_config"}, {"gp_resqueue_status"}, {"gp_stats_missing"},
+		},
+	})
+}
+
+// SegmentColumns are the columns of gp_segment_configuration used by
+// db.Client.Segments.
+var SegmentColumns = []Column{
+	{Name: "dbid", Type: TypeInt2},
+	{Name: "content", Type: TypeInt2},
+	{Name: "role", Type: TypeChar},
+	{Name: "preferred_role", Type: TypeChar},
+	{Name: "mode", Type: TypeChar},
+	{Name: "status", Type: TypeChar},
+	{Name: "port", Type: TypeInt4},
+	{Name: "hostname", Type: TypeText},
+	{Name: "address", Type: TypeText},
+	{Name: "datadir", Type: TypeText},
+}
+
+// Segments scripts gp_segment_configuration. Every query against it gets the
+// full table, ordered as db.Client.Segments expects.
+func (server *Server) Segments(segments []db.Segment) {
+	rows := make([][]interface{}, len(segments))
+	for idx, segment := range segments {
+		rows[idx] = []interface{}{segment.DBID, segment.ContentID, segment.Role, segment.PreferredRole,
+			segment.Mode, segment.Status, segment.Port, segment.Hostname, segment.Address, segment.DataDir}
+	}
+	server.Handle(`from gp_segment_configuration`, Response{Columns: SegmentColumns, Rows: rows})
+}
+
+// Format a Go value in PostgreSQL text form.
+func encodeText(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case []byte:
+		return `\x` + hex.EncodeToString(typed)
+	case bool:
+		if typed {
+			return "t"
+		}
+		return "f"
+	case time.Time:
+		return typed.Format("2006-01-02 15:04:05.999999-07")
+	case float32, float64:
+		return fmt.Sprintf("%v", typed)
+	case []string:
+		quoted := make([]string, len(typed))
+		for idx, elem := range typed {
+			quoted[idx] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(elem) + `"`
+		}
+		return "{" + strings.Join(quoted, ",") + "}"
+	}
+	return fmt.Sprint(value)
+}
+
+// Format a Go value in the binary form the driver asks for on integer, bytea
+// and uuid columns of prepared statements.
+func encodeBinary(typ Oid, value interface{}) []byte {
+	text := encodeText(value)
+	switch typ {
+	case TypeInt2, TypeInt4, TypeInt8:
+		number, _ := strconv.ParseInt(text, 10, 64)
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(number))
+		switch typ {
+		case TypeInt2:
+			return buf[6:]
+		case TypeInt4:
+			return buf[4:]
+		}
+		return buf
+	case TypeBytea:
+		if raw, ok := value.([]byte); ok {
+			return raw
+		}
+		return []byte(text)
+	case TypeUUID:
+		raw, _ := hex.DecodeString(strings.ReplaceAll(text, "-", ""))
+		return raw
+	}
+	return []byte(text)
+}
@@ -0,0 +1,649 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+
+// Package dbtest provides an in-process server that speaks enough of the
+// PostgreSQL wire protocol for pkg/db and the gpmt commands to be tested end
+// to end without a Greenplum cluster. Queries are answered from scripted
+// responses registered with Handle and HandleFunc.
+package dbtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluethumpasaurus/gpmt2/pkg/db"
+)
+
+// Protocol codes sent in place of a version in the startup packet.
+const (
+	protocolVersion3  = 196608
+	sslRequestCode    = 80877103
+	cancelRequestCode = 80877102
+)
+
+// Server is a scripted PostgreSQL server listening on a local port.
+type Server struct {
+	// Password, when set, is required from clients using cleartext
+	// password authentication.
+	Password string
+
+	// OnStartup may reject a connection by returning an error, e.g. a
+	// 3D000 error for an unknown database.
+	OnStartup func(params map[string]string) *Error
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	lock     sync.Mutex
+	handlers []handler
+	queries  []string
+	startups []map[string]string
+	cancels  int
+	closes   int
+	nextPID  uint32
+	sessions map[uint32]*session
+}
+
+type handler struct {
+	pattern *regexp.Regexp
+	fn      HandlerFunc
+}
+
+// NewServer starts a server on a free local port. Close it when done.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{listener: listener, nextPID: 1000, sessions: make(map[uint32]*session)}
+	server.wg.Add(1)
+	go server.serve()
+	return server, nil
+}
+
+// Port returns the port the server listens on.
+func (server *Server) Port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+// ConnString returns connection details that reach this server.
+func (server *Server) ConnString() db.ConnString {
+	return db.ConnString{
+		Hostname: "127.0.0.1",
+		Port:     server.Port(),
+		Username: "gpadmin",
+		Password: server.Password,
+		Database: "template1",
+	}
+}
+
+// Close stops the server and drops every open connection.
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.lock.Lock()
+	for _, session := range server.sessions {
+		session.conn.Close()
+	}
+	server.lock.Unlock()
+	server.wg.Wait()
+	return err
+}
+
+// Queries returns every query received so far, in order.
+func (server *Server) Queries() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string(nil), server.queries...)
+}
+
+// StartupParams returns the startup parameters of every connection so far.
+func (server *Server) StartupParams() []map[string]string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]map[string]string(nil), server.startups...)
+}
+
+// Cancels returns how many cancel requests have been received.
+func (server *Server) Cancels() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.cancels
+}
+
+// ClosedStatements returns how many prepared statements clients have closed.
+func (server *Server) ClosedStatements() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.closes
+}
+
+func (server *Server) serve() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			defer conn.Close()
+			server.handleConn(conn)
+		}()
+	}
+}
+
+// session is the state of one client connection.
+type session struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	pid      uint32
+	secret   uint32
+	cancel   chan struct{}
+	txStatus byte
+
+	statements map[string]string
+	portal     portal
+}
+
+// portal is a bound statement waiting to be executed.
+type portal struct {
+	query   string
+	args    []interface{}
+	formats []int16
+}
+
+func (server *Server) handleConn(conn net.Conn) {
+	sess := &session{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		txStatus:   'I',
+		statements: make(map[string]string),
+	}
+
+	params, ok := server.startup(sess)
+	if !ok {
+		return
+	}
+
+	server.lock.Lock()
+	server.startups = append(server.startups, params)
+	sess.pid = server.nextPID
+	sess.secret = server.nextPID * 7
+	sess.cancel = make(chan struct{}, 1)
+	server.nextPID++
+	server.sessions[sess.pid] = sess
+	server.lock.Unlock()
+	defer func() {
+		server.lock.Lock()
+		delete(server.sessions, sess.pid)
+		server.lock.Unlock()
+	}()
+
+	sess.sendAuthOK(server)
+	server.loop(sess)
+}
+
+// Read the startup packet, answering SSL and cancel requests along the way.
+func (server *Server) startup(sess *session) (map[string]string, bool) {
+	for {
+		var length int32
+		if err := binary.Read(sess.reader, binary.BigEndian, &length); err != nil || length < 8 {
+			return nil, false
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(sess.reader, body); err != nil {
+			return nil, false
+		}
+		code := binary.BigEndian.Uint32(body[:4])
+
+		switch code {
+		case sslRequestCode:
+			// No TLS here; the client falls back or fails per its sslmode
+			sess.conn.Write([]byte{'N'})
+			continue
+		case cancelRequestCode:
+			if len(body) >= 12 {
+				server.cancelSession(binary.BigEndian.Uint32(body[4:8]), binary.BigEndian.Uint32(body[8:12]))
+			}
+			return nil, false
+		case protocolVersion3:
+		default:
+			sess.sendError(&Error{Code: "08P01", Message: fmt.Sprintf("unsupported protocol %d", code)})
+			sess.writer.Flush()
+			return nil, false
+		}
+
+		params := make(map[string]string)
+		fields := strings.Split(string(body[4:]), "\x00")
+		for idx := 0; idx+1 < len(fields); idx += 2 {
+			if fields[idx] == "" {
+				break
+			}
+			params[fields[idx]] = fields[idx+1]
+		}
+
+		if server.Password != "" {
+			sess.send('R', uint32Bytes(3))
+			sess.writer.Flush()
+			msgType, msg, err := sess.readMessage()
+			if err != nil || msgType != 'p' || strings.TrimRight(string(msg), "\x00") != server.Password {
+				sess.sendError(&Error{Code: "28P01", Message: fmt.Sprintf("password authentication failed for user %q", params["user"])})
+				sess.writer.Flush()
+				return nil, false
+			}
+		}
+
+		if server.OnStartup != nil {
+			if startupErr := server.OnStartup(params); startupErr != nil {
+				sess.sendError(startupErr)
+				sess.writer.Flush()
+				return nil, false
+			}
+		}
+		return params, true
+	}
+}
+
+func (server *Server) cancelSession(pid uint32, secret uint32) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.cancels++
+	if sess, ok := server.sessions[pid]; ok && sess.secret == secret {
+		select {
+		case sess.cancel <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (sess *session) sendAuthOK(server *Server) {
+	sess.send('R', uint32Bytes(0))
+	for _, param := range [][2]string{
+		{"server_version", "9.4.26"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		sess.send('S', []byte(param[0]+"\x00"+param[1]+"\x00"))
+	}
+	key := append(uint32Bytes(sess.pid), uint32Bytes(sess.secret)...)
+	sess.send('K', key)
+	sess.sendReady()
+}
+
+// Process frontend messages until the client disconnects.
+func (server *Server) loop(sess *session) {
+	// After an error in the extended protocol everything up to the next
+	// Sync is discarded
+	skipping := false
+	for {
+		msgType, msg, err := sess.readMessage()
+		if err != nil {
+			return
+		}
+		if skipping && msgType != 'S' {
+			continue
+		}
+
+		switch msgType {
+		case 'Q':
+			query := cString(msg)
+			server.simpleQuery(sess, query)
+			sess.sendReady()
+		case 'P':
+			name, rest := splitCString(msg)
+			query, _ := splitCString(rest)
+			server.record(query)
+			sess.statements[name] = query
+			sess.send('1', nil)
+		case 'D':
+			if len(msg) < 1 {
+				return
+			}
+			name := cString(msg[1:])
+			query := sess.statements[name]
+			if msg[0] == 'P' {
+				query = sess.portal.query
+			}
+			if msg[0] == 'S' {
+				sess.sendParameterDescription(query)
+			}
+			response := server.respond(query, nil)
+			if response.Err != nil {
+				sess.sendError(response.Err)
+				skipping = true
+				continue
+			}
+			if len(response.Columns) == 0 {
+				sess.send('n', nil)
+			} else {
+				sess.sendRowDescription(response.Columns)
+			}
+		case 'B':
+			if err := sess.bind(msg); err != nil {
+				sess.sendError(&Error{Code: "08P01", Message: err.Error()})
+				skipping = true
+				continue
+			}
+			sess.send('2', nil)
+		case 'E':
+			response := server.respond(sess.portal.query, sess.portal.args)
+			if !sess.deliver(response, sess.portal.formats, false) {
+				skipping = true
+			}
+		case 'C':
+			if len(msg) > 0 && msg[0] == 'S' {
+				name := cString(msg[1:])
+				delete(sess.statements, name)
+				server.lock.Lock()
+				server.closes++
+				server.lock.Unlock()
+			}
+			sess.send('3', nil)
+		case 'H':
+			sess.writer.Flush()
+		case 'S':
+			skipping = false
+			sess.sendReady()
+		case 'X':
+			return
+		default:
+			sess.sendError(&Error{Code: "08P01", Message: fmt.Sprintf("unsupported message %q", msgType)})
+			sess.sendReady()
+		}
+	}
+}
+
+// Answer a simple query message.
+func (server *Server) simpleQuery(sess *session, query string) {
+	if strings.TrimSpace(strings.TrimRight(strings.TrimSpace(query), ";")) == "" {
+		sess.send('I', nil)
+		return
+	}
+	server.record(query)
+	sess.deliver(server.respond(query, nil), nil, true)
+}
+
+func (server *Server) record(query string) {
+	server.lock.Lock()
+	server.queries = append(server.queries, query)
+	server.lock.Unlock()
+}
+
+// Find the response for a query: the most recently registered matching
+// handler wins, then the built in transaction and SET handling.
+func (server *Server) respond(query string, args []interface{}) Response {
+	server.lock.Lock()
+	handlers := append([]handler(nil), server.handlers...)
+	server.lock.Unlock()
+
+	for idx := len(handlers) - 1; idx >= 0; idx-- {
+		if handlers[idx].pattern.MatchString(query) {
+			return handlers[idx].fn(query, args)
+		}
+	}
+
+	command := strings.ToUpper(strings.Fields(query + " ")[0])
+	switch command {
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "SET", "RESET":
+		return Response{Tag: command}
+	}
+	return Response{Err: &Error{Code: "XX000", Message: "dbtest: no response scripted for query: " + query}}
+}
+
+// Send a response: the optional delay, then the rows or the error. It
+// reports false when an error was sent.
+func (sess *session) deliver(response Response, formats []int16, describe bool) bool {
+	if response.Delay > 0 {
+		sess.writer.Flush()
+		select {
+		case <-time.After(response.Delay):
+		case <-sess.cancel:
+			sess.sendError(&Error{Code: "57014", Message: "canceling statement due to user request"})
+			return false
+		}
+	}
+
+	if response.Err != nil {
+		sess.sendError(response.Err)
+		return false
+	}
+
+	switch strings.ToUpper(response.Tag) {
+	case "BEGIN", "START":
+		sess.txStatus = 'T'
+	case "COMMIT", "END", "ROLLBACK":
+		sess.txStatus = 'I'
+	}
+
+	if describe && len(response.Columns) > 0 {
+		sess.sendRowDescription(response.Columns)
+	}
+	for _, row := range response.Rows {
+		sess.sendDataRow(response.Columns, row, formats)
+	}
+
+	tag := response.Tag
+	if tag == "" {
+		tag = fmt.Sprintf("SELECT %d", len(response.Rows))
+	}
+	sess.send('C', []byte(tag+"\x00"))
+	return true
+}
+
+// Parse a Bind message into the session's portal.
+func (sess *session) bind(msg []byte) error {
+	_, rest := splitCString(msg)
+	name, rest := splitCString(rest)
+	query, ok := sess.statements[name]
+	if !ok {
+		return fmt.Errorf("prepared statement %q does not exist", name)
+	}
+
+	reader := &messageReader{buf: rest}
+	paramFormats := make([]int16, reader.int16())
+	for idx := range paramFormats {
+		paramFormats[idx] = reader.int16()
+	}
+	args := make([]interface{}, reader.int16())
+	for idx := range args {
+		length := reader.int32()
+		if length < 0 {
+			continue
+		}
+		value := reader.bytes(int(length))
+		if len(paramFormats) > 0 && paramFormats[idx%len(paramFormats)] == 1 {
+			args[idx] = value
+		} else {
+			args[idx] = string(value)
+		}
+	}
+	formats := make([]int16, reader.int16())
+	for idx := range formats {
+		formats[idx] = reader.int16()
+	}
+	if reader.err != nil {
+		return reader.err
+	}
+
+	sess.portal = portal{query: query, args: args, formats: formats}
+	return nil
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// Describe the parameters of a statement by counting its placeholders.
+func (sess *session) sendParameterDescription(query string) {
+	count := 0
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(query, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && n > count {
+			count = n
+		}
+	}
+	body := int16Bytes(int16(count))
+	for idx := 0; idx < count; idx++ {
+		body = append(body, uint32Bytes(0)...)
+	}
+	sess.send('t', body)
+}
+
+func (sess *session) sendRowDescription(columns []Column) {
+	body := int16Bytes(int16(len(columns)))
+	for _, column := range columns {
+		body = append(body, []byte(column.Name+"\x00")...)
+		body = append(body, uint32Bytes(0)...)
+		body = append(body, int16Bytes(0)...)
+		body = append(body, uint32Bytes(uint32(column.Type))...)
+		body = append(body, int16Bytes(-1)...)
+		body = append(body, uint32Bytes(0xffffffff)...)
+		body = append(body, int16Bytes(0)...)
+	}
+	sess.send('T', body)
+}
+
+func (sess *session) sendDataRow(columns []Column, row []interface{}, formats []int16) {
+	body := int16Bytes(int16(len(row)))
+	for idx, value := range row {
+		if value == nil {
+			body = append(body, uint32Bytes(0xffffffff)...)
+			continue
+		}
+		binaryFormat := false
+		if len(formats) == 1 {
+			binaryFormat = formats[0] == 1
+		} else if idx < len(formats) {
+			binaryFormat = formats[idx] == 1
+		}
+
+		var encoded []byte
+		if binaryFormat && idx < len(columns) {
+			encoded = encodeBinary(columns[idx].Type, value)
+		} else {
+			encoded = []byte(encodeText(value))
+		}
+		body = append(body, uint32Bytes(uint32(len(encoded)))...)
+		body = append(body, encoded...)
+	}
+	sess.send('D', body)
+}
+
+func (sess *session) sendError(err *Error) {
+	body := []byte("SERROR\x00VERROR\x00")
+	body = append(body, []byte("C"+err.Code+"\x00")...)
+	body = append(body, []byte("M"+err.Message+"\x00")...)
+	body = append(body, 0)
+	sess.send('E', body)
+}
+
+func (sess *session) sendReady() {
+	sess.send('Z', []byte{sess.txStatus})
+	sess.writer.Flush()
+}
+
+func (sess *session) send(msgType byte, body []byte) {
+	sess.writer.WriteByte(msgType)
+	sess.writer.Write(uint32Bytes(uint32(len(body) + 4)))
+	sess.writer.Write(body)
+}
+
+func (sess *session) readMessage() (byte, []byte, error) {
+	msgType, err := sess.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var length int32
+	if err := binary.Read(sess.reader, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length < 4 {
+		return 0, nil, errors.New("invalid message length")
+	}
+	msg := make([]byte, length-4)
+	if _, err := io.ReadFull(sess.reader, msg); err != nil {
+		return 0, nil, err
+	}
+	return msgType, msg, nil
+}
+
+// messageReader decodes the fields of a frontend message.
+type messageReader struct {
+	buf []byte
+	err error
+}
+
+func (reader *messageReader) int16() int16 {
+	if len(reader.buf) < 2 {
+		reader.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	value := int16(binary.BigEndian.Uint16(reader.buf))
+	reader.buf = reader.buf[2:]
+	return value
+}
+
+func (reader *messageReader) int32() int32 {
+	if len(reader.buf) < 4 {
+		reader.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	value := int32(binary.BigEndian.Uint32(reader.buf))
+	reader.buf = reader.buf[4:]
+	return value
+}
+
+func (reader *messageReader) bytes(length int) []byte {
+	if len(reader.buf) < length {
+		reader.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	value := append([]byte(nil), reader.buf[:length]...)
+	reader.buf = reader.buf[length:]
+	return value
+}
+
+func cString(buf []byte) string {
+	value, _ := splitCString(buf)
+	return value
+}
+
+func splitCString(buf []byte) (string, []byte) {
+	for idx, b := range buf {
+		if b == 0 {
+			return string(buf[:idx]), buf[idx+1:]
+		}
+	}
+	return string(buf), nil
+}
+
+func uint32Bytes(value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return buf
+}
+
+func int16Bytes(value int16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, uint16(value))
+	return buf
+}
@@ -0,0 +1,321 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults used when neither the caller, a service file nor the environment
+// supplies a value.
+const (
+	DefaultHostname = "localhost"
+	DefaultPort     = 5432
+	DefaultUsername = "gpadmin"
+	DefaultDatabase = "template1"
+)
+
+// Environment variables that lib/pq refuses to start with. We read them
+// ourselves and then remove them from the process environment.
+var consumedEnvironment = []string{"PGSERVICE", "PGSERVICEFILE", "PGSYSCONFDIR"}
+
+// ResolveConnString completes the connection details the same way libpq does.
+// Fields already set in connString (typically from command line flags) always
+// win; anything left empty is taken, in order, from the named service in
+// pg_service.conf, the PG* environment variables and finally our defaults. If
+// no password is found by then, ~/.pgpass (or $PGPASSFILE) is consulted.
+//
+// service may be empty, in which case $PGSERVICE is used if set.
+func ResolveConnString(connString ConnString, service string) (ConnString, error) {
+	if service == "" {
+		service = os.Getenv("PGSERVICE")
+	}
+	if service != "" {
+		settings, err := lookupService(service)
+		if err != nil {
+			return connString, err
+		}
+		if err := connString.applySettings(settings); err != nil {
+			return connString, fmt.Errorf("service %q: %w", service, err)
+		}
+	}
+
+	if err := connString.applySettings(environmentSettings()); err != nil {
+		return connString, fmt.Errorf("environment: %w", err)
+	}
+
+	if connString.Hostname == "" {
+		connString.Hostname = DefaultHostname
+	}
+	if connString.Port == 0 {
+		connString.Port = DefaultPort
+	}
+	if connString.Username == "" {
+		connString.Username = DefaultUsername
+	}
+	if connString.Database == "" {
+		connString.Database = DefaultDatabase
+	}
+
+	if connString.Password == "" {
+		password, err := lookupPgpass(connString)
+		if err != nil {
+			log.Warnf("Ignoring password file: %v", err)
+		}
+		connString.Password = password
+	}
+
+	for _, name := range consumedEnvironment {
+		os.Unsetenv(name)
+	}
+
+	return connString, nil
+}
+
+// Collect the libpq environment variables we understand, keyed by the
+// matching connection parameter name.
+func environmentSettings() map[string]string {
+	settings := make(map[string]string)
+	for param, env := range map[string]string{
+		"host":        "PGHOST",
+		"port":        "PGPORT",
+		"user":        "PGUSER",
+		"password":    "PGPASSWORD",
+		"dbname":      "PGDATABASE",
+		"sslmode":     "PGSSLMODE",
+		"sslrootcert": "PGSSLROOTCERT",
+		"sslcert":     "PGSSLCERT",
+		"sslkey":      "PGSSLKEY",
+	} {
+		if value, ok := os.LookupEnv(env); ok && value != "" {
+			settings[param] = value
+		}
+	}
+	return settings
+}
+
+// Fill any empty field from a set of libpq connection parameters. Unknown
+// parameters are ignored, as libpq would pass them to the server.
+func (connString *ConnString) applySettings(settings map[string]string) error {
+	for param, value := range settings {
+		switch param {
+		case "host":
+			if connString.Hostname == "" {
+				connString.Hostname = value
+			}
+		case "port":
+			if connString.Port == 0 {
+				port, err := strconv.Atoi(value)
+				if err != nil {
+					return fmt.Errorf("invalid port %q", value)
+				}
+				connString.Port = port
+			}
+		case "user":
+			if connString.Username == "" {
+				connString.Username = value
+			}
+		case "password":
+			if connString.Password == "" {
+				connString.Password = value
+			}
+		case "dbname":
+			if connString.Database == "" {
+				connString.Database = value
+			}
+		case "sslmode":
+			if connString.SSLMode == "" {
+				connString.SSLMode = value
+			}
+		case "sslrootcert":
+			if connString.SSLRootCert == "" {
+				connString.SSLRootCert = value
+			}
+		case "sslcert":
+			if connString.SSLCert == "" {
+				connString.SSLCert = value
+			}
+		case "sslkey":
+			if connString.SSLKey == "" {
+				connString.SSLKey = value
+			}
+		}
+	}
+	return nil
+}
+
+// Locate the service file candidates in the order libpq searches them.
+func serviceFiles() []string {
+	var files []string
+	if file := os.Getenv("PGSERVICEFILE"); file != "" {
+		files = append(files, file)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "pg_service.conf"))
+	}
+	return files
+}
+
+// Find the named service in the first service file that defines it.
+func lookupService(service string) (map[string]string, error) {
+	for _, file := range serviceFiles() {
+		settings, found, err := readServiceFile(file, service)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			log.Debugf("Using connection service %q from %s", service, file)
+			return settings, nil
+		}
+	}
+	return nil, fmt.Errorf("definition of service %q not found", service)
+}
+
+// Parse an INI style pg_service.conf and return the settings of one section.
+// A missing file is not an error; it simply does not define the service.
+func readServiceFile(file string, service string) (map[string]string, bool, error) {
+	handle, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer handle.Close()
+
+	var settings map[string]string
+	inService := false
+	scanner := bufio.NewScanner(handle)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			// libpq stops at the first section with the wanted name
+			if inService {
+				break
+			}
+			inService = strings.TrimSpace(line[1:len(line)-1]) == service
+			if inService {
+				settings = make(map[string]string)
+			}
+			continue
+		}
+		if !inService {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, false, fmt.Errorf("%s:%d: syntax error in service file", file, lineNo)
+		}
+		settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return settings, settings != nil, nil
+}
+
+// Locate the password file the way libpq does.
+func pgpassFile() string {
+	if file := os.Getenv("PGPASSFILE"); file != "" {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".pgpass")
+}
+
+// Look up the password for the connection in the password file. A missing
+// file yields an empty password and no error.
+func lookupPgpass(connString ConnString) (string, error) {
+	file := pgpassFile()
+	if file == "" {
+		return "", nil
+	}
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s has group or world access; permissions should be u=rw (0600) or less", file)
+	}
+
+	handle, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		if pgpassMatch(fields[0], connString.Hostname, "localhost") &&
+			pgpassMatch(fields[1], strconv.Itoa(connString.Port), "") &&
+			pgpassMatch(fields[2], connString.Database, "") &&
+			pgpassMatch(fields[3], connString.Username, "") {
+			log.Debugf("Using password from %s", file)
+			return fields[4], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// A pgpass field matches on a wildcard, an exact value or, for the host
+// field, "localhost" matching a Unix socket directory.
+func pgpassMatch(field string, value string, socketAlias string) bool {
+	if field == "*" || field == value {
+		return true
+	}
+	return socketAlias != "" && field == socketAlias && strings.HasPrefix(value, "/")
+}
+
+// Split a pgpass line on unescaped colons, removing the backslash escapes.
+func splitPgpassLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			field.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(c)
+		}
+	}
+	return append(fields, field.String())
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Clear every libpq variable the resolver looks at so the host environment
+// cannot leak into a test.
+func clearPGEnvironment(t *testing.T) {
+	for _, name := range []string{"PGHOST", "PGPORT", "PGUSER", "PGPASSWORD", "PGDATABASE",
+		"PGSERVICE", "PGSERVICEFILE", "PGSYSCONFDIR", "PGPASSFILE"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Setenv("HOME", t.TempDir())
+}
+
+func writeFile(t *testing.T, name string, contents string, perm os.FileMode) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), perm); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+func TestResolveConnStringPrecedence(t *testing.T) {
+	clearPGEnvironment(t)
+	t.Setenv("PGHOST", "envhost")
+	t.Setenv("PGPORT", "6000")
+	t.Setenv("PGUSER", "envuser")
+	t.Setenv("PGPASSWORD", "envpass")
+	t.Setenv("PGSERVICEFILE", writeFile(t, "pg_service.conf", `
+# comment
+[other]
+host=wrong
+
+[prod]
+host=servicehost
+dbname=servicedb
+`, 0600))
+
+	resolved, err := ResolveConnString(ConnString{Username: "flaguser"}, "prod")
+	if err != nil {
+		t.Fatalf("ResolveConnString failed: %v", err)
+	}
+
+	expected := ConnString{
+		Hostname: "servicehost",
+		Port:     6000,
+		Username: "flaguser",
+		Password: "envpass",
+		Database: "servicedb",
+	}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, resolved)
+	}
+	if _, ok := os.LookupEnv("PGSERVICEFILE"); ok {
+		t.Errorf("Expected PGSERVICEFILE to be removed from the environment")
+	}
+}
+
+func TestResolveConnStringDefaults(t *testing.T) {
+	clearPGEnvironment(t)
+
+	resolved, err := ResolveConnString(ConnString{}, "")
+	if err != nil {
+		t.Fatalf("ResolveConnString failed: %v", err)
+	}
+	expected := ConnString{Hostname: DefaultHostname, Port: DefaultPort, Username: DefaultUsername, Database: DefaultDatabase}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, resolved)
+	}
+}
+
+func TestResolveConnStringMissingService(t *testing.T) {
+	clearPGEnvironment(t)
+	t.Setenv("PGSERVICEFILE", writeFile(t, "pg_service.conf", "[prod]\nhost=cdw\n", 0600))
+
+	if _, err := ResolveConnString(ConnString{}, "staging"); err == nil {
+		t.Errorf("Expected an error for an undefined service")
+	}
+}
+
+func TestResolveConnStringPgpass(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		perm     os.FileMode
+		expected string
+	}{
+		{
+			name:     "exact match",
+			contents: "cdw:5432:template1:gpadmin:secret\n",
+			perm:     0600,
+			expected: "secret",
+		},
+		{
+			name:     "first match wins",
+			contents: "# comment\nother:*:*:*:nope\n*:*:*:gpadmin:wild\ncdw:5432:template1:gpadmin:late\n",
+			perm:     0600,
+			expected: "wild",
+		},
+		{
+			name:     "escaped colon",
+			contents: "cdw:5432:*:gpadmin:pa\\:ss\n",
+			perm:     0600,
+			expected: "pa:ss",
+		},
+		{
+			name:     "no match",
+			contents: "cdw:6000:*:*:secret\n",
+			perm:     0600,
+			expected: "",
+		},
+		{
+			name:     "insecure permissions ignored",
+			contents: "*:*:*:*:secret\n",
+			perm:     0644,
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clearPGEnvironment(t)
+			t.Setenv("PGPASSFILE", writeFile(t, "pgpass", tc.contents, tc.perm))
+
+			resolved, err := ResolveConnString(ConnString{Hostname: "cdw"}, "")
+			if err != nil {
+				t.Fatalf("ResolveConnString failed: %v", err)
+			}
+			if resolved.Password != tc.expected {
+				t.Errorf("Expected password %q, got %q", tc.expected, resolved.Password)
+			}
+		})
+	}
+}
+
+func TestRedactedURI(t *testing.T) {
+	connString := ConnString{Hostname: "cdw", Port: 5432, Username: "gpadmin", Password: "s3cr'et", Database: "postgres"}
+
+	if redacted := connString.redactedURI(); strings.Contains(redacted, "s3cr") {
+		t.Errorf("Expected the password to be masked, got %s", redacted)
+	}
+	if uri := connString.uri(); !strings.Contains(uri, `password='s3cr\'et'`) {
+		t.Errorf("Expected the password to be quoted and escaped, got %s", uri)
+	}
+	if uri := (ConnString{Hostname: "cdw"}).uri(); strings.Contains(uri, "password") {
+		t.Errorf("Expected an empty password to be omitted, got %s", uri)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/lib/pq"
+)
+
+// Sentinel errors describing why a connection could not be made. Callers
+// should test for them with errors.Is.
+var (
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrAuthFailed        = errors.New("authentication failed")
+	ErrDatabaseNotExist  = errors.New("database does not exist")
+	ErrTimeout           = errors.New("connection timed out")
+	ErrHostUnreachable   = errors.New("host unreachable")
+	ErrSSL               = errors.New("TLS negotiation failed")
+)
+
+// SQLSTATE codes that map onto our sentinel errors.
+const (
+	sqlStateInvalidAuthorization = "28000"
+	sqlStateInvalidPassword      = "28P01"
+	sqlStateInvalidCatalogName   = "3D000"
+	sqlStateCannotConnectNow     = "57P03"
+)
+
+// ConnectionError is returned by every pkg/db entry point that fails to reach
+// the database. Kind holds one of the sentinel errors above (or nil when the
+// failure could not be classified) and Err holds the underlying driver error.
+type ConnectionError struct {
+	Host     string
+	Port     int
+	Database string
+	Kind     error
+	Err      error
+}
+
+func (e *ConnectionError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("unable to connect to %s:%d/%s: %v: %v", e.Host, e.Port, e.Database, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("unable to connect to %s:%d/%s: %v", e.Host, e.Port, e.Database, e.Err)
+}
+
+// Unwrap exposes both the classification and the driver error so that
+// errors.Is and errors.As work against either of them.
+func (e *ConnectionError) Unwrap() []error {
+	if e.Kind != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Err}
+}
+
+// Wrap a driver error into a ConnectionError for the given connection details.
+func (connString ConnString) connectionError(err error) error {
+	return &ConnectionError{
+		Host:     connString.Hostname,
+		Port:     connString.Port,
+		Database: connString.Database,
+		Kind:     classifyConnectionError(err),
+		Err:      err,
+	}
+}
+
+// Map a driver or network error onto one of our sentinel errors.
+func classifyConnectionError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch string(pqErr.Code) {
+		case sqlStateInvalidAuthorization, sqlStateInvalidPassword:
+			return ErrAuthFailed
+		case sqlStateInvalidCatalogName:
+			return ErrDatabaseNotExist
+		case sqlStateCannotConnectNow:
+			return ErrConnectionRefused
+		}
+		return nil
+	}
+
+	if errors.Is(err, ErrSSL) || errors.Is(err, pq.ErrSSLNotSupported) {
+		return ErrSSL
+	}
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &certErr) || errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidCert) || errors.As(err, &recordErr) {
+		return ErrSSL
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrConnectionRefused
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+
+	// Any other failure to resolve or dial the host, such as no route to it
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) ||
+		(errors.As(err, &opErr) && opErr.Op == "dial") {
+		return ErrHostUnreachable
+	}
+
+	return nil
+}
+
+// Attach the context error to a failed query so callers can tell a timeout or
+// cancellation apart from an SQL error with errors.Is.
+func queryError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	return err
+}
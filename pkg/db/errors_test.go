@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestClassifyConnectionError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{
+			name:     "bad password",
+			err:      &pq.Error{Code: "28P01", Message: "password authentication failed"},
+			expected: ErrAuthFailed,
+		},
+		{
+			name:     "no pg_hba entry",
+			err:      &pq.Error{Code: "28000", Message: "no pg_hba.conf entry"},
+			expected: ErrAuthFailed,
+		},
+		{
+			name:     "missing database",
+			err:      &pq.Error{Code: "3D000", Message: `database "nope" does not exist`},
+			expected: ErrDatabaseNotExist,
+		},
+		{
+			name: "refused",
+			err: &net.OpError{Op: "dial", Net: "tcp",
+				Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}},
+			expected: ErrConnectionRefused,
+		},
+		{
+			name: "no route to host",
+			err: &net.OpError{Op: "dial", Net: "tcp",
+				Err: &os.SyscallError{Syscall: "connect", Err: syscall.EHOSTUNREACH}},
+			expected: ErrHostUnreachable,
+		},
+		{
+			name: "network unreachable",
+			err: &net.OpError{Op: "dial", Net: "tcp",
+				Err: &os.SyscallError{Syscall: "connect", Err: syscall.ENETUNREACH}},
+			expected: ErrHostUnreachable,
+		},
+		{
+			name: "unknown host",
+			err: &net.OpError{Op: "dial", Net: "tcp",
+				Err: &net.DNSError{Err: "no such host", Name: "cdw.invalid", IsNotFound: true}},
+			expected: ErrHostUnreachable,
+		},
+		{
+			name:     "deadline",
+			err:      fmt.Errorf("dial: %w", context.DeadlineExceeded),
+			expected: ErrTimeout,
+		},
+		{
+			name:     "unknown",
+			err:      errors.New("something else"),
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyConnectionError(tc.err); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConnectionErrorUnwrap(t *testing.T) {
+	driverErr := &pq.Error{Code: "28P01", Message: "password authentication failed"}
+	err := ConnString{Hostname: "cdw", Port: 5432, Database: "postgres"}.connectionError(driverErr)
+
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected errors.Is(err, ErrAuthFailed) to hold for %v", err)
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "28P01" {
+		t.Errorf("Expected the driver error to be reachable with errors.As, got %v", err)
+	}
+
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) || connErr.Host != "cdw" {
+		t.Errorf("Expected a *ConnectionError for host cdw, got %v", err)
+	}
+}
+
+func TestNewClientRefused(t *testing.T) {
+	// Grab a free port and close it again so nothing is listening there
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to reserve a local port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	_, err = NewClient(ConnString{Hostname: "127.0.0.1", Port: port, Username: "gpadmin", Database: "template1"})
+	if !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("Expected ErrConnectionRefused, got %v", err)
+	}
+}
+
+func TestNewClientUnresolvable(t *testing.T) {
+	_, err := NewClient(ConnString{Hostname: "cdw.invalid", Port: 5432, Username: "gpadmin", Database: "template1"})
+	if !errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("Expected ErrHostUnreachable, got %v", err)
+	}
+	if !retryable(err) {
+		t.Errorf("Expected an unresolvable host to be retried")
+	}
+}
@@ -0,0 +1,29 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import "context"
+
+// Querier is the read-only query surface the gpmt tools depend on. *Client
+// implements it against a live database and dbtest.Querier implements it
+// with canned results, so tools should accept a Querier rather than a
+// *Client wherever they only need to read.
+type Querier interface {
+	// ExecuteQueryContext runs query with optional bind arguments and
+	// buffers the result.
+	ExecuteQueryContext(ctx context.Context, query string, args ...interface{}) (*Result, error)
+
+	// Each calls fn for every row of query; see Client.Each.
+	Each(ctx context.Context, query string, fn func(Row) error, args ...interface{}) error
+
+	// ServerInfo describes the server being queried.
+	ServerInfo(ctx context.Context) (*ServerInfo, error)
+}
+
+var _ Querier = (*Client)(nil)
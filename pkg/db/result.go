@@ -0,0 +1,460 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNull is returned by the non-nullable Row accessors when the value is NULL.
+var ErrNull = errors.New("value is NULL")
+
+// Column describes one column of a result set.
+type Column struct {
+	Name string
+	// DatabaseType is the driver's type name, e.g. "TEXT", "INT4" or "_TEXT".
+	DatabaseType string
+}
+
+// Result holds a fully buffered result set with its columns in query order.
+type Result struct {
+	Columns []Column
+	Rows    []Row
+}
+
+// Row is a single result row. Values are decoded by MetalScanner, so they are
+// nil, int64, float64, bool, string, time.Time or one of the richer types it
+// documents for numeric, array, interval, network and JSON columns.
+type Row struct {
+	columns []Column
+	values  []interface{}
+}
+
+// NewResult builds a Result from already decoded values, one slice per row
+// holding a value for each column in order. It is mainly useful for fakes and tests.
+func NewResult(columns []Column, rows ...[]interface{}) *Result {
+	result := &Result{Columns: columns}
+	for _, values := range rows {
+		result.Rows = append(result.Rows, Row{columns: columns, values: values})
+	}
+	return result
+}
+
+// Read the column metadata of a result set.
+func readColumns(rows *sql.Rows) ([]Column, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]Column, len(types))
+	for idx, columnType := range types {
+		columns[idx] = Column{Name: columnType.Name(), DatabaseType: columnType.DatabaseTypeName()}
+	}
+	return columns, nil
+}
+
+// Scan the current row of rows into a Row sharing the given columns.
+func scanRow(rows *sql.Rows, columns []Column) (Row, error) {
+	// Create a scanner per column so that every value is decoded the
+	// same way regardless of its type
+	scanners := make([]interface{}, len(columns))
+	for idx, column := range columns {
+		scanners[idx] = NewMetalScanner(column.DatabaseType)
+	}
+	if err := rows.Scan(scanners...); err != nil {
+		return Row{}, err
+	}
+
+	values := make([]interface{}, len(columns))
+	for idx, scanner := range scanners {
+		values[idx] = scanner.(*MetalScanner).value
+	}
+	return Row{columns: columns, values: values}, nil
+}
+
+// Buffer a whole result set.
+func readResult(rows *sql.Rows) (*Result, error) {
+	columns, err := readColumns(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: columns}
+	for rows.Next() {
+		row, err := scanRow(rows, columns)
+		if err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, rows.Err()
+}
+
+// ColumnNames returns the column names in query order.
+func (result *Result) ColumnNames() []string {
+	names := make([]string, len(result.Columns))
+	for idx, column := range result.Columns {
+		names[idx] = column.Name
+	}
+	return names
+}
+
+// Len returns the number of rows.
+func (result *Result) Len() int {
+	return len(result.Rows)
+}
+
+// ScanStructs appends every row to the slice dest points to. See
+// Row.ScanStruct for how columns are matched to fields.
+func (result *Result) ScanStructs(dest interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("ScanStructs needs a pointer to a slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	for _, row := range result.Rows {
+		elem := reflect.New(elemType)
+		if err := row.ScanStruct(elem.Interface()); err != nil {
+			return err
+		}
+		if isPtr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+	return nil
+}
+
+// Columns returns the row's columns in query order.
+func (row Row) Columns() []Column {
+	return row.columns
+}
+
+// Values returns the row's values in column order.
+func (row Row) Values() []interface{} {
+	return row.values
+}
+
+// Value returns the raw value of the named column.
+func (row Row) Value(name string) (interface{}, error) {
+	for idx, column := range row.columns {
+		if column.Name == name && idx < len(row.values) {
+			return row.values[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("column %q is not in the result", name)
+}
+
+// String returns the named column as a string. Non-text values are formatted
+// with fmt.
+func (row Row) String(name string) (string, error) {
+	value, err := row.nonNull(name)
+	if err != nil {
+		return "", err
+	}
+	return asString(value), nil
+}
+
+// Int64 returns the named column as an int64.
+func (row Row) Int64(name string) (int64, error) {
+	value, err := row.nonNull(name)
+	if err != nil {
+		return 0, err
+	}
+	converted, err := asInt64(value)
+	if err != nil {
+		return 0, fmt.Errorf("column %q: %w", name, err)
+	}
+	return converted, nil
+}
+
+// Float64 returns the named column as a float64.
+func (row Row) Float64(name string) (float64, error) {
+	value, err := row.nonNull(name)
+	if err != nil {
+		return 0, err
+	}
+	converted, err := asFloat64(value)
+	if err != nil {
+		return 0, fmt.Errorf("column %q: %w", name, err)
+	}
+	return converted, nil
+}
+
+// Bool returns the named column as a bool.
+func (row Row) Bool(name string) (bool, error) {
+	value, err := row.nonNull(name)
+	if err != nil {
+		return false, err
+	}
+	converted, err := asBool(value)
+	if err != nil {
+		return false, fmt.Errorf("column %q: %w", name, err)
+	}
+	return converted, nil
+}
+
+// Time returns the named column as a time.Time.
+func (row Row) Time(name string) (time.Time, error) {
+	value, err := row.nonNull(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	converted, ok := value.(time.Time)
+	if !ok {
+		return time.Time{}, fmt.Errorf("column %q: cannot convert %T to time.Time", name, value)
+	}
+	return converted, nil
+}
+
+// NullString returns the named column as a sql.NullString.
+func (row Row) NullString(name string) (sql.NullString, error) {
+	value, err := row.String(name)
+	if errors.Is(err, ErrNull) {
+		return sql.NullString{}, nil
+	}
+	return sql.NullString{String: value, Valid: err == nil}, err
+}
+
+// NullInt64 returns the named column as a sql.NullInt64.
+func (row Row) NullInt64(name string) (sql.NullInt64, error) {
+	value, err := row.Int64(name)
+	if errors.Is(err, ErrNull) {
+		return sql.NullInt64{}, nil
+	}
+	return sql.NullInt64{Int64: value, Valid: err == nil}, err
+}
+
+// NullFloat64 returns the named column as a sql.NullFloat64.
+func (row Row) NullFloat64(name string) (sql.NullFloat64, error) {
+	value, err := row.Float64(name)
+	if errors.Is(err, ErrNull) {
+		return sql.NullFloat64{}, nil
+	}
+	return sql.NullFloat64{Float64: value, Valid: err == nil}, err
+}
+
+// NullBool returns the named column as a sql.NullBool.
+func (row Row) NullBool(name string) (sql.NullBool, error) {
+	value, err := row.Bool(name)
+	if errors.Is(err, ErrNull) {
+		return sql.NullBool{}, nil
+	}
+	return sql.NullBool{Bool: value, Valid: err == nil}, err
+}
+
+// NullTime returns the named column as a sql.NullTime.
+func (row Row) NullTime(name string) (sql.NullTime, error) {
+	value, err := row.Time(name)
+	if errors.Is(err, ErrNull) {
+		return sql.NullTime{}, nil
+	}
+	return sql.NullTime{Time: value, Valid: err == nil}, err
+}
+
+// ScanStruct copies the row into the struct dest points to. A field is filled
+// from the column named in its `db` tag, or failing that the column whose
+// name matches the field name case-insensitively. Fields tagged `db:"-"` and
+// columns without a matching field are skipped. Pointer and sql.Scanner
+// fields accept NULL; other fields return ErrNull for it.
+func (row Row) ScanStruct(dest interface{}) error {
+	target := reflect.ValueOf(dest)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("ScanStruct needs a pointer to a struct, got %T", dest)
+	}
+	target = target.Elem()
+	structType := target.Type()
+
+	for idx := 0; idx < structType.NumField(); idx++ {
+		field := structType.Field(idx)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("db")
+		if name == "-" {
+			continue
+		}
+
+		colIdx := -1
+		for candidate, column := range row.columns {
+			if (name != "" && column.Name == name) || (name == "" && strings.EqualFold(column.Name, field.Name)) {
+				colIdx = candidate
+				break
+			}
+		}
+		if colIdx < 0 || colIdx >= len(row.values) {
+			continue
+		}
+
+		if err := assignValue(target.Field(idx), row.values[colIdx]); err != nil {
+			return fmt.Errorf("column %q into field %s: %w", row.columns[colIdx].Name, field.Name, err)
+		}
+	}
+	return nil
+}
+
+// Look up a column and reject NULL.
+func (row Row) nonNull(name string) (interface{}, error) {
+	value, err := row.Value(name)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("column %q: %w", name, ErrNull)
+	}
+	return value, nil
+}
+
+// Store a decoded value into a struct field, converting where it is safe.
+func assignValue(field reflect.Value, value interface{}) error {
+	if scanner, ok := field.Addr().Interface().(sql.Scanner); ok {
+		return scanner.Scan(value)
+	}
+
+	if field.Kind() == reflect.Ptr {
+		if value == nil {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		elem := reflect.New(field.Type().Elem())
+		if err := assignValue(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	if value == nil {
+		return ErrNull
+	}
+
+	// Anything directly assignable (time.Time, slices produced by the
+	// scanner, ...) is copied as is.
+	if reflect.TypeOf(value).AssignableTo(field.Type()) {
+		field.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(asString(value))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		converted, err := asInt64(value)
+		if err != nil {
+			return err
+		}
+		if field.OverflowInt(converted) {
+			return fmt.Errorf("value %d overflows %s", converted, field.Type())
+		}
+		field.SetInt(converted)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		converted, err := asInt64(value)
+		if err != nil {
+			return err
+		}
+		if converted < 0 || field.OverflowUint(uint64(converted)) {
+			return fmt.Errorf("value %d overflows %s", converted, field.Type())
+		}
+		field.SetUint(uint64(converted))
+	case reflect.Float32, reflect.Float64:
+		converted, err := asFloat64(value)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(converted)
+	case reflect.Bool:
+		converted, err := asBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(converted)
+	default:
+		return fmt.Errorf("cannot convert %T to %s", value, field.Type())
+	}
+	return nil
+}
+
+func asString(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case []byte:
+		return string(typed)
+	case json.RawMessage:
+		return string(typed)
+	case time.Time:
+		return typed.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return typed.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func asInt64(value interface{}) (int64, error) {
+	switch typed := value.(type) {
+	case int64:
+		return typed, nil
+	case Numeric:
+		return typed.Int64()
+	case float64:
+		// math.MaxInt64 rounds up to 2^63 as a float64, which does not fit
+		if typed != math.Trunc(typed) || typed >= 1<<63 || typed < math.MinInt64 {
+			return 0, fmt.Errorf("value %v is not an integer", typed)
+		}
+		return int64(typed), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(typed), 10, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %T to int64", value)
+}
+
+func asFloat64(value interface{}) (float64, error) {
+	switch typed := value.(type) {
+	case float64:
+		return typed, nil
+	case int64:
+		return float64(typed), nil
+	case Numeric:
+		return typed.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(typed), 64)
+	}
+	return 0, fmt.Errorf("cannot convert %T to float64", value)
+}
+
+func asBool(value interface{}) (bool, error) {
+	switch typed := value.(type) {
+	case bool:
+		return typed, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(typed)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+		return false, fmt.Errorf("value %q is not a boolean", typed)
+	}
+	return false, fmt.Errorf("cannot convert %T to bool", value)
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func sampleResult() *Result {
+	columns := []Column{
+		{Name: "dbid", DatabaseType: "INT2"},
+		{Name: "hostname", DatabaseType: "TEXT"},
+		{Name: "preferred", DatabaseType: "BOOL"},
+		{Name: "updated", DatabaseType: "TIMESTAMPTZ"},
+		{Name: "mirror", DatabaseType: "TEXT"},
+		{Name: "size", DatabaseType: "NUMERIC"},
+	}
+	updated := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &Result{
+		Columns: columns,
+		Rows: []Row{
+			{columns: columns, values: []interface{}{int64(1), "cdw", true, updated, nil, "1024"}},
+			{columns: columns, values: []interface{}{int64(2), "sdw1", "f", updated, "sdw2", float64(2048)}},
+		},
+	}
+}
+
+func TestResultColumnOrder(t *testing.T) {
+	names := sampleResult().ColumnNames()
+	expected := []string{"dbid", "hostname", "preferred", "updated", "mirror", "size"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %d columns, got %d", len(expected), len(names))
+	}
+	for idx := range expected {
+		if names[idx] != expected[idx] {
+			t.Errorf("Expected column %d to be %s, got %s", idx, expected[idx], names[idx])
+		}
+	}
+}
+
+func TestRowAccessors(t *testing.T) {
+	first, second := sampleResult().Rows[0], sampleResult().Rows[1]
+
+	if v, err := first.Int64("dbid"); err != nil || v != 1 {
+		t.Errorf("Int64: expected 1, got %v (%v)", v, err)
+	}
+	if v, err := first.String("hostname"); err != nil || v != "cdw" {
+		t.Errorf("String: expected cdw, got %v (%v)", v, err)
+	}
+	if v, err := first.Bool("preferred"); err != nil || !v {
+		t.Errorf("Bool: expected true, got %v (%v)", v, err)
+	}
+	if v, err := second.Bool("preferred"); err != nil || v {
+		t.Errorf("Bool from text: expected false, got %v (%v)", v, err)
+	}
+	if v, err := first.Time("updated"); err != nil || v.Year() != 2025 {
+		t.Errorf("Time: expected 2025, got %v (%v)", v, err)
+	}
+	if v, err := first.Int64("size"); err != nil || v != 1024 {
+		t.Errorf("Int64 from numeric text: expected 1024, got %v (%v)", v, err)
+	}
+	if v, err := second.Int64("size"); err != nil || v != 2048 {
+		t.Errorf("Int64 from float: expected 2048, got %v (%v)", v, err)
+	}
+
+	if _, err := first.String("mirror"); !errors.Is(err, ErrNull) {
+		t.Errorf("Expected ErrNull for a NULL column, got %v", err)
+	}
+	if v, err := first.NullString("mirror"); err != nil || v.Valid {
+		t.Errorf("NullString: expected invalid, got %+v (%v)", v, err)
+	}
+	if v, err := second.NullString("mirror"); err != nil || !v.Valid || v.String != "sdw2" {
+		t.Errorf("NullString: expected sdw2, got %+v (%v)", v, err)
+	}
+	if _, err := first.String("nope"); err == nil {
+		t.Errorf("Expected an error for an unknown column")
+	}
+	if _, err := first.Int64("hostname"); err == nil {
+		t.Errorf("Expected an error converting text to int64")
+	}
+}
+
+func TestAsInt64Float(t *testing.T) {
+	testCases := []struct {
+		value       float64
+		expected    int64
+		expectError bool
+	}{
+		{value: 2048, expected: 2048},
+		{value: math.MinInt64, expected: math.MinInt64},
+		{value: math.Nextafter(1<<63, 0), expected: 1<<63 - 1024},
+		{value: 1 << 63, expectError: true},
+		{value: math.Inf(-1), expectError: true},
+		{value: 0.5, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		value, err := asInt64(tc.value)
+		if tc.expectError && err == nil {
+			t.Errorf("Expected an error converting %v, got %d", tc.value, value)
+		} else if !tc.expectError && (err != nil || value != tc.expected) {
+			t.Errorf("Expected %d, got %d (%v)", tc.expected, value, err)
+		}
+	}
+}
+
+func TestScanStructs(t *testing.T) {
+	type segment struct {
+		DBID      int16  `db:"dbid"`
+		Host      string `db:"hostname"`
+		Preferred bool
+		Updated   time.Time `db:"updated"`
+		Mirror    *string   `db:"mirror"`
+		Size      sql.NullInt64
+		Ignored   string `db:"-"`
+	}
+
+	var segments []segment
+	if err := sampleResult().ScanStructs(&segments); err != nil {
+		t.Fatalf("ScanStructs failed: %v", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(segments))
+	}
+	if segments[0].DBID != 1 || segments[0].Host != "cdw" || !segments[0].Preferred || segments[0].Mirror != nil {
+		t.Errorf("Unexpected first row %+v", segments[0])
+	}
+	if segments[1].Mirror == nil || *segments[1].Mirror != "sdw2" || segments[1].Preferred {
+		t.Errorf("Unexpected second row %+v", segments[1])
+	}
+	if !segments[0].Size.Valid || segments[0].Size.Int64 != 1024 {
+		t.Errorf("Expected Size to be scanned through sql.Scanner, got %+v", segments[0].Size)
+	}
+
+	var pointers []*segment
+	if err := sampleResult().ScanStructs(&pointers); err != nil || len(pointers) != 2 {
+		t.Errorf("Expected ScanStructs into []*segment to work, got %d rows (%v)", len(pointers), err)
+	}
+}
+
+func TestScanStructErrors(t *testing.T) {
+	row := sampleResult().Rows[0]
+
+	var notNullable struct {
+		Mirror string `db:"mirror"`
+	}
+	if err := row.ScanStruct(&notNullable); !errors.Is(err, ErrNull) {
+		t.Errorf("Expected ErrNull scanning NULL into a string, got %v", err)
+	}
+
+	var tooSmall struct {
+		Size int8 `db:"size"`
+	}
+	if err := row.ScanStruct(&tooSmall); err == nil {
+		t.Errorf("Expected an overflow error")
+	}
+
+	var notStruct int
+	if err := row.ScanStruct(&notStruct); err == nil {
+		t.Errorf("Expected an error for a non-struct destination")
+	}
+}
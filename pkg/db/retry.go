@@ -0,0 +1,101 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backoff limits used when the ConnString does not set its own.
+const (
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// Connect to the coordinator, retrying with exponential backoff and falling
+// over to the standby coordinator when one is configured. Errors that another
+// attempt cannot fix, such as a bad password, are returned straight away.
+func connectWithRetry(ctx context.Context, connString ConnString) (*Client, error) {
+	candidates := []ConnString{connString}
+	if standby, ok := connString.standby(); ok {
+		candidates = append(candidates, standby)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= connString.Retries; attempt++ {
+		if attempt > 0 {
+			delay := connString.retryDelay(attempt)
+			log.Warnf("Unable to connect (%v); retrying in %v (attempt %d of %d)", lastErr, delay, attempt, connString.Retries)
+			select {
+			case <-ctx.Done():
+				return nil, connString.connectionError(ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+
+		for idx, candidate := range candidates {
+			if idx > 0 {
+				log.Warnf("Coordinator %s:%d is unavailable, trying standby %s:%d",
+					connString.Hostname, connString.Port, candidate.Hostname, candidate.Port)
+			}
+			client, err := connectOnce(ctx, candidate)
+			if err == nil {
+				return client, nil
+			}
+			lastErr = err
+			if !retryable(err) || ctx.Err() != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// The standby coordinator's connection details, if one is configured.
+func (connString ConnString) standby() (ConnString, bool) {
+	if connString.StandbyHostname == "" {
+		return ConnString{}, false
+	}
+	standby := connString
+	standby.Hostname = connString.StandbyHostname
+	if connString.StandbyPort != 0 {
+		standby.Port = connString.StandbyPort
+	}
+	standby.StandbyHostname = ""
+	standby.StandbyPort = 0
+	return standby, true
+}
+
+// The delay before the given retry: the backoff doubled for every earlier
+// retry, capped at maxRetryBackoff.
+func (connString ConnString) retryDelay(attempt int) time.Duration {
+	delay := connString.RetryBackoff
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+	for idx := 1; idx < attempt && delay < maxRetryBackoff; idx++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// Only failures that can clear up on their own are worth retrying: the
+// server refusing connections (down, restarting, or in recovery), timeouts,
+// and a host that cannot be resolved or reached, which the standby may well
+// be.
+func retryable(err error) bool {
+	return errors.Is(err, ErrConnectionRefused) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrHostUnreachable)
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	connString := ConnString{RetryBackoff: 500 * time.Millisecond}
+	expected := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second}
+	for idx, delay := range expected {
+		if got := connString.retryDelay(idx + 1); got != delay {
+			t.Errorf("Expected retry %d to wait %v, got %v", idx+1, delay, got)
+		}
+	}
+	if got := connString.retryDelay(20); got != maxRetryBackoff {
+		t.Errorf("Expected the delay to be capped at %v, got %v", maxRetryBackoff, got)
+	}
+	if got := (ConnString{}).retryDelay(1); got != defaultRetryBackoff {
+		t.Errorf("Expected the default backoff %v, got %v", defaultRetryBackoff, got)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	if _, ok := (ConnString{Hostname: "cdw"}).standby(); ok {
+		t.Errorf("Expected no standby without --standby-host")
+	}
+
+	standby, ok := ConnString{Hostname: "cdw", Port: 5432, StandbyHostname: "scdw"}.standby()
+	if !ok || standby.Hostname != "scdw" || standby.Port != 5432 || standby.StandbyHostname != "" {
+		t.Errorf("Unexpected standby %+v", standby)
+	}
+
+	standby, _ = ConnString{Hostname: "cdw", Port: 5432, StandbyHostname: "scdw", StandbyPort: 6432}.standby()
+	if standby.Port != 6432 {
+		t.Errorf("Expected standby port 6432, got %d", standby.Port)
+	}
+}
+
+func TestConnectWithRetryGivesUp(t *testing.T) {
+	connString := ConnString{
+		Hostname:        "127.0.0.1",
+		Port:            1,
+		StandbyHostname: "127.0.0.1",
+		StandbyPort:     2,
+		Retries:         2,
+		RetryBackoff:    time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := connectWithRetry(context.Background(), connString)
+	if !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("Expected ErrConnectionRefused after retrying, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("Expected to back off between attempts, finished in %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	connString.RetryBackoff = time.Hour
+	if _, err := connectWithRetry(ctx, connString); err == nil {
+		t.Errorf("Expected a cancelled context to stop the retries")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrStopIteration can be returned from an Each callback to stop reading rows
+// early without Each reporting an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// Rows streams a result set one row at a time so that only the current row
+// is held in memory. It must be closed, which is safe to do before all rows
+// have been read.
+type Rows struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	rows    *sql.Rows
+	columns []Column
+	row     Row
+	err     error
+	done    bool
+}
+
+// QueryRows executes query and returns an iterator over its rows instead of
+// buffering them. Use it for queries whose result may not fit in memory, such
+// as the log tables.
+func (client *Client) QueryRows(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	log.Debug("Executing the streaming statement: " + query)
+	return client.stream(ctx, func(ctx context.Context) (*sql.Rows, error) {
+		return client.db.QueryContext(ctx, query, args...)
+	})
+}
+
+// Each calls fn for every row of query in order. If fn returns an error the
+// remaining rows are abandoned and the error returned, except for
+// ErrStopIteration which makes Each return nil.
+func (client *Client) Each(ctx context.Context, query string, fn func(Row) error, args ...interface{}) error {
+	rows, err := client.QueryRows(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return rows.each(fn)
+}
+
+// QueryRows executes the prepared statement and returns an iterator over its
+// rows.
+func (stmt *Stmt) QueryRows(ctx context.Context, args ...interface{}) (*Rows, error) {
+	log.Debug("Executing the streaming prepared statement: " + stmt.query)
+	return stmt.client.stream(ctx, func(ctx context.Context) (*sql.Rows, error) {
+		return stmt.stmt.QueryContext(ctx, args...)
+	})
+}
+
+// Each is Client.Each for a prepared statement.
+func (stmt *Stmt) Each(ctx context.Context, fn func(Row) error, args ...interface{}) error {
+	rows, err := stmt.QueryRows(ctx, args...)
+	if err != nil {
+		return err
+	}
+	return rows.each(fn)
+}
+
+// Start a query whose rows are read lazily. The query context lives as long
+// as the iterator.
+func (client *Client) stream(ctx context.Context, query func(context.Context) (*sql.Rows, error)) (*Rows, error) {
+	ctx, cancel := client.queryContext(ctx)
+
+	rows, err := query(ctx)
+	if err != nil {
+		cancel()
+		return nil, queryError(ctx, err)
+	}
+
+	columns, err := readColumns(rows)
+	if err != nil {
+		rows.Close()
+		cancel()
+		return nil, queryError(ctx, err)
+	}
+
+	return &Rows{ctx: ctx, cancel: cancel, rows: rows, columns: columns}, nil
+}
+
+// Columns returns the result's columns in query order.
+func (rows *Rows) Columns() []Column {
+	return rows.columns
+}
+
+// Next advances to the next row, returning false at the end of the result or
+// on error. Check Err afterwards.
+func (rows *Rows) Next() bool {
+	if rows.done {
+		return false
+	}
+	if !rows.rows.Next() {
+		rows.done = true
+		rows.err = queryError(rows.ctx, rows.rows.Err())
+		return false
+	}
+
+	rows.row, rows.err = scanRow(rows.rows, rows.columns)
+	if rows.err != nil {
+		rows.done = true
+		return false
+	}
+	return true
+}
+
+// Row returns the current row. It is only valid until the next call to Next.
+func (rows *Rows) Row() Row {
+	return rows.row
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+// Close releases the connection. If rows remain unread the statement is
+// cancelled on the server first, rather than reading and discarding the rest
+// of a potentially huge result.
+func (rows *Rows) Close() error {
+	if !rows.done {
+		rows.done = true
+		rows.cancel()
+		// The driver reports the cancellation we just asked for; that is
+		// not an error from the caller's point of view.
+		rows.rows.Close()
+		return nil
+	}
+	defer rows.cancel()
+	return rows.rows.Close()
+}
+
+// Feed every row to fn and close the iterator.
+func (rows *Rows) each(fn func(Row) error) error {
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows.Row()); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,423 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetalScanner decodes a single column into a Go value. The driver already
+// decodes integers, floats, booleans, text and timestamps; everything else
+// arrives as text and is decoded here based on the column's database type:
+//
+//	NUMERIC                     Numeric
+//	OID, XID, CID               int64
+//	INT2VECTOR, OIDVECTOR       []int64
+//	INTERVAL                    Interval, or string in other IntervalStyles
+//	INET, CIDR                  *net.IPNet
+//	JSON, JSONB                 json.RawMessage
+//	BYTEA                       []byte
+//	_INT2, _INT4, _INT8, _OID   []int64
+//	_FLOAT4, _FLOAT8            []float64
+//	_BOOL                       []bool
+//	_NUMERIC                    []Numeric
+//	other arrays                []string
+//	multi-dimensional arrays    string
+//	anything else               string
+//
+// NULL elements inside arrays decode to the element's zero value.
+type MetalScanner struct {
+	valid  bool
+	value  interface{}
+	dbType string
+}
+
+// NewMetalScanner returns a scanner for a column of the given database type
+// name, as reported by sql.ColumnType.DatabaseTypeName.
+func NewMetalScanner(dbType string) *MetalScanner {
+	return &MetalScanner{dbType: dbType}
+}
+
+// Value returns the decoded value and whether Scan has been called.
+func (scanner *MetalScanner) Value() (interface{}, bool) {
+	return scanner.value, scanner.valid
+}
+
+// Scan the column data type and send back its value.
+func (scanner *MetalScanner) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		scanner.value = nil
+	case int64, float64, bool, time.Time:
+		scanner.value = value
+	case string:
+		decoded, err := decodeText(scanner.dbType, value)
+		if err != nil {
+			return err
+		}
+		scanner.value = decoded
+	case []byte:
+		if scanner.dbType == "BYTEA" {
+			// The driver reuses its buffer, so keep our own copy
+			scanner.value = append([]byte(nil), value...)
+			break
+		}
+		decoded, err := decodeText(scanner.dbType, string(value))
+		if err != nil {
+			return err
+		}
+		scanner.value = decoded
+	default:
+		return fmt.Errorf("unsupported driver value %T for %s column", src, scanner.dbType)
+	}
+	scanner.valid = true
+	return nil
+}
+
+// Numeric holds an arbitrary precision NUMERIC value in its text form so no
+// precision is lost.
+type Numeric string
+
+// String returns the value as printed by the server.
+func (numeric Numeric) String() string {
+	return string(numeric)
+}
+
+// Rat returns the exact value. It fails for NaN.
+func (numeric Numeric) Rat() (*big.Rat, error) {
+	rat, ok := new(big.Rat).SetString(string(numeric))
+	if !ok {
+		return nil, fmt.Errorf("numeric %q has no exact value", string(numeric))
+	}
+	return rat, nil
+}
+
+// Float64 returns the nearest float64.
+func (numeric Numeric) Float64() (float64, error) {
+	return strconv.ParseFloat(string(numeric), 64)
+}
+
+// Int64 returns the value if it is a whole number that fits in an int64.
+func (numeric Numeric) Int64() (int64, error) {
+	rat, err := numeric.Rat()
+	if err != nil {
+		return 0, err
+	}
+	if !rat.IsInt() || !rat.Num().IsInt64() {
+		return 0, fmt.Errorf("numeric %s is not an int64", string(numeric))
+	}
+	return rat.Num().Int64(), nil
+}
+
+// Interval mirrors the server's representation of an INTERVAL, which cannot be
+// expressed as a time.Duration because months and days vary in length.
+type Interval struct {
+	Months       int64
+	Days         int64
+	Microseconds int64
+}
+
+// Duration approximates the interval assuming 30 day months and 24 hour days,
+// the same convention the server uses for justify_interval.
+func (interval Interval) Duration() time.Duration {
+	days := interval.Months*30 + interval.Days
+	return time.Duration(days)*24*time.Hour + time.Duration(interval.Microseconds)*time.Microsecond
+}
+
+// String formats the interval the way the server does by default.
+func (interval Interval) String() string {
+	var parts []string
+	years, months := interval.Months/12, interval.Months%12
+	for _, part := range []struct {
+		value int64
+		unit  string
+	}{{years, "year"}, {months, "mon"}, {interval.Days, "day"}} {
+		if part.value == 1 || part.value == -1 {
+			parts = append(parts, fmt.Sprintf("%d %s", part.value, part.unit))
+		} else if part.value != 0 {
+			parts = append(parts, fmt.Sprintf("%d %ss", part.value, part.unit))
+		}
+	}
+	if interval.Microseconds != 0 || len(parts) == 0 {
+		micros := interval.Microseconds
+		sign := ""
+		if micros < 0 {
+			sign, micros = "-", -micros
+		}
+		clock := fmt.Sprintf("%s%02d:%02d:%02d", sign, micros/3600e6, micros/60e6%60, micros/1e6%60)
+		if fraction := micros % 1e6; fraction != 0 {
+			clock += strings.TrimRight(fmt.Sprintf(".%06d", fraction), "0")
+		}
+		parts = append(parts, clock)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Decode the text form of a value of the given database type.
+func decodeText(dbType string, text string) (interface{}, error) {
+	switch dbType {
+	case "NUMERIC":
+		return Numeric(text), nil
+	case "OID", "XID", "CID":
+		return strconv.ParseInt(text, 10, 64)
+	case "INT2VECTOR", "OIDVECTOR":
+		return decodeVector(text)
+	case "INTERVAL":
+		// The session may use the iso_8601 or sql_standard IntervalStyle,
+		// which is kept as the server formatted it
+		if interval, err := parseInterval(text); err == nil {
+			return interval, nil
+		}
+		return text, nil
+	case "INET", "CIDR":
+		return parseInet(text)
+	case "JSON", "JSONB":
+		return json.RawMessage(text), nil
+	case "BYTEA":
+		return []byte(text), nil
+	}
+	if strings.HasPrefix(dbType, "_") {
+		// Multi-dimensional arrays are kept as the server formatted them
+		values, err := decodeArray(dbType[1:], text)
+		if errors.Is(err, errMultiDimensionalArray) {
+			return text, nil
+		}
+		return values, err
+	}
+	return text, nil
+}
+
+// Decode the space separated int2vector/oidvector form.
+func decodeVector(text string) ([]int64, error) {
+	fields := strings.Fields(text)
+	values := make([]int64, len(fields))
+	for idx, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector element %q: %w", field, err)
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+// Decode a one-dimensional array literal into a typed slice.
+func decodeArray(elemType string, text string) (interface{}, error) {
+	elems, err := parseArrayLiteral(text)
+	if err != nil {
+		return nil, err
+	}
+
+	switch elemType {
+	case "INT2", "INT4", "INT8", "OID":
+		values := make([]int64, len(elems))
+		for idx, elem := range elems {
+			if elem == nil {
+				continue
+			}
+			if values[idx], err = strconv.ParseInt(*elem, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid array element %q: %w", *elem, err)
+			}
+		}
+		return values, nil
+	case "FLOAT4", "FLOAT8":
+		values := make([]float64, len(elems))
+		for idx, elem := range elems {
+			if elem == nil {
+				continue
+			}
+			if values[idx], err = strconv.ParseFloat(*elem, 64); err != nil {
+				return nil, fmt.Errorf("invalid array element %q: %w", *elem, err)
+			}
+		}
+		return values, nil
+	case "BOOL":
+		values := make([]bool, len(elems))
+		for idx, elem := range elems {
+			values[idx] = elem != nil && *elem == "t"
+		}
+		return values, nil
+	case "NUMERIC":
+		values := make([]Numeric, len(elems))
+		for idx, elem := range elems {
+			if elem != nil {
+				values[idx] = Numeric(*elem)
+			}
+		}
+		return values, nil
+	}
+
+	values := make([]string, len(elems))
+	for idx, elem := range elems {
+		if elem != nil {
+			values[idx] = *elem
+		}
+	}
+	return values, nil
+}
+
+// Returned by parseArrayLiteral for arrays of more than one dimension
+var errMultiDimensionalArray = errors.New("multi-dimensional arrays are not supported")
+
+// Split a one-dimensional array literal such as {a,"b c",NULL} into its
+// elements. A nil element is an SQL NULL.
+func parseArrayLiteral(text string) ([]*string, error) {
+	// Arrays with non-default lower bounds are prefixed with their
+	// dimensions, e.g. [0:1]={1,2}
+	if strings.HasPrefix(text, "[") {
+		if idx := strings.Index(text, "="); idx >= 0 {
+			text = text[idx+1:]
+		}
+	}
+	if len(text) < 2 || text[0] != '{' || text[len(text)-1] != '}' {
+		return nil, fmt.Errorf("invalid array literal %q", text)
+	}
+	body := text[1 : len(text)-1]
+	if body == "" {
+		return []*string{}, nil
+	}
+	if strings.HasPrefix(body, "{") {
+		return nil, fmt.Errorf("%w: %q", errMultiDimensionalArray, text)
+	}
+
+	var elems []*string
+	for pos := 0; pos <= len(body); {
+		var elem strings.Builder
+		quoted := false
+		if pos < len(body) && body[pos] == '"' {
+			quoted = true
+			pos++
+			for ; pos < len(body) && body[pos] != '"'; pos++ {
+				if body[pos] == '\\' && pos+1 < len(body) {
+					pos++
+				}
+				elem.WriteByte(body[pos])
+			}
+			if pos >= len(body) {
+				return nil, fmt.Errorf("unterminated quoted element in %q", text)
+			}
+			pos++
+		} else {
+			for ; pos < len(body) && body[pos] != ','; pos++ {
+				elem.WriteByte(body[pos])
+			}
+		}
+		if pos < len(body) && body[pos] != ',' {
+			return nil, fmt.Errorf("unexpected %q in array literal %q", body[pos], text)
+		}
+		pos++
+
+		value := elem.String()
+		if !quoted && value == "NULL" {
+			elems = append(elems, nil)
+		} else {
+			elems = append(elems, &value)
+		}
+	}
+	return elems, nil
+}
+
+// Parse the default (postgres) IntervalStyle output, e.g.
+// "1 year 2 mons -3 days 04:05:06.5".
+func parseInterval(text string) (Interval, error) {
+	var interval Interval
+	fields := strings.Fields(text)
+	for idx := 0; idx < len(fields); idx++ {
+		field := fields[idx]
+		if strings.Contains(field, ":") {
+			micros, err := parseClock(field)
+			if err != nil {
+				return Interval{}, fmt.Errorf("invalid interval %q: %w", text, err)
+			}
+			interval.Microseconds += micros
+			continue
+		}
+
+		if idx+1 >= len(fields) {
+			return Interval{}, fmt.Errorf("invalid interval %q", text)
+		}
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return Interval{}, fmt.Errorf("invalid interval %q: %w", text, err)
+		}
+		idx++
+		switch unit := strings.TrimSuffix(fields[idx], "s"); unit {
+		case "year":
+			interval.Months += value * 12
+		case "mon":
+			interval.Months += value
+		case "day":
+			interval.Days += value
+		default:
+			return Interval{}, fmt.Errorf("invalid interval %q: unknown unit %q", text, fields[idx])
+		}
+	}
+	return interval, nil
+}
+
+// Parse [-]hh:mm:ss[.ffffff] into microseconds.
+func parseClock(clock string) (int64, error) {
+	sign := int64(1)
+	if strings.HasPrefix(clock, "-") {
+		sign, clock = -1, clock[1:]
+	} else {
+		clock = strings.TrimPrefix(clock, "+")
+	}
+
+	parts := strings.Split(clock, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	hours, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, err
+	}
+	micros := (hours*3600+minutes*60)*1e6 + int64(seconds*1e6+0.5)
+	return sign * micros, nil
+}
+
+// Parse an inet or cidr value. A bare address is given a full-length mask, and
+// the host bits of an inet are kept.
+func parseInet(text string) (*net.IPNet, error) {
+	if !strings.Contains(text, "/") {
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid inet %q", text)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	ip, network, err := net.ParseCIDR(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inet %q: %w", text, err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
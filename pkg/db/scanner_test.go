@@ -0,0 +1,163 @@
+package db
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetalScanner(t *testing.T) {
+	timestamp := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		dbType   string
+		src      interface{}
+		expected interface{}
+	}{
+		// Values the driver has already decoded
+		{name: "null", dbType: "TEXT", src: nil, expected: nil},
+		{name: "int2", dbType: "INT2", src: int64(-1), expected: int64(-1)},
+		{name: "int8", dbType: "INT8", src: int64(9000000000), expected: int64(9000000000)},
+		{name: "float8", dbType: "FLOAT8", src: float64(1.5), expected: float64(1.5)},
+		{name: "bool", dbType: "BOOL", src: true, expected: true},
+		{name: "timestamptz", dbType: "TIMESTAMPTZ", src: timestamp, expected: timestamp},
+
+		// Text the driver hands over as a Go string
+		{name: "text as string", dbType: "TEXT", src: "/data/coordinator/gpseg-1", expected: "/data/coordinator/gpseg-1"},
+		{name: "varchar as string", dbType: "VARCHAR", src: "sdw1", expected: "sdw1"},
+		{name: "char role as string", dbType: "CHAR", src: "p", expected: "p"},
+		{name: "unknown type as string", dbType: "", src: "gp_segment_configuration", expected: "gp_segment_configuration"},
+
+		// Text the driver hands over as bytes
+		{name: "name", dbType: "NAME", src: []byte("pg_class"), expected: "pg_class"},
+		{name: "bpchar", dbType: "BPCHAR", src: []byte("u"), expected: "u"},
+		{name: "uuid", dbType: "UUID", src: []byte("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"), expected: "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"},
+		{name: "bytea", dbType: "BYTEA", src: []byte{0xde, 0xad}, expected: []byte{0xde, 0xad}},
+		{name: "numeric", dbType: "NUMERIC", src: []byte("12345678901234567890.0001"), expected: Numeric("12345678901234567890.0001")},
+		{name: "numeric nan", dbType: "NUMERIC", src: []byte("NaN"), expected: Numeric("NaN")},
+		{name: "oid", dbType: "OID", src: []byte("4294967295"), expected: int64(4294967295)},
+		{name: "xid", dbType: "XID", src: []byte("1234"), expected: int64(1234)},
+		{name: "int2vector", dbType: "INT2VECTOR", src: []byte("1 3 5"), expected: []int64{1, 3, 5}},
+		{name: "empty oidvector", dbType: "OIDVECTOR", src: []byte(""), expected: []int64{}},
+		{name: "json", dbType: "JSON", src: []byte(`{"a": 1}`), expected: json.RawMessage(`{"a": 1}`)},
+		{name: "jsonb", dbType: "JSONB", src: []byte(`[1, 2]`), expected: json.RawMessage(`[1, 2]`)},
+		{name: "inet host", dbType: "INET", src: []byte("10.0.0.5"),
+			expected: &net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(32, 32)}},
+		{name: "inet with mask keeps host", dbType: "INET", src: []byte("10.0.0.5/24"),
+			expected: &net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(24, 32)}},
+		{name: "cidr v6", dbType: "CIDR", src: []byte("2001:db8::/32"),
+			expected: &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)}},
+		{name: "interval clock", dbType: "INTERVAL", src: []byte("00:05:30.25"),
+			expected: Interval{Microseconds: 330250000}},
+		{name: "interval full", dbType: "INTERVAL", src: []byte("1 year 2 mons -3 days -04:00:00"),
+			expected: Interval{Months: 14, Days: -3, Microseconds: -4 * 3600e6}},
+		{name: "interval days", dbType: "INTERVAL", src: []byte("1 day"), expected: Interval{Days: 1}},
+		{name: "interval iso_8601 as string", dbType: "INTERVAL", src: []byte("P1Y2M-3DT-4H"), expected: "P1Y2M-3DT-4H"},
+		{name: "interval sql_standard as string", dbType: "INTERVAL", src: []byte("+1-2 -3 -4:00:00"), expected: "+1-2 -3 -4:00:00"},
+
+		// Arrays
+		{name: "text array", dbType: "_TEXT", src: []byte(`{fillfactor=70,"a b","with \"quote\"",NULL,"NULL"}`),
+			expected: []string{"fillfactor=70", "a b", `with "quote"`, "", "NULL"}},
+		{name: "name array", dbType: "_NAME", src: []byte(`{gpadmin,"Mixed Case"}`), expected: []string{"gpadmin", "Mixed Case"}},
+		{name: "empty array", dbType: "_TEXT", src: []byte(`{}`), expected: []string{}},
+		{name: "int2 array", dbType: "_INT2", src: []byte(`{1,2,NULL}`), expected: []int64{1, 2, 0}},
+		{name: "oid array with bounds", dbType: "_OID", src: []byte(`[0:1]={16384,16385}`), expected: []int64{16384, 16385}},
+		{name: "float array", dbType: "_FLOAT8", src: []byte(`{0.5,-1}`), expected: []float64{0.5, -1}},
+		{name: "bool array", dbType: "_BOOL", src: []byte(`{t,f}`), expected: []bool{true, false}},
+		{name: "numeric array", dbType: "_NUMERIC", src: []byte(`{1.10,NaN}`), expected: []Numeric{"1.10", "NaN"}},
+		{name: "aclitem array", dbType: "_ACLITEM", src: []byte(`{gpadmin=arwdDxt/gpadmin,=r/gpadmin}`),
+			expected: []string{"gpadmin=arwdDxt/gpadmin", "=r/gpadmin"}},
+		{name: "multi-dimensional array as string", dbType: "_INT4", src: []byte("{{1,2},{3,4}}"), expected: "{{1,2},{3,4}}"},
+		{name: "multi-dimensional array with bounds as string", dbType: "_TEXT", src: []byte("[0:1][1:1]={{a},{b}}"),
+			expected: "[0:1][1:1]={{a},{b}}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scanner := NewMetalScanner(tc.dbType)
+			if err := scanner.Scan(tc.src); err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			value, valid := scanner.Value()
+			if !valid {
+				t.Errorf("Expected the scanner to be marked valid")
+			}
+			if !reflect.DeepEqual(value, tc.expected) {
+				t.Errorf("Expected %#v (%T), got %#v (%T)", tc.expected, tc.expected, value, value)
+			}
+		})
+	}
+}
+
+func TestMetalScannerErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		dbType string
+		src    interface{}
+	}{
+		{name: "bad oid", dbType: "OID", src: []byte("abc")},
+		{name: "bad vector", dbType: "INT2VECTOR", src: []byte("1 x")},
+		{name: "bad inet", dbType: "INET", src: []byte("not-an-ip")},
+		{name: "bad array", dbType: "_TEXT", src: []byte("a,b")},
+		{name: "unsupported driver type", dbType: "TEXT", src: struct{}{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := NewMetalScanner(tc.dbType).Scan(tc.src); err == nil {
+				t.Errorf("Expected an error scanning %v as %s", tc.src, tc.dbType)
+			}
+		})
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	if value, err := Numeric("42").Int64(); err != nil || value != 42 {
+		t.Errorf("Expected 42, got %v (%v)", value, err)
+	}
+	if _, err := Numeric("4.2").Int64(); err == nil {
+		t.Errorf("Expected an error converting a fraction to int64")
+	}
+	if value, err := Numeric("4.25").Float64(); err != nil || value != 4.25 {
+		t.Errorf("Expected 4.25, got %v (%v)", value, err)
+	}
+	if _, err := Numeric("NaN").Rat(); err == nil {
+		t.Errorf("Expected an error for NaN")
+	}
+}
+
+func TestInterval(t *testing.T) {
+	testCases := []struct {
+		interval Interval
+		text     string
+		duration time.Duration
+	}{
+		{Interval{}, "00:00:00", 0},
+		{Interval{Microseconds: 330250000}, "00:05:30.25", 5*time.Minute + 30250*time.Millisecond},
+		{Interval{Months: 14, Days: -3, Microseconds: -4 * 3600e6}, "1 year 2 mons -3 days -04:00:00", (14*30-3)*24*time.Hour - 4*time.Hour},
+		{Interval{Days: 1}, "1 day", 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		if text := tc.interval.String(); text != tc.text {
+			t.Errorf("Expected %q, got %q", tc.text, text)
+		}
+		if duration := tc.interval.Duration(); duration != tc.duration {
+			t.Errorf("Expected %v for %q, got %v", tc.duration, tc.text, duration)
+		}
+		if parsed, err := parseInterval(tc.text); err != nil || parsed != tc.interval {
+			t.Errorf("Expected %q to round trip, got %+v (%v)", tc.text, parsed, err)
+		}
+	}
+}
+
+func TestParseIntervalOtherStyles(t *testing.T) {
+	for _, text := range []string{"P1Y2M-3DT-4H", "+1-2 -3 -4:00:00", "3 fortnights"} {
+		if parsed, err := parseInterval(text); err == nil {
+			t.Errorf("Expected %q not to parse, got %+v", text, parsed)
+		}
+	}
+}
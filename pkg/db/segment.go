@@ -0,0 +1,183 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Segment roles as stored in gp_segment_configuration.
+const (
+	RolePrimary = "p"
+	RoleMirror  = "m"
+)
+
+// CoordinatorContentID is the content id of the coordinator and its standby.
+const CoordinatorContentID = -1
+
+// Segment is one row of gp_segment_configuration.
+type Segment struct {
+	DBID          int    `db:"dbid"`
+	ContentID     int    `db:"content"`
+	Role          string `db:"role"`
+	PreferredRole string `db:"preferred_role"`
+	Mode          string `db:"mode"`
+	Status        string `db:"status"`
+	Port          int    `db:"port"`
+	Hostname      string `db:"hostname"`
+	Address       string `db:"address"`
+	DataDir       string `db:"datadir"`
+}
+
+// IsPrimary reports whether the segment is currently acting as a primary.
+func (segment Segment) IsPrimary() bool {
+	return segment.Role == RolePrimary
+}
+
+// IsUp reports whether the segment is marked up.
+func (segment Segment) IsUp() bool {
+	return segment.Status == "u"
+}
+
+func (segment Segment) String() string {
+	return fmt.Sprintf("content %d %s (dbid %d) on %s:%d", segment.ContentID, segment.Role, segment.DBID, segment.Hostname, segment.Port)
+}
+
+const segmentsQuery = `select dbid, content, role, preferred_role, mode, status, port, hostname, address, datadir
+from gp_segment_configuration
+order by content, role desc`
+
+// Segments lists every coordinator, standby, primary and mirror from
+// gp_segment_configuration, ordered by content id with primaries first.
+func (client *Client) Segments(ctx context.Context) ([]Segment, error) {
+	return ListSegments(ctx, client)
+}
+
+// ListSegments is Client.Segments for any Querier.
+func ListSegments(ctx context.Context, querier Querier) ([]Segment, error) {
+	result, err := querier.ExecuteQueryContext(ctx, segmentsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query gp_segment_configuration: %w", err)
+	}
+
+	var segments []Segment
+	if err := result.ScanStructs(&segments); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// Segment looks up the segment with the given content id and role.
+func (client *Client) Segment(ctx context.Context, contentID int, role string) (Segment, error) {
+	segments, err := client.Segments(ctx)
+	if err != nil {
+		return Segment{}, err
+	}
+	for _, segment := range segments {
+		if segment.ContentID == contentID && segment.Role == role {
+			return segment, nil
+		}
+	}
+	return Segment{}, fmt.Errorf("no segment with content id %d and role %s", contentID, role)
+}
+
+// ConnectSegment opens a utility-mode connection directly to a segment,
+// using the coordinator connection's credentials and database. The caller
+// must close the returned client.
+func (client *Client) ConnectSegment(ctx context.Context, segment Segment) (*Client, error) {
+	info, err := client.ServerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	connString := client.connString
+	connString.Hostname = segment.Address
+	if connString.Hostname == "" {
+		connString.Hostname = segment.Hostname
+	}
+	connString.Port = segment.Port
+	connString.StandbyHostname = ""
+	connString.StandbyPort = 0
+	// A single connection is plenty for a per-segment check
+	connString.MaxOpenConns = 1
+
+	params := make(map[string]string, len(connString.RuntimeParams)+1)
+	for key, value := range connString.RuntimeParams {
+		params[key] = value
+	}
+	params[utilityModeParam(info)] = "utility"
+	connString.RuntimeParams = params
+
+	log.Debugf("Opening utility mode connection to %s", segment)
+	segClient, err := NewClientContext(ctx, connString)
+	if err != nil {
+		return nil, err
+	}
+	// The segment runs the same server build as the coordinator
+	segClient.info = info
+	return segClient, nil
+}
+
+// Greenplum 7 renamed gp_session_role to gp_role.
+func utilityModeParam(info *ServerInfo) string {
+	if info.IsGreenplum && info.GreenplumVersion.Major < 7 {
+		return "gp_session_role"
+	}
+	return "gp_role"
+}
+
+// SegmentResult is the outcome of running a check against one segment.
+type SegmentResult struct {
+	Segment Segment
+	Err     error
+}
+
+// RunOnSegments connects to each segment in utility mode and calls check
+// with that connection, running at most parallel checks at a time (all of
+// them when parallel is zero or less). A failure on one segment does not stop
+// the others; results are returned in the order of segments.
+func (client *Client) RunOnSegments(ctx context.Context, segments []Segment, parallel int,
+	check func(ctx context.Context, segment Segment, segClient *Client) error) []SegmentResult {
+	if parallel <= 0 || parallel > len(segments) {
+		parallel = len(segments)
+	}
+
+	results := make([]SegmentResult, len(segments))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for idx, segment := range segments {
+		wg.Add(1)
+		go func(idx int, segment Segment) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			results[idx] = SegmentResult{Segment: segment, Err: client.runOnSegment(ctx, segment, check)}
+		}(idx, segment)
+	}
+	wg.Wait()
+	return results
+}
+
+func (client *Client) runOnSegment(ctx context.Context, segment Segment,
+	check func(ctx context.Context, segment Segment, segClient *Client) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	segClient, err := client.ConnectSegment(ctx, segment)
+	if err != nil {
+		return err
+	}
+	defer segClient.Close()
+	return check(ctx, segment, segClient)
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSegmentScan(t *testing.T) {
+	columns := []Column{
+		{Name: "dbid", DatabaseType: "INT2"}, {Name: "content", DatabaseType: "INT2"},
+		{Name: "role", DatabaseType: "CHAR"}, {Name: "preferred_role", DatabaseType: "CHAR"},
+		{Name: "mode", DatabaseType: "CHAR"}, {Name: "status", DatabaseType: "CHAR"},
+		{Name: "port", DatabaseType: "INT4"}, {Name: "hostname", DatabaseType: "TEXT"},
+		{Name: "address", DatabaseType: "TEXT"}, {Name: "datadir", DatabaseType: "TEXT"},
+	}
+	result := &Result{Columns: columns, Rows: []Row{
+		{columns: columns, values: []interface{}{int64(2), int64(0), "p", "p", "s", "u", int64(6000), "sdw1", "sdw1-1", "/data/primary/gpseg0"}},
+		{columns: columns, values: []interface{}{int64(4), int64(0), "m", "m", "s", "d", int64(7000), "sdw2", "sdw2-1", "/data/mirror/gpseg0"}},
+	}}
+
+	var segments []Segment
+	if err := result.ScanStructs(&segments); err != nil {
+		t.Fatalf("ScanStructs failed: %v", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segments))
+	}
+	primary, mirror := segments[0], segments[1]
+	if !primary.IsPrimary() || !primary.IsUp() || primary.Port != 6000 || primary.DataDir != "/data/primary/gpseg0" {
+		t.Errorf("Unexpected primary %+v", primary)
+	}
+	if mirror.IsPrimary() || mirror.IsUp() || mirror.Address != "sdw2-1" {
+		t.Errorf("Unexpected mirror %+v", mirror)
+	}
+}
+
+func TestUtilityModeParam(t *testing.T) {
+	gp6, _ := ParseVersion("PostgreSQL 9.4.26 (Greenplum Database 6.25.3 build commit:abc)")
+	gp7, _ := ParseVersion("PostgreSQL 12.12 (Greenplum Database 7.1.0 build commit:abc)")
+
+	if param := utilityModeParam(gp6); param != "gp_session_role" {
+		t.Errorf("Expected gp_session_role for Greenplum 6, got %s", param)
+	}
+	if param := utilityModeParam(gp7); param != "gp_role" {
+		t.Errorf("Expected gp_role for Greenplum 7, got %s", param)
+	}
+}
+
+func TestRunOnSegmentsIsolatesFailures(t *testing.T) {
+	gp7, _ := ParseVersion("PostgreSQL 12.12 (Greenplum Database 7.1.0 build commit:abc)")
+	// Nothing listens on port 1, so every connection is refused
+	client := &Client{connString: ConnString{Username: "gpadmin", Database: "template1"}, info: gp7}
+	segments := []Segment{
+		{ContentID: 0, Role: RolePrimary, Address: "127.0.0.1", Port: 1},
+		{ContentID: 1, Role: RolePrimary, Address: "127.0.0.1", Port: 1},
+	}
+
+	called := false
+	results := client.RunOnSegments(context.Background(), segments, 1,
+		func(ctx context.Context, segment Segment, segClient *Client) error {
+			called = true
+			return nil
+		})
+
+	if called {
+		t.Errorf("Expected the check not to run without a connection")
+	}
+	if len(results) != len(segments) {
+		t.Fatalf("Expected %d results, got %d", len(segments), len(results))
+	}
+	for idx, result := range results {
+		if result.Segment.ContentID != idx {
+			t.Errorf("Expected results in segment order, got content %d at %d", result.Segment.ContentID, idx)
+		}
+		if !errors.Is(result.Err, ErrConnectionRefused) {
+			t.Errorf("Expected ErrConnectionRefused for %s, got %v", result.Segment, result.Err)
+		}
+	}
+}
+
+func TestRuntimeParamsInURI(t *testing.T) {
+	uri := ConnString{RuntimeParams: map[string]string{"gp_role": "utility", "application_name": "gpmt"}}.uri()
+	if !strings.Contains(uri, "application_name='gpmt' default_transaction_read_only='on' gp_role='utility'") {
+		t.Errorf("Expected sorted runtime parameters in %s", uri)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is a dotted major.minor.patch version number.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (version Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+}
+
+// AtLeast reports whether version is the same as or newer than major.minor.
+func (version Version) AtLeast(major int, minor int) bool {
+	return version.Major > major || (version.Major == major && version.Minor >= minor)
+}
+
+// ServerInfo describes the server a Client is connected to, so that tools can
+// choose the right catalog queries for Greenplum 6 and 7.
+type ServerInfo struct {
+	// VersionString is the full output of version()
+	VersionString    string
+	PostgresVersion  Version
+	GreenplumVersion Version
+	// IsGreenplum is false when connected to plain PostgreSQL
+	IsGreenplum bool
+	// ResourceManager is the value of gp_resource_manager, e.g. "queue",
+	// "group" or "group-v2"; empty on plain PostgreSQL.
+	ResourceManager string
+	// Relations in the gp_toolkit schema, views and external tables alike
+	GPToolkitRelations map[string]bool
+}
+
+var (
+	postgresVersionRegexp  = regexp.MustCompile(`PostgreSQL (\d+)\.(\d+)(?:\.(\d+))?`)
+	greenplumVersionRegexp = regexp.MustCompile(`Greenplum Database (\d+)\.(\d+)\.(\d+)`)
+)
+
+// Catalog queries used to build the ServerInfo.
+const (
+	versionQuery         = "select version() as version"
+	resourceManagerQuery = "select setting from pg_settings where name = 'gp_resource_manager'"
+	gpToolkitQuery       = "select c.relname from pg_class c join pg_namespace n on n.oid = c.relnamespace where n.nspname = 'gp_toolkit'"
+)
+
+// ServerInfo looks up the server's version and capabilities. The answer is
+// cached on the client after the first successful lookup.
+func (client *Client) ServerInfo(ctx context.Context) (*ServerInfo, error) {
+	client.infoLock.Lock()
+	defer client.infoLock.Unlock()
+	if client.info != nil {
+		return client.info, nil
+	}
+
+	info, err := LookupServerInfo(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	client.info = info
+	return info, nil
+}
+
+// LookupServerInfo runs the catalog queries behind ServerInfo against any
+// Querier, without caching.
+func LookupServerInfo(ctx context.Context, querier Querier) (*ServerInfo, error) {
+	result, err := querier.ExecuteQueryContext(ctx, versionQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+	if result.Len() != 1 {
+		return nil, fmt.Errorf("version() returned %d rows", result.Len())
+	}
+	versionString, err := result.Rows[0].String("version")
+	if err != nil {
+		return nil, err
+	}
+	info, err := ParseVersion(versionString)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsGreenplum {
+		result, err = querier.ExecuteQueryContext(ctx, resourceManagerQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query gp_resource_manager: %w", err)
+		}
+		if result.Len() > 0 {
+			if info.ResourceManager, err = result.Rows[0].String("setting"); err != nil {
+				return nil, err
+			}
+		}
+
+		result, err = querier.ExecuteQueryContext(ctx, gpToolkitQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list gp_toolkit relations: %w", err)
+		}
+		for _, row := range result.Rows {
+			name, err := row.String("relname")
+			if err != nil {
+				return nil, err
+			}
+			info.GPToolkitRelations[name] = true
+		}
+	}
+
+	return info, nil
+}
+
+// ParseVersion builds a ServerInfo from the output of version(). Only the
+// version fields are filled in.
+func ParseVersion(versionString string) (*ServerInfo, error) {
+	info := &ServerInfo{VersionString: versionString, GPToolkitRelations: make(map[string]bool)}
+
+	match := postgresVersionRegexp.FindStringSubmatch(versionString)
+	if match == nil {
+		return nil, fmt.Errorf("unrecognised server version %q", versionString)
+	}
+	info.PostgresVersion = versionFromMatch(match)
+
+	if match := greenplumVersionRegexp.FindStringSubmatch(versionString); match != nil {
+		info.IsGreenplum = true
+		info.GreenplumVersion = versionFromMatch(match)
+	}
+	return info, nil
+}
+
+func versionFromMatch(match []string) Version {
+	var parts [3]int
+	for idx := range parts {
+		if idx+1 < len(match) && match[idx+1] != "" {
+			parts[idx], _ = strconv.Atoi(match[idx+1])
+		}
+	}
+	return Version{Major: parts[0], Minor: parts[1], Patch: parts[2]}
+}
+
+// CoordinatorTerm is what the server calls the node with content -1:
+// "coordinator" from Greenplum 7 onwards and "master" before.
+func (info *ServerInfo) CoordinatorTerm() string {
+	if info.IsGreenplum && info.GreenplumVersion.Major < 7 {
+		return "master"
+	}
+	return "coordinator"
+}
+
+// LogDirectory is the name of the server log directory inside a data
+// directory: "pg_log" up to PostgreSQL 9.6 (Greenplum 6) and "log" after.
+func (info *ServerInfo) LogDirectory() string {
+	if info.PostgresVersion.Major < 10 {
+		return "pg_log"
+	}
+	return "log"
+}
+
+// HasGPToolkit reports whether the named relation exists in gp_toolkit.
+func (info *ServerInfo) HasGPToolkit(relation string) bool {
+	return info.GPToolkitRelations[strings.TrimPrefix(relation, "gp_toolkit.")]
+}
+
+// UsesResourceGroups reports whether workload management uses resource
+// groups rather than resource queues.
+func (info *ServerInfo) UsesResourceGroups() bool {
+	return strings.HasPrefix(info.ResourceManager, "group")
+}
+
+// UsesResourceQueues reports whether workload management uses resource
+// queues.
+func (info *ServerInfo) UsesResourceQueues() bool {
+	return info.ResourceManager == "queue"
+}
@@ -0,0 +1,85 @@
+package db
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	testCases := []struct {
+		name            string
+		version         string
+		greenplum       bool
+		postgres        Version
+		gpdb            Version
+		coordinatorTerm string
+		logDirectory    string
+	}{
+		{
+			name:            "greenplum 6",
+			version:         "PostgreSQL 9.4.26 (Greenplum Database 6.25.3 build commit:367edc6b4dfd909fe38fc288ade9e294d74e3f9a Open Source) on x86_64-unknown-linux-gnu, compiled by gcc (GCC) 6.4.0, 64-bit compiled on Sep  6 2023 23:51:53",
+			greenplum:       true,
+			postgres:        Version{9, 4, 26},
+			gpdb:            Version{6, 25, 3},
+			coordinatorTerm: "master",
+			logDirectory:    "pg_log",
+		},
+		{
+			name:            "greenplum 7",
+			version:         "PostgreSQL 12.12 (Greenplum Database 7.1.0 build commit:e7c2b1f14bb42a1018ac57d14f4436880e0a0515 Open Source) on x86_64-pc-linux-gnu, compiled by gcc (GCC) 8.5.0 20210514 (Red Hat 8.5.0-18), 64-bit compiled on Jan 19 2024 06:48:52 Bhuvnesh C.",
+			greenplum:       true,
+			postgres:        Version{12, 12, 0},
+			gpdb:            Version{7, 1, 0},
+			coordinatorTerm: "coordinator",
+			logDirectory:    "log",
+		},
+		{
+			name:            "postgres",
+			version:         "PostgreSQL 16.2 on x86_64-pc-linux-gnu, compiled by gcc (GCC) 12.2.0, 64-bit",
+			postgres:        Version{16, 2, 0},
+			coordinatorTerm: "coordinator",
+			logDirectory:    "log",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := ParseVersion(tc.version)
+			if err != nil {
+				t.Fatalf("ParseVersion failed: %v", err)
+			}
+			if info.IsGreenplum != tc.greenplum {
+				t.Errorf("Expected IsGreenplum %v, got %v", tc.greenplum, info.IsGreenplum)
+			}
+			if info.PostgresVersion != tc.postgres {
+				t.Errorf("Expected PostgreSQL %v, got %v", tc.postgres, info.PostgresVersion)
+			}
+			if info.GreenplumVersion != tc.gpdb {
+				t.Errorf("Expected Greenplum %v, got %v", tc.gpdb, info.GreenplumVersion)
+			}
+			if term := info.CoordinatorTerm(); term != tc.coordinatorTerm {
+				t.Errorf("Expected coordinator term %s, got %s", tc.coordinatorTerm, term)
+			}
+			if dir := info.LogDirectory(); dir != tc.logDirectory {
+				t.Errorf("Expected log directory %s, got %s", tc.logDirectory, dir)
+			}
+		})
+	}
+
+	if _, err := ParseVersion("MySQL 8.0"); err == nil {
+		t.Errorf("Expected an error for a non-PostgreSQL version string")
+	}
+}
+
+func TestServerInfoCapabilities(t *testing.T) {
+	info := &ServerInfo{
+		ResourceManager:    "group-v2",
+		GPToolkitRelations: map[string]bool{"gp_log_system": true},
+	}
+	if !info.UsesResourceGroups() || info.UsesResourceQueues() {
+		t.Errorf("Expected group-v2 to count as resource groups")
+	}
+	if !info.HasGPToolkit("gp_toolkit.gp_log_system") || info.HasGPToolkit("gp_log_master_concise") {
+		t.Errorf("Unexpected gp_toolkit lookups for %v", info.GPToolkitRelations)
+	}
+	if !(Version{7, 1, 0}).AtLeast(7, 0) || (Version{6, 25, 3}).AtLeast(7, 0) {
+		t.Errorf("Unexpected AtLeast results")
+	}
+}
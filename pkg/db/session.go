@@ -0,0 +1,96 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultApplicationName is reported in pg_stat_activity for every gpmt
+// session unless the ConnString overrides it.
+const DefaultApplicationName = "gpmt"
+
+// The settings every session starts with. gpmt runs on production clusters,
+// so sessions default to read-only transactions; ExecuteWriteQuery is the
+// only way to get a read-write one. RuntimeParams may add to these or change
+// the application name, but cannot lift the read-only default.
+func (connString ConnString) sessionParams() map[string]string {
+	params := map[string]string{"application_name": DefaultApplicationName}
+	for key, value := range connString.RuntimeParams {
+		params[key] = value
+	}
+	if connString.ApplicationName != "" {
+		params["application_name"] = connString.ApplicationName
+	}
+	if connString.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.FormatInt(connString.StatementTimeout.Milliseconds(), 10)
+	}
+	params["default_transaction_read_only"] = "on"
+	return params
+}
+
+// ExecuteWriteQuery runs a statement that changes server state, such as
+// cancelling a backend, in an explicit READ WRITE transaction and commits it.
+// Sessions are read-only by default, so this is the opt-in for the rare
+// diagnostic action that needs it; never use it for catalog queries.
+func (client *Client) ExecuteWriteQuery(ctx context.Context, query string, args ...interface{}) (*Result, error) {
+	ctx, cancel := client.queryContext(ctx)
+	defer cancel()
+
+	log.Warn("Executing a read-write statement: " + query)
+	tx, err := client.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: false})
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+
+	result, err := func() (*Result, error) {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		return readResult(rows)
+	}()
+	if err != nil {
+		tx.Rollback()
+		return nil, queryError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return result, nil
+}
+
+// CancelBackend cancels the query running in the backend with the given
+// process id, reporting whether the signal was sent.
+func (client *Client) CancelBackend(ctx context.Context, pid int) (bool, error) {
+	return client.signalBackend(ctx, "pg_cancel_backend", pid)
+}
+
+// TerminateBackend terminates the backend with the given process id,
+// reporting whether the signal was sent.
+func (client *Client) TerminateBackend(ctx context.Context, pid int) (bool, error) {
+	return client.signalBackend(ctx, "pg_terminate_backend", pid)
+}
+
+func (client *Client) signalBackend(ctx context.Context, function string, pid int) (bool, error) {
+	result, err := client.ExecuteWriteQuery(ctx, "select "+function+"($1) as signalled", pid)
+	if err != nil {
+		return false, fmt.Errorf("%s(%d) failed: %w", function, pid, err)
+	}
+	if result.Len() != 1 {
+		return false, fmt.Errorf("%s(%d) returned %d rows", function, pid, result.Len())
+	}
+	return result.Rows[0].Bool("signalled")
+}
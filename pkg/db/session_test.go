@@ -0,0 +1,40 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionParams(t *testing.T) {
+	testCases := []struct {
+		name       string
+		connString ConnString
+		expected   map[string]string
+	}{
+		{
+			name:       "defaults",
+			connString: ConnString{},
+			expected:   map[string]string{"application_name": "gpmt", "default_transaction_read_only": "on"},
+		},
+		{
+			name:       "statement timeout and application name",
+			connString: ConnString{StatementTimeout: 90 * time.Second, ApplicationName: "gpmt-analyze"},
+			expected: map[string]string{"application_name": "gpmt-analyze", "default_transaction_read_only": "on",
+				"statement_timeout": "90000"},
+		},
+		{
+			name:       "read only cannot be lifted",
+			connString: ConnString{RuntimeParams: map[string]string{"default_transaction_read_only": "off", "gp_role": "utility"}},
+			expected:   map[string]string{"application_name": "gpmt", "default_transaction_read_only": "on", "gp_role": "utility"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if params := tc.connString.sessionParams(); !reflect.DeepEqual(params, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, params)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SSL modes understood by the driver.
+const (
+	SSLModeDisable    = "disable"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+)
+
+var sslModes = []string{SSLModeDisable, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull}
+
+// libpq's "allow" and "prefer" are not supported by lib/pq. As "prefer" is
+// libpq's default and often exported as PGSSLMODE, both are treated as
+// disable rather than failing every connection.
+var fallbackSSLModes = map[string]bool{"allow": true, "prefer": true}
+
+// The fallback is reported once, not on every segment connection
+var fallbackWarning sync.Once
+
+// The effective SSL mode, defaulting to disable as gpmt always has.
+func (connString ConnString) sslMode() string {
+	if connString.SSLMode == "" || fallbackSSLModes[connString.SSLMode] {
+		return SSLModeDisable
+	}
+	return connString.SSLMode
+}
+
+// validateSSL checks the TLS settings before we hand them to the driver so
+// that a typo in a flag gives an actionable error rather than a handshake
+// failure.
+func (connString ConnString) validateSSL() error {
+	if fallbackSSLModes[connString.SSLMode] {
+		fallbackWarning.Do(func() {
+			log.Warnf("sslmode %q is not supported by the driver, connecting without TLS; use sslmode=%s to encrypt the connection",
+				connString.SSLMode, SSLModeRequire)
+		})
+	}
+	mode := connString.sslMode()
+	valid := false
+	for _, known := range sslModes {
+		if mode == known {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("unsupported sslmode %q; use one of %s", mode, strings.Join(sslModes, ", "))
+	}
+
+	if mode == SSLModeDisable {
+		return nil
+	}
+
+	if (connString.SSLCert == "") != (connString.SSLKey == "") {
+		return fmt.Errorf("sslcert and sslkey must be given together")
+	}
+	for _, file := range []struct{ name, path string }{
+		{"sslrootcert", connString.SSLRootCert},
+		{"sslcert", connString.SSLCert},
+		{"sslkey", connString.SSLKey},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+	return nil
+}
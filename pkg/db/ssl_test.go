@@ -0,0 +1,67 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestValidateSSL(t *testing.T) {
+	cert := writeFile(t, "client.crt", "cert", 0600)
+	key := writeFile(t, "client.key", "key", 0600)
+
+	testCases := []struct {
+		name        string
+		connString  ConnString
+		expectError bool
+	}{
+		{name: "default disable", connString: ConnString{}},
+		{name: "require", connString: ConnString{SSLMode: SSLModeRequire}},
+		{name: "verify-full with files", connString: ConnString{SSLMode: SSLModeVerifyFull, SSLRootCert: cert, SSLCert: cert, SSLKey: key}},
+		{name: "prefer falls back to disable", connString: ConnString{SSLMode: "prefer"}},
+		{name: "allow falls back to disable", connString: ConnString{SSLMode: "allow"}},
+		{name: "unknown mode", connString: ConnString{SSLMode: "required"}, expectError: true},
+		{name: "cert without key", connString: ConnString{SSLMode: SSLModeRequire, SSLCert: cert}, expectError: true},
+		{name: "missing root cert", connString: ConnString{SSLMode: SSLModeVerifyCA, SSLRootCert: "/nonexistent/root.crt"}, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.connString.validateSSL()
+			if tc.expectError && err == nil {
+				t.Errorf("Expected an error for %+v", tc.connString)
+			} else if !tc.expectError && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSSLURI(t *testing.T) {
+	connString := ConnString{Hostname: "cdw", SSLMode: SSLModeVerifyFull, SSLRootCert: "/etc/gpmt/root.crt"}
+	uri := connString.uri()
+	for _, expected := range []string{"sslmode=verify-full", "sslrootcert='/etc/gpmt/root.crt'"} {
+		if !strings.Contains(uri, expected) {
+			t.Errorf("Expected %q in %s", expected, uri)
+		}
+	}
+	if uri := (ConnString{}).uri(); !strings.Contains(uri, "sslmode=disable") {
+		t.Errorf("Expected sslmode=disable by default, got %s", uri)
+	}
+	if uri := (ConnString{SSLMode: "prefer"}).uri(); !strings.Contains(uri, "sslmode=disable") {
+		t.Errorf("Expected sslmode=prefer to connect with sslmode=disable, got %s", uri)
+	}
+}
+
+func TestSSLErrors(t *testing.T) {
+	if got := classifyConnectionError(pq.ErrSSLNotSupported); got != ErrSSL {
+		t.Errorf("Expected ErrSSL for a server without TLS, got %v", got)
+	}
+
+	_, err := NewClient(ConnString{Hostname: "127.0.0.1", Port: 1, SSLMode: "required"})
+	if !errors.Is(err, ErrSSL) {
+		t.Errorf("Expected ErrSSL for an unsupported sslmode, got %v", err)
+	}
+}
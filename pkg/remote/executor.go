@@ -0,0 +1,120 @@
+/*
+Greenplum Magic Tool
+
+Authored by Tyler Ramer, Ignacio Elizaga
+Copyright 2018
+
+Licensed under the Apache License, Version 2.0 (the "License")
+*/
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultConnectTimeout bounds how long ssh waits to reach a host.
+const DefaultConnectTimeout = 10 * time.Second
+
+// Executor runs shell commands on cluster hosts. SSHExecutor is used against a
+// real cluster; LocalExecutor runs everything on this machine, which lets the
+// collectors be tested without sshd.
+type Executor interface {
+	// Run executes command with the POSIX shell on host, feeding it stdin
+	// (which may be nil) and copying its standard output to stdout. A
+	// non-zero exit is returned as a *CommandError.
+	Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error
+}
+
+// CommandError is a command that ran but failed.
+type CommandError struct {
+	Host    string
+	Command string
+	Stderr  string
+	Err     error
+}
+
+func (err *CommandError) Error() string {
+	message := fmt.Sprintf("command on %s failed: %v", err.Host, err.Err)
+	if stderr := strings.TrimSpace(err.Stderr); stderr != "" {
+		message += ": " + stderr
+	}
+	return message
+}
+
+func (err *CommandError) Unwrap() error {
+	return err.Err
+}
+
+// SSHExecutor runs commands with the system ssh client, relying on the
+// passwordless ssh between cluster hosts that Greenplum itself requires.
+type SSHExecutor struct {
+	// User to log in as; empty uses the current user or ~/.ssh/config.
+	User string
+
+	// ConnectTimeout overrides DefaultConnectTimeout when non-zero.
+	ConnectTimeout time.Duration
+
+	// Options are extra -o options, such as "StrictHostKeyChecking=no".
+	Options []string
+}
+
+// Run implements Executor.
+func (executor *SSHExecutor) Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	timeout := executor.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	args := []string{"-o", "BatchMode=yes", "-o", fmt.Sprintf("ConnectTimeout=%d", int(timeout.Seconds()))}
+	for _, option := range executor.Options {
+		args = append(args, "-o", option)
+	}
+	if executor.User != "" {
+		args = append(args, "-l", executor.User)
+	}
+	args = append(args, "--", host, command)
+
+	return run(exec.CommandContext(ctx, "ssh", args...), host, command, stdin, stdout)
+}
+
+// LocalExecutor runs every command on this machine, whatever the host.
+type LocalExecutor struct{}
+
+// Run implements Executor.
+func (LocalExecutor) Run(ctx context.Context, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	return run(exec.CommandContext(ctx, "sh", "-c", command), host, command, stdin, stdout)
+}
+
+// Run the prepared command, capturing stderr for the error.
+func run(cmd *exec.Cmd, host string, command string, stdin io.Reader, stdout io.Writer) error {
+	log.WithField("host", host).Debug("Running: " + command)
+
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return &CommandError{Host: host, Command: command, Stderr: stderr.String(), Err: err}
+	}
+	return nil
+}
+
+// Output runs command on host and returns its standard output.
+func Output(ctx context.Context, executor Executor, host string, command string) ([]byte, error) {
+	var stdout bytes.Buffer
+	err := executor.Run(ctx, host, command, nil, &stdout)
+	return stdout.Bytes(), err
+}
+
+// Quote makes value safe to use as a single word in a POSIX shell command.
+func Quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,55 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	testCases := map[string]string{
+		"":                   "''",
+		"/data/primary":      "'/data/primary'",
+		"it's":               `'it'\''s'`,
+		"$(rm -rf /) `x` \\": "'$(rm -rf /) `x` \\'",
+	}
+	for value, expected := range testCases {
+		if quoted := Quote(value); quoted != expected {
+			t.Errorf("Quote(%q) = %s, expected %s", value, quoted, expected)
+		}
+	}
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	value := "a 'quoted' $HOME `path`\n"
+	output, err := Output(context.Background(), LocalExecutor{}, "sdw1", "printf %s "+Quote(value))
+	if err != nil {
+		t.Fatalf("Output failed: %v", err)
+	}
+	if string(output) != value {
+		t.Errorf("Expected %q back from the shell, got %q", value, output)
+	}
+}
+
+func TestLocalExecutorStdin(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := (LocalExecutor{}).Run(context.Background(), "sdw1", "tr a-z A-Z", strings.NewReader("segment"), &stdout); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stdout.String() != "SEGMENT" {
+		t.Errorf("Expected SEGMENT, got %q", stdout.String())
+	}
+}
+
+func TestLocalExecutorFailure(t *testing.T) {
+	_, err := Output(context.Background(), LocalExecutor{}, "sdw1", "echo no such file >&2; exit 3")
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("Expected a *CommandError, got %v", err)
+	}
+	if commandErr.Host != "sdw1" || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Expected the host and stderr in the error, got %v", err)
+	}
+}